@@ -2,28 +2,239 @@ package appconfig
 
 import "time"
 
-// Store settings
+// Courier sender kinds
 const (
-	PostgresStore = "Postgres"
-	MongoStore    = "Mongo"
+	SMTPSender   = "smtp"
+	StdoutSender = "stdout"
+	FileSender   = "file"
 )
 
-// Web server settings
+// Password hash algorithms
 const (
-	Port                   = 3000
-	Store                  = MongoStore
-	IdentityJSONSchemaPath = "file:////Users/trapck/go/krapi/model/schema.json"
+	Argon2idHash = "argon2id"
+	BcryptHash   = "bcrypt"
 )
 
-// Postgres settings
+// Store settings
 const (
-	PostgresDriver  = "postgres"
-	PostgresConnStr = "user=postgres password=postgres dbname=postgres sslmode=disable"
+	PostgresStore = "Postgres"
+	MongoStore    = "Mongo"
+	MemoryStore   = "Memory"
 )
 
-// Mongo settings
-const (
-	MongoHost       = "mongodb://localhost:27017"
-	MongoDBName     = "krapi"
-	MongoDefTimeout = 5 * time.Second
-)
+// Config is a runtime application configuration
+type Config struct {
+	Port             int               `json:"port" yaml:"port"`
+	AdminPort        int               `json:"admin_port" yaml:"admin_port"`
+	ShutdownTimeout  Duration          `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	ShutdownDelay    Duration          `json:"shutdown_delay" yaml:"shutdown_delay"`
+	Store            string            `json:"store" yaml:"store"`
+	IdentitySchemas  map[string]string `json:"identity_schemas" yaml:"identity_schemas"`
+	DefaultPageSize  int               `json:"default_page_size" yaml:"default_page_size"`
+	MaxPageSize      int               `json:"max_page_size" yaml:"max_page_size"`
+	MaxPatchAttempts int               `json:"max_patch_attempts" yaml:"max_patch_attempts"`
+	Verification     CodeConfig        `json:"verification" yaml:"verification"`
+	Recovery         RecoveryConfig    `json:"recovery" yaml:"recovery"`
+	Session          SessionConfig     `json:"session" yaml:"session"`
+	Courier          CourierConfig     `json:"courier" yaml:"courier"`
+	Password         PasswordConfig    `json:"password" yaml:"password"`
+	TOTP             TOTPConfig        `json:"totp" yaml:"totp"`
+	Auth             AuthConfig        `json:"auth" yaml:"auth"`
+	Postgres         PostgresConfig    `json:"postgres" yaml:"postgres"`
+	Mongo            MongoConfig       `json:"mongo" yaml:"mongo"`
+}
+
+// CodeConfig configures one-time codes sent to identity addresses.
+// A new code for the same address is issued not earlier than resend interval after the previous one and keeps
+// its failed attempts. A code guessed wrong max attempts times is locked and not reissued until it expires
+type CodeConfig struct {
+	TTL            Duration `json:"ttl" yaml:"ttl"`
+	MaxAttempts    int      `json:"max_attempts" yaml:"max_attempts"`
+	ResendInterval Duration `json:"resend_interval" yaml:"resend_interval"`
+}
+
+// RecoveryConfig configures account recovery.
+// A new token for the same identity is issued not earlier than resend interval after the previous one
+type RecoveryConfig struct {
+	TokenTTL       Duration `json:"token_ttl" yaml:"token_ttl"`
+	SessionTTL     Duration `json:"session_ttl" yaml:"session_ttl"`
+	ResendInterval Duration `json:"resend_interval" yaml:"resend_interval"`
+}
+
+// SessionConfig configures sessions issued on login
+type SessionConfig struct {
+	TTL          Duration `json:"ttl" yaml:"ttl"`
+	CookieName   string   `json:"cookie_name" yaml:"cookie_name"`
+	CookieSecure bool     `json:"cookie_secure" yaml:"cookie_secure"`
+}
+
+// CourierConfig configures delivery of messages to identity addresses
+type CourierConfig struct {
+	// Senders maps address channel (via) to sender kind: smtp, stdout or file
+	Senders map[string]string `json:"senders" yaml:"senders"`
+	// DevSenders allows stdout and file senders, which expose codes and tokens to whoever reads the output
+	DevSenders   bool       `json:"dev_senders" yaml:"dev_senders"`
+	File         string     `json:"file" yaml:"file"`
+	SMTP         SMTPConfig `json:"smtp" yaml:"smtp"`
+	TemplateDir  string     `json:"template_dir" yaml:"template_dir"`
+	MaxAttempts  int        `json:"max_attempts" yaml:"max_attempts"`
+	RetryBackoff Duration   `json:"retry_backoff" yaml:"retry_backoff"`
+	PollInterval Duration   `json:"poll_interval" yaml:"poll_interval"`
+}
+
+// SMTPConfig is a configuration of SMTP sender
+type SMTPConfig struct {
+	Addr     string `json:"addr" yaml:"addr"`
+	From     string `json:"from" yaml:"from"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// PasswordConfig configures password credentials. Stored hashes made with other algorithm
+// or parameters are upgraded on successful login
+type PasswordConfig struct {
+	Algorithm  string       `json:"algorithm" yaml:"algorithm"`
+	Argon2     Argon2Config `json:"argon2" yaml:"argon2"`
+	BcryptCost int          `json:"bcrypt_cost" yaml:"bcrypt_cost"`
+	MinLength  int          `json:"min_length" yaml:"min_length"`
+}
+
+// Argon2Config holds Argon2id parameters. Memory is in KiB
+type Argon2Config struct {
+	Memory      int `json:"memory" yaml:"memory"`
+	Iterations  int `json:"iterations" yaml:"iterations"`
+	Parallelism int `json:"parallelism" yaml:"parallelism"`
+	SaltLength  int `json:"salt_length" yaml:"salt_length"`
+	KeyLength   int `json:"key_length" yaml:"key_length"`
+}
+
+// TOTPConfig configures time-based one-time password credentials
+type TOTPConfig struct {
+	// Issuer is shown by authenticator apps next to the account name
+	Issuer        string `json:"issuer" yaml:"issuer"`
+	RecoveryCodes int    `json:"recovery_codes" yaml:"recovery_codes"`
+	// MaxAttempts limits totp and recovery code attempts of an identity per attempts window,
+	// further attempts are rejected until the window passes
+	MaxAttempts    int      `json:"max_attempts" yaml:"max_attempts"`
+	AttemptsWindow Duration `json:"attempts_window" yaml:"attempts_window"`
+}
+
+// AuthConfig configures authentication of API clients by the Authorization header.
+// Requests are rejected when neither API keys nor JWKS file are configured
+type AuthConfig struct {
+	APIKeys []APIKeyConfig `json:"api_keys" yaml:"api_keys"`
+	JWT     JWTConfig      `json:"jwt" yaml:"jwt"`
+}
+
+// APIKeyConfig is a static API key. Only hex encoded SHA-256 hash of the key is configured
+type APIKeyConfig struct {
+	Name   string   `json:"name" yaml:"name"`
+	Hash   string   `json:"hash" yaml:"hash"`
+	Scopes []string `json:"scopes" yaml:"scopes"`
+}
+
+// JWTConfig configures verification of JWT bearer tokens. Issuer and audience are checked when not empty
+type JWTConfig struct {
+	JWKSFile string   `json:"jwks_file" yaml:"jwks_file"`
+	Issuer   string   `json:"issuer" yaml:"issuer"`
+	Audience string   `json:"audience" yaml:"audience"`
+	Leeway   Duration `json:"leeway" yaml:"leeway"`
+}
+
+// PostgresConfig is a postgres store configuration
+type PostgresConfig struct {
+	Driver      string `json:"driver" yaml:"driver"`
+	ConnStr     string `json:"conn_str" yaml:"conn_str"`
+	AutoMigrate bool   `json:"auto_migrate" yaml:"auto_migrate"`
+}
+
+// MongoConfig is a mongo store configuration
+type MongoConfig struct {
+	Host    string   `json:"host" yaml:"host"`
+	DBName  string   `json:"db_name" yaml:"db_name"`
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+}
+
+// Duration is a time.Duration which is read from config files in "5s" format
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses duration string
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	d.Duration = v
+	return err
+}
+
+// MarshalText formats duration string
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default returns configuration used when no other source overrides a setting
+func Default() Config {
+	return Config{
+		Port:             3000,
+		AdminPort:        3001,
+		ShutdownTimeout:  Duration{15 * time.Second},
+		ShutdownDelay:    Duration{5 * time.Second},
+		Store:            MongoStore,
+		DefaultPageSize:  100,
+		MaxPageSize:      1000,
+		MaxPatchAttempts: 3,
+		Verification: CodeConfig{
+			TTL:            Duration{15 * time.Minute},
+			MaxAttempts:    5,
+			ResendInterval: Duration{time.Minute},
+		},
+		Recovery: RecoveryConfig{
+			TokenTTL:       Duration{time.Hour},
+			SessionTTL:     Duration{15 * time.Minute},
+			ResendInterval: Duration{time.Minute},
+		},
+		Session: SessionConfig{
+			TTL:          Duration{24 * time.Hour},
+			CookieName:   "krapi_session",
+			CookieSecure: true,
+		},
+		Courier: CourierConfig{
+			Senders:      map[string]string{"email": SMTPSender},
+			SMTP:         SMTPConfig{Addr: "localhost:25", From: "no-reply@localhost"},
+			MaxAttempts:  5,
+			RetryBackoff: Duration{30 * time.Second},
+			PollInterval: Duration{time.Second},
+		},
+		Password: PasswordConfig{
+			Algorithm: Argon2idHash,
+			Argon2: Argon2Config{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+				SaltLength:  16,
+				KeyLength:   32,
+			},
+			BcryptCost: 12,
+			MinLength:  8,
+		},
+		TOTP: TOTPConfig{
+			Issuer:         "kr.api",
+			RecoveryCodes:  10,
+			MaxAttempts:    5,
+			AttemptsWindow: Duration{15 * time.Minute},
+		},
+		Auth: AuthConfig{
+			JWT: JWTConfig{Leeway: Duration{30 * time.Second}},
+		},
+		Postgres: PostgresConfig{
+			Driver:      "postgres",
+			ConnStr:     "user=postgres password=postgres dbname=postgres sslmode=disable",
+			AutoMigrate: true,
+		},
+		Mongo: MongoConfig{
+			Host:    "mongodb://localhost:27017",
+			DBName:  "krapi",
+			Timeout: Duration{5 * time.Second},
+		},
+	}
+}
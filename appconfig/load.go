@@ -0,0 +1,330 @@
+package appconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is a prefix of all environment variables read by Load
+const EnvPrefix = "KRAPI_"
+
+// ConfigFileSetting is a name of flag (and suffix of environment variable) pointing to a YAML or JSON config file
+const ConfigFileSetting = "config"
+
+// setting describes a single configuration value which can be overridden by environment variable or flag
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{"port", "http port of public self-service api", func(c *Config, v string) error { return setInt(&c.Port, v) }},
+	{"admin-port", "http port of identity management api, meant to be reachable from internal network only", func(c *Config, v string) error { return setInt(&c.AdminPort, v) }},
+	{"shutdown-timeout", "time given to in-flight requests and background jobs to finish on SIGINT or SIGTERM, e.g. 15s", func(c *Config, v string) error { return c.ShutdownTimeout.UnmarshalText([]byte(v)) }},
+	{"shutdown-delay", "time readiness probes fail before listeners are closed on SIGINT or SIGTERM, e.g. 5s", func(c *Config, v string) error { return c.ShutdownDelay.UnmarshalText([]byte(v)) }},
+	{"store", "identity store: Postgres, Mongo or Memory", func(c *Config, v string) error { c.Store = v; return nil }},
+	{"identity-schemas", "identity JSON schema paths or URLs by schema id, e.g. customer=schemas/customer.json,employee=file:///etc/employee.json", func(c *Config, v string) error { return setMap(&c.IdentitySchemas, v) }},
+	{"default-page-size", "identities page size when not requested", func(c *Config, v string) error { return setInt(&c.DefaultPageSize, v) }},
+	{"max-page-size", "max requested identities page size", func(c *Config, v string) error { return setInt(&c.MaxPageSize, v) }},
+	{"max-patch-attempts", "attempts to apply a patch concurrently changed identity", func(c *Config, v string) error { return setInt(&c.MaxPatchAttempts, v) }},
+	{"verification-code-ttl", "lifetime of address verification codes, e.g. 15m", func(c *Config, v string) error { return c.Verification.TTL.UnmarshalText([]byte(v)) }},
+	{"verification-max-attempts", "wrong code attempts after which address verification code is locked until it expires", func(c *Config, v string) error { return setInt(&c.Verification.MaxAttempts, v) }},
+	{"verification-resend-interval", "min interval between verification codes issued for the same address, e.g. 1m", func(c *Config, v string) error { return c.Verification.ResendInterval.UnmarshalText([]byte(v)) }},
+	{"recovery-token-ttl", "lifetime of recovery tokens, e.g. 1h", func(c *Config, v string) error { return c.Recovery.TokenTTL.UnmarshalText([]byte(v)) }},
+	{"recovery-resend-interval", "min interval between recovery tokens issued for the same identity, e.g. 1m", func(c *Config, v string) error { return c.Recovery.ResendInterval.UnmarshalText([]byte(v)) }},
+	{"recovery-session-ttl", "lifetime of privileged sessions issued by recovery, e.g. 15m", func(c *Config, v string) error { return c.Recovery.SessionTTL.UnmarshalText([]byte(v)) }},
+	{"session-ttl", "lifetime of sessions issued on login, e.g. 24h", func(c *Config, v string) error { return c.Session.TTL.UnmarshalText([]byte(v)) }},
+	{"session-cookie-name", "name of session token cookie", func(c *Config, v string) error { c.Session.CookieName = v; return nil }},
+	{"session-cookie-secure", "send session cookie over https only", func(c *Config, v string) error { return setBool(&c.Session.CookieSecure, v) }},
+	{"courier-senders", "message sender kind by address channel, e.g. email=smtp,sms=stdout. Kinds: smtp, stdout, file", func(c *Config, v string) error { return setMap(&c.Courier.Senders, v) }},
+	{"courier-dev-senders", "allow stdout and file senders printing codes and tokens, meant for development only", func(c *Config, v string) error { return setBool(&c.Courier.DevSenders, v) }},
+	{"courier-file", "file appended by file sender", func(c *Config, v string) error { c.Courier.File = v; return nil }},
+	{"courier-smtp-addr", "SMTP server host:port", func(c *Config, v string) error { c.Courier.SMTP.Addr = v; return nil }},
+	{"courier-smtp-from", "sender address of emails", func(c *Config, v string) error { c.Courier.SMTP.From = v; return nil }},
+	{"courier-smtp-username", "SMTP username. Authentication is skipped when empty", func(c *Config, v string) error { c.Courier.SMTP.Username = v; return nil }},
+	{"courier-smtp-password", "SMTP password", func(c *Config, v string) error { c.Courier.SMTP.Password = v; return nil }},
+	{"courier-template-dir", "directory overriding built-in message templates", func(c *Config, v string) error { c.Courier.TemplateDir = v; return nil }},
+	{"courier-max-attempts", "delivery attempts after which a message is abandoned", func(c *Config, v string) error { return setInt(&c.Courier.MaxAttempts, v) }},
+	{"courier-retry-backoff", "delay before the first redelivery, doubled on every next one, e.g. 30s", func(c *Config, v string) error { return c.Courier.RetryBackoff.UnmarshalText([]byte(v)) }},
+	{"courier-poll-interval", "interval of checking queued messages, e.g. 1s", func(c *Config, v string) error { return c.Courier.PollInterval.UnmarshalText([]byte(v)) }},
+	{"password-algorithm", "password hash algorithm: argon2id or bcrypt", func(c *Config, v string) error { c.Password.Algorithm = v; return nil }},
+	{"password-argon2-memory", "argon2id memory in KiB", func(c *Config, v string) error { return setInt(&c.Password.Argon2.Memory, v) }},
+	{"password-argon2-iterations", "argon2id iterations", func(c *Config, v string) error { return setInt(&c.Password.Argon2.Iterations, v) }},
+	{"password-argon2-parallelism", "argon2id parallelism", func(c *Config, v string) error { return setInt(&c.Password.Argon2.Parallelism, v) }},
+	{"password-bcrypt-cost", "bcrypt cost", func(c *Config, v string) error { return setInt(&c.Password.BcryptCost, v) }},
+	{"password-min-length", "min password length", func(c *Config, v string) error { return setInt(&c.Password.MinLength, v) }},
+	{"totp-issuer", "issuer name shown by authenticator apps", func(c *Config, v string) error { c.TOTP.Issuer = v; return nil }},
+	{"totp-recovery-codes", "number of single-use recovery codes issued on totp enrollment", func(c *Config, v string) error { return setInt(&c.TOTP.RecoveryCodes, v) }},
+	{"totp-max-attempts", "totp and recovery code attempts of an identity allowed per attempts window", func(c *Config, v string) error { return setInt(&c.TOTP.MaxAttempts, v) }},
+	{"totp-attempts-window", "window counting totp and recovery code attempts, e.g. 15m", func(c *Config, v string) error { return c.TOTP.AttemptsWindow.UnmarshalText([]byte(v)) }},
+	{"auth-jwks-file", "JWKS file with keys verifying JWT bearer tokens", func(c *Config, v string) error { c.Auth.JWT.JWKSFile = v; return nil }},
+	{"auth-jwt-issuer", "required iss claim of JWT bearer tokens", func(c *Config, v string) error { c.Auth.JWT.Issuer = v; return nil }},
+	{"auth-jwt-audience", "required aud claim of JWT bearer tokens", func(c *Config, v string) error { c.Auth.JWT.Audience = v; return nil }},
+	{"auth-jwt-leeway", "allowed clock skew checking JWT time claims, e.g. 30s", func(c *Config, v string) error { return c.Auth.JWT.Leeway.UnmarshalText([]byte(v)) }},
+	{"postgres-driver", "postgres sql driver name", func(c *Config, v string) error { c.Postgres.Driver = v; return nil }},
+	{"postgres-conn-str", "postgres connection string", func(c *Config, v string) error { c.Postgres.ConnStr = v; return nil }},
+	{"postgres-auto-migrate", "apply pending postgres migrations on start", func(c *Config, v string) error { return setBool(&c.Postgres.AutoMigrate, v) }},
+	{"mongo-host", "mongo connection URI", func(c *Config, v string) error { c.Mongo.Host = v; return nil }},
+	{"mongo-db-name", "mongo database name", func(c *Config, v string) error { c.Mongo.DBName = v; return nil }},
+	{"mongo-timeout", "mongo operations timeout, e.g. 5s", func(c *Config, v string) error { return c.Mongo.Timeout.UnmarshalText([]byte(v)) }},
+}
+
+// Load builds configuration from defaults, config file, environment variables and command line flags.
+// Every next source overrides the previous one. Config file path is taken from -config flag or KRAPI_CONFIG variable.
+// lookupEnv is usually os.LookupEnv. Returns arguments left after flags
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, []string, error) {
+	cfg := Default()
+	fs := flag.NewFlagSet("kr.api", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	configFile := fs.String(ConfigFileSetting, "", "path to YAML or JSON config file")
+	values := make([]*string, len(settings))
+	for i, s := range settings {
+		values[i] = fs.String(s.name, "", s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+	path := *configFile
+	if v, ok := lookupEnv(EnvName(ConfigFileSetting)); ok && path == "" {
+		path = v
+	}
+	if path != "" {
+		if err := readFile(path, &cfg); err != nil {
+			return cfg, nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := lookupEnv(EnvName(s.name)); ok {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, nil, fmt.Errorf("invalid %s: %v", EnvName(s.name), err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for i, s := range settings {
+			if s.name == f.Name && err == nil {
+				if e := s.set(&cfg, *values[i]); e != nil {
+					err = fmt.Errorf("invalid -%s: %v", s.name, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return cfg, nil, err
+	}
+	return cfg, fs.Args(), cfg.Validate()
+}
+
+// EnvName returns environment variable name of a setting
+func EnvName(setting string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// Usage returns description of all flags and environment variables
+func Usage() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "  -%s, %s\n    \tpath to YAML or JSON config file\n", ConfigFileSetting, EnvName(ConfigFileSetting))
+	for _, s := range settings {
+		fmt.Fprintf(&b, "  -%s, %s\n    \t%s\n", s.name, EnvName(s.name), s.usage)
+	}
+	return b.String()
+}
+
+// Validate checks configuration consistency
+func (c Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be from 1 to 65535, got %d", c.Port)
+	}
+	if c.AdminPort < 1 || c.AdminPort > 65535 || c.AdminPort == c.Port {
+		return fmt.Errorf("admin port must be from 1 to 65535 and differ from public port, got %d", c.AdminPort)
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.ShutdownDelay.Duration < 0 || c.ShutdownDelay.Duration >= c.ShutdownTimeout.Duration {
+		return fmt.Errorf("shutdown delay must not be negative and must be less than shutdown timeout, got %s", c.ShutdownDelay)
+	}
+	for id, location := range c.IdentitySchemas {
+		if id == "" || location == "" {
+			return fmt.Errorf("identity schema id and location must not be empty, got %q=%q", id, location)
+		}
+	}
+	if c.MaxPageSize < 1 || c.DefaultPageSize < 1 || c.DefaultPageSize > c.MaxPageSize {
+		return fmt.Errorf("page sizes must satisfy 1 <= default (%d) <= max (%d)", c.DefaultPageSize, c.MaxPageSize)
+	}
+	if c.MaxPatchAttempts < 1 {
+		return fmt.Errorf("max patch attempts must be positive, got %d", c.MaxPatchAttempts)
+	}
+	if c.Verification.TTL.Duration <= 0 || c.Verification.MaxAttempts < 1 {
+		return fmt.Errorf("verification code ttl and max attempts must be positive")
+	}
+	if c.Verification.ResendInterval.Duration < 0 {
+		return fmt.Errorf("verification code resend interval must not be negative")
+	}
+	if c.Recovery.TokenTTL.Duration <= 0 || c.Recovery.SessionTTL.Duration <= 0 {
+		return fmt.Errorf("recovery token and session ttl must be positive")
+	}
+	if c.Recovery.ResendInterval.Duration < 0 {
+		return fmt.Errorf("recovery token resend interval must not be negative")
+	}
+	if c.Session.TTL.Duration <= 0 || c.Session.CookieName == "" {
+		return fmt.Errorf("session ttl must be positive and cookie name must not be empty")
+	}
+	if err := c.Courier.validate(); err != nil {
+		return err
+	}
+	if err := c.Password.validate(); err != nil {
+		return err
+	}
+	if c.TOTP.Issuer == "" || c.TOTP.RecoveryCodes < 1 {
+		return fmt.Errorf("totp issuer must not be empty and recovery codes number must be positive")
+	}
+	if c.TOTP.MaxAttempts < 1 || c.TOTP.AttemptsWindow.Duration <= 0 {
+		return fmt.Errorf("totp max attempts and attempts window must be positive")
+	}
+	if err := c.Auth.validate(); err != nil {
+		return err
+	}
+	switch c.Store {
+	case PostgresStore:
+		if c.Postgres.Driver == "" || c.Postgres.ConnStr == "" {
+			return fmt.Errorf("postgres driver and connection string must not be empty")
+		}
+	case MongoStore:
+		if c.Mongo.Host == "" || c.Mongo.DBName == "" {
+			return fmt.Errorf("mongo host and db name must not be empty")
+		}
+		if c.Mongo.Timeout.Duration <= 0 {
+			return fmt.Errorf("mongo timeout must be positive, got %s", c.Mongo.Timeout)
+		}
+	case MemoryStore:
+	default:
+		return fmt.Errorf("unknown store %q. Expected one of %s, %s, %s", c.Store, PostgresStore, MongoStore, MemoryStore)
+	}
+	return nil
+}
+
+func (c CourierConfig) validate() error {
+	if c.MaxAttempts < 1 || c.RetryBackoff.Duration <= 0 || c.PollInterval.Duration <= 0 {
+		return fmt.Errorf("courier max attempts, retry backoff and poll interval must be positive")
+	}
+	for via, kind := range c.Senders {
+		switch kind {
+		case SMTPSender:
+			if c.SMTP.Addr == "" || c.SMTP.From == "" {
+				return fmt.Errorf("smtp addr and from must not be empty for %s sender", via)
+			}
+		case FileSender, StdoutSender:
+			if !c.DevSenders {
+				return fmt.Errorf("%s sender %q is allowed with courier dev senders only", via, kind)
+			}
+			if kind == FileSender && c.File == "" {
+				return fmt.Errorf("courier file must not be empty for %s sender", via)
+			}
+		default:
+			return fmt.Errorf("unknown %s sender %q. Expected one of %s, %s, %s", via, kind, SMTPSender, StdoutSender, FileSender)
+		}
+	}
+	return nil
+}
+
+func (c PasswordConfig) validate() error {
+	if c.MinLength < 1 {
+		return fmt.Errorf("min password length must be positive, got %d", c.MinLength)
+	}
+	switch c.Algorithm {
+	case Argon2idHash:
+		a := c.Argon2
+		if a.Memory < 8*a.Parallelism || a.Iterations < 1 || a.Parallelism < 1 || a.Parallelism > 255 || a.SaltLength < 8 || a.KeyLength < 16 {
+			return fmt.Errorf("argon2 parameters must satisfy memory >= 8*parallelism, iterations >= 1, 1 <= parallelism <= 255, salt length >= 8, key length >= 16")
+		}
+	case BcryptHash:
+		if c.BcryptCost < 4 || c.BcryptCost > 31 {
+			return fmt.Errorf("bcrypt cost must be from 4 to 31, got %d", c.BcryptCost)
+		}
+	default:
+		return fmt.Errorf("unknown password algorithm %q. Expected %s or %s", c.Algorithm, Argon2idHash, BcryptHash)
+	}
+	return nil
+}
+
+func (c AuthConfig) validate() error {
+	names := map[string]bool{}
+	for _, k := range c.APIKeys {
+		if k.Name == "" || names[k.Name] {
+			return fmt.Errorf("api key names must be unique and not empty, got %q", k.Name)
+		}
+		names[k.Name] = true
+		if b, err := hex.DecodeString(k.Hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("hash of api key %s must be hex encoded sha256", k.Name)
+		}
+	}
+	if c.JWT.Leeway.Duration < 0 {
+		return fmt.Errorf("jwt leeway must not be negative, got %s", c.JWT.Leeway)
+	}
+	return nil
+}
+
+func readFile(path string, cfg *Config) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		err = d.Decode(cfg)
+	case ".yaml", ".yml":
+		d := yaml.NewDecoder(bytes.NewReader(b))
+		d.KnownFields(true)
+		err = d.Decode(cfg)
+	default:
+		return fmt.Errorf("unsupported config file extension %q. Expected .json, .yaml or .yml", filepath.Ext(path))
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	*dst = n
+	return err
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	*dst = b
+	return err
+}
+
+func setMap(dst *map[string]string, v string) error {
+	m := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected key=value pair, got %q", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	*dst = m
+	return nil
+}
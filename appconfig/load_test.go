@@ -0,0 +1,109 @@
+package appconfig
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func env(m map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := m[k]
+		return v, ok
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, rest, err := Load(nil, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+	assert.Empty(t, rest)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cfg.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("port: 4000\nstore: Memory\nmax_page_size: 50\nmongo:\n  timeout: 2s\n"), 0600))
+	cfg, rest, err := Load([]string{"-config", path, "-port", "5000", "status"}, env(map[string]string{
+		"KRAPI_PORT":              "4500",
+		"KRAPI_DEFAULT_PAGE_SIZE": "10",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 5000, cfg.Port, "flag overrides env and file")
+	assert.Equal(t, 10, cfg.DefaultPageSize, "env overrides default")
+	assert.Equal(t, 50, cfg.MaxPageSize, "file overrides default")
+	assert.Equal(t, MemoryStore, cfg.Store)
+	assert.Equal(t, 2*time.Second, cfg.Mongo.Timeout.Duration)
+	assert.Equal(t, []string{"status"}, rest)
+}
+
+func TestLoadJSONFileFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cfg.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"store":"Postgres","postgres":{"auto_migrate":true},"identity_schemas":{"a":"a.json"}}`), 0600))
+	cfg, _, err := Load(nil, env(map[string]string{"KRAPI_CONFIG": path}))
+	require.NoError(t, err)
+	assert.Equal(t, PostgresStore, cfg.Store)
+	assert.True(t, cfg.Postgres.AutoMigrate)
+	assert.Equal(t, map[string]string{"a": "a.json"}, cfg.IdentitySchemas)
+}
+
+func TestLoadIdentitySchemas(t *testing.T) {
+	cfg, _, err := Load([]string{"-identity-schemas", "customer=customer.json, employee=https://example.com/employee.json"}, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"customer": "customer.json", "employee": "https://example.com/employee.json"}, cfg.IdentitySchemas)
+	_, _, err = Load(nil, env(map[string]string{"KRAPI_IDENTITY_SCHEMAS": "customer"}))
+	assert.Error(t, err)
+}
+
+func TestLoadDevSenders(t *testing.T) {
+	cfg, _, err := Load([]string{"-courier-senders", "email=stdout,sms=stdout", "-courier-dev-senders", "true"}, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"email": StdoutSender, "sms": StdoutSender}, cfg.Courier.Senders)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.json")
+	require.NoError(t, ioutil.WriteFile(unknown, []byte(`{"prot":3000}`), 0600))
+	apiKey := filepath.Join(dir, "api_key.yaml")
+	require.NoError(t, ioutil.WriteFile(apiKey, []byte("auth:\n  api_keys:\n    - name: ci\n      hash: secret\n"), 0600))
+	cases := map[string]struct {
+		args []string
+		env  map[string]string
+	}{
+		"unknown flag":        {args: []string{"-nope", "1"}},
+		"invalid env number":  {env: map[string]string{"KRAPI_PORT": "abc"}},
+		"invalid flag number": {args: []string{"-max-page-size", "abc"}},
+		"port out of range":   {args: []string{"-port", "70000"}},
+		"same admin port":     {args: []string{"-port", "4000", "-admin-port", "4000"}},
+		"shutdown timeout":    {args: []string{"-shutdown-timeout", "0s"}},
+		"unknown store":       {args: []string{"-store", "Nope"}},
+		"page sizes":          {args: []string{"-default-page-size", "20", "-max-page-size", "10"}},
+		"shutdown delay":      {args: []string{"-shutdown-timeout", "5s", "-shutdown-delay", "5s"}},
+		"missing file":        {args: []string{"-config", filepath.Join(dir, "missing.yaml")}},
+		"unknown file field":  {args: []string{"-config", unknown}},
+		"invalid duration":    {env: map[string]string{"KRAPI_MONGO_TIMEOUT": "soon"}},
+		"unknown sender":      {args: []string{"-courier-senders", "email=pigeon"}},
+		"file sender no file": {args: []string{"-courier-senders", "email=file", "-courier-dev-senders", "true"}},
+		"stdout sender":       {args: []string{"-courier-senders", "email=stdout"}},
+		"unknown hash":        {args: []string{"-password-algorithm", "md5"}},
+		"bcrypt cost":         {args: []string{"-password-algorithm", "bcrypt", "-password-bcrypt-cost", "40"}},
+		"totp recovery codes": {args: []string{"-totp-recovery-codes", "0"}},
+		"recovery resend":     {args: []string{"-recovery-resend-interval", "-1s"}},
+		"totp max attempts":   {args: []string{"-totp-max-attempts", "0"}},
+		"totp window":         {args: []string{"-totp-attempts-window", "0s"}},
+		"jwt leeway":          {args: []string{"-auth-jwt-leeway", "-1s"}},
+		"api key hash":        {args: []string{"-config", apiKey}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := Load(c.args, env(c.env))
+			assert.Error(t, err)
+		})
+	}
+}
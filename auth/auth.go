@@ -0,0 +1,139 @@
+// Package auth authenticates API clients by static API keys and JWT bearer tokens
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/trapck/kr.api/appconfig"
+)
+
+// Authentication methods of principals
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// Scopes granted to principals. Admin scope grants all other scopes
+const (
+	ScopeIdentitiesRead   = "identities:read"
+	ScopeIdentitiesWrite  = "identities:write"
+	ScopeIdentitiesDelete = "identities:delete"
+	ScopeAdmin            = "admin"
+)
+
+// scopes are all known scopes
+var scopes = map[string]bool{ScopeIdentitiesRead: true, ScopeIdentitiesWrite: true, ScopeIdentitiesDelete: true, ScopeAdmin: true}
+
+// apiKeySize is a number of random bytes in generated API keys
+const apiKeySize = 32
+
+var (
+	// ErrMissingCredentials is returned when request has no bearer credentials
+	ErrMissingCredentials = errors.New("missing bearer credentials")
+	// ErrInvalidCredentials is returned when bearer credentials are unknown, malformed or expired
+	ErrInvalidCredentials = errors.New("invalid bearer credentials")
+)
+
+// Principal is an authenticated API client
+type Principal struct {
+	// Name is an API key name or a JWT subject
+	Name   string
+	Method string
+	Scopes []string
+}
+
+// HasScope returns whether the principal was granted the scope directly or by admin scope
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator verifies Authorization header values
+type Authenticator struct {
+	keys []apiKey
+	jwks *JWKS
+	jwt  appconfig.JWTConfig
+}
+
+type apiKey struct {
+	hash      []byte
+	principal Principal
+}
+
+// New returns authenticator of configured API keys and JWKS file
+func New(cfg appconfig.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{jwt: cfg.JWT}
+	for _, k := range cfg.APIKeys {
+		hash, err := hex.DecodeString(k.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("hash of api key %s must be hex encoded sha256", k.Name)
+		}
+		for _, v := range k.Scopes {
+			if !scopes[v] {
+				return nil, fmt.Errorf("unknown scope %q of api key %s", v, k.Name)
+			}
+		}
+		a.keys = append(a.keys, apiKey{hash, Principal{Name: k.Name, Method: MethodAPIKey, Scopes: k.Scopes}})
+	}
+	if cfg.JWT.JWKSFile != "" {
+		jwks, err := LoadJWKS(cfg.JWT.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.jwks = jwks
+	}
+	return a, nil
+}
+
+// Authenticate returns principal of "Bearer <credentials>" header value. Credentials with three dot separated parts
+// are verified as JWT, others are compared with API key hashes
+func (a *Authenticator) Authenticate(header string, now time.Time) (Principal, error) {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return Principal{}, ErrMissingCredentials
+	}
+	credentials := strings.TrimSpace(header[len(prefix):])
+	if credentials == "" {
+		return Principal{}, ErrMissingCredentials
+	}
+	if strings.Count(credentials, ".") == 2 {
+		if a.jwks == nil {
+			return Principal{}, ErrInvalidCredentials
+		}
+		return verifyJWT(credentials, a.jwks, a.jwt, now)
+	}
+	hash := sha256.Sum256([]byte(credentials))
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash) == 1 {
+			return k.principal, nil
+		}
+	}
+	return Principal{}, ErrInvalidCredentials
+}
+
+// HashAPIKey returns hex encoded SHA-256 hash of the key which is configured instead of the key
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// NewAPIKey returns a random API key
+func NewAPIKey() (string, error) {
+	b := make([]byte, apiKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
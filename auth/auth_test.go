@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/appconfig"
+)
+
+var hmacSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func sign(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := b64(h) + "." + b64(c)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		m := hmac.New(sha256.New, k)
+		m.Write([]byte(signed))
+		sig = m.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func newAuthenticator(t *testing.T, rsaKey *rsa.PrivateKey) *Authenticator {
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","alg":"RS256","use":"sig","n":%q,"e":%q},
+		{"kty":"oct","kid":"hmac","k":%q},
+		{"kty":"RSA","use":"enc","n":"","e":""}
+	]}`, b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()), b64(hmacSecret))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(jwks), 0600))
+	a, err := New(appconfig.AuthConfig{
+		APIKeys: []appconfig.APIKeyConfig{{Name: "ci", Hash: HashAPIKey("ci-key"), Scopes: []string{"identities:read"}}},
+		JWT:     appconfig.JWTConfig{JWKSFile: path, Issuer: "https://issuer.example.com", Audience: "kr.api", Leeway: appconfig.Duration{Duration: time.Minute}},
+	})
+	require.NoError(t, err)
+	return a
+}
+
+func TestAPIKey(t *testing.T) {
+	a, err := New(appconfig.AuthConfig{
+		APIKeys: []appconfig.APIKeyConfig{{Name: "ci", Hash: HashAPIKey("ci-key"), Scopes: []string{"identities:read"}}},
+	})
+	require.NoError(t, err)
+	p, err := a.Authenticate("Bearer ci-key", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, Principal{Name: "ci", Method: MethodAPIKey, Scopes: []string{"identities:read"}}, p)
+	assert.True(t, p.HasScope("identities:read"))
+	assert.False(t, p.HasScope(ScopeAdmin))
+	assert.False(t, p.HasScope(ScopeIdentitiesDelete))
+	assert.True(t, Principal{Scopes: []string{ScopeAdmin}}.HasScope(ScopeIdentitiesDelete), "expected admin scope to grant all scopes")
+
+	_, err = a.Authenticate("Bearer other-key", time.Now())
+	assert.Equal(t, ErrInvalidCredentials, err)
+	for _, h := range []string{"", "ci-key", "Basic ci-key", "Bearer  "} {
+		_, err = a.Authenticate(h, time.Now())
+		assert.Equal(t, ErrMissingCredentials, err, "header %q", h)
+	}
+	_, err = a.Authenticate("Bearer a.b.c", time.Now())
+	assert.Equal(t, ErrInvalidCredentials, err, "expected jwt to be rejected without jwks")
+
+	key, err := NewAPIKey()
+	require.NoError(t, err)
+	assert.Len(t, HashAPIKey(key), 64)
+	_, err = New(appconfig.AuthConfig{APIKeys: []appconfig.APIKeyConfig{{Name: "ci", Hash: "ci-key"}}})
+	assert.Error(t, err, "expected plain key to be rejected as hash")
+	_, err = New(appconfig.AuthConfig{APIKeys: []appconfig.APIKeyConfig{{Name: "ci", Hash: HashAPIKey("ci-key"), Scopes: []string{"identities:nuke"}}}})
+	assert.Error(t, err, "expected unknown scope to be rejected")
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	a := newAuthenticator(t, rsaKey)
+	now := time.Unix(1700000000, 0)
+	claims := func(override map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "service-a",
+			"iss":   "https://issuer.example.com",
+			"aud":   []string{"other", "kr.api"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "identities:read identities:write",
+		}
+		for k, v := range override {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+	hs256 := map[string]interface{}{"alg": "HS256", "kid": "hmac"}
+
+	t.Run("should accept valid tokens", func(t *testing.T) {
+		p, err := a.Authenticate("Bearer "+sign(t, rs256, claims(nil), rsaKey), now)
+		require.NoError(t, err)
+		assert.Equal(t, Principal{Name: "service-a", Method: MethodJWT, Scopes: []string{"identities:read", "identities:write"}}, p)
+		p, err = a.Authenticate("Bearer "+sign(t, map[string]interface{}{"alg": "HS256"}, claims(map[string]interface{}{"scope": nil, "scp": []string{"admin"}, "aud": "kr.api"}), hmacSecret), now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"admin"}, p.Scopes)
+		_, err = a.Authenticate("Bearer "+sign(t, rs256, claims(map[string]interface{}{"exp": now.Unix() - 30}), rsaKey), now)
+		assert.NoError(t, err, "expected expiration within leeway to be accepted")
+	})
+	cases := map[string]string{
+		"expired":        sign(t, rs256, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), rsaKey),
+		"without exp":    sign(t, rs256, claims(map[string]interface{}{"exp": nil}), rsaKey),
+		"not yet valid":  sign(t, rs256, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), rsaKey),
+		"wrong issuer":   sign(t, rs256, claims(map[string]interface{}{"iss": "https://evil.example.com"}), rsaKey),
+		"wrong audience": sign(t, rs256, claims(map[string]interface{}{"aud": "other"}), rsaKey),
+		"unknown kid":    sign(t, map[string]interface{}{"alg": "RS256", "kid": "nope"}, claims(nil), rsaKey),
+		"wrong secret":   sign(t, hs256, claims(nil), []byte("fedcba9876543210fedcba9876543210")),
+		"alg none":       sign(t, map[string]interface{}{"alg": "none"}, claims(nil), nil),
+		"alg confusion":  sign(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims(nil), rsaKey.N.Bytes()),
+		"malformed":      "a.b.c",
+		"tampered token": sign(t, rs256, claims(nil), rsaKey)[:10] + "x" + sign(t, rs256, claims(nil), rsaKey)[11:],
+	}
+	for name, token := range cases {
+		t.Run("should reject "+name, func(t *testing.T) {
+			_, err := a.Authenticate("Bearer "+token, now)
+			assert.Equal(t, ErrInvalidCredentials, err)
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	for name, v := range map[string]string{
+		"invalid json":    `{`,
+		"no keys":         `{"keys":[]}`,
+		"unknown type":    `{"keys":[{"kty":"EC"}]}`,
+		"short secret":    `{"keys":[{"kty":"oct","k":"c2hvcnQ"}]}`,
+		"short modulus":   `{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`,
+		"alg mismatch":    fmt.Sprintf(`{"keys":[{"kty":"oct","alg":"RS256","k":%q}]}`, b64(hmacSecret)),
+		"unsupported alg": fmt.Sprintf(`{"keys":[{"kty":"oct","alg":"none","k":%q}]}`, b64(hmacSecret)),
+	} {
+		_, err := ParseJWKS([]byte(v))
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+// Key types of JSON web keys
+const (
+	keyTypeRSA = "RSA"
+	keyTypeOct = "oct"
+)
+
+// JWKS is a set of keys verifying JWT signatures
+type JWKS struct {
+	keys []jwk
+}
+
+// jwk is a parsed JSON web key. Exactly one of rsa and secret is set
+type jwk struct {
+	kid    string
+	alg    string
+	rsa    *rsa.PublicKey
+	secret []byte
+}
+
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+// LoadJWKS reads JSON web key set file with RSA public keys and HMAC secrets
+func LoadJWKS(path string) (*JWKS, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read jwks file: %v", err)
+	}
+	return ParseJWKS(b)
+}
+
+// ParseJWKS parses JSON web key set with RSA public keys and HMAC secrets
+func ParseJWKS(b []byte) (*JWKS, error) {
+	var raw struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("could not parse jwks: %v", err)
+	}
+	set := &JWKS{}
+	for n, r := range raw.Keys {
+		if r.Use != "" && r.Use != "sig" {
+			continue
+		}
+		k := jwk{kid: r.Kid, alg: r.Alg}
+		switch r.Kty {
+		case keyTypeRSA:
+			nb, err := base64.RawURLEncoding.DecodeString(r.N)
+			if err != nil || len(nb) < 256 {
+				return nil, fmt.Errorf("jwks key %d: modulus must be base64url encoded and at least 2048 bits", n)
+			}
+			eb, err := base64.RawURLEncoding.DecodeString(r.E)
+			if err != nil || len(eb) == 0 || len(eb) > 4 {
+				return nil, fmt.Errorf("jwks key %d: invalid exponent", n)
+			}
+			e := new(big.Int).SetBytes(eb)
+			k.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(e.Int64())}
+		case keyTypeOct:
+			secret, err := base64.RawURLEncoding.DecodeString(r.K)
+			if err != nil || len(secret) < 32 {
+				return nil, fmt.Errorf("jwks key %d: secret must be base64url encoded and at least 256 bits", n)
+			}
+			k.secret = secret
+		default:
+			return nil, fmt.Errorf("jwks key %d: unsupported key type %q", n, r.Kty)
+		}
+		if k.alg != "" && !k.supports(k.alg) {
+			return nil, fmt.Errorf("jwks key %d: algorithm %s doesn't match key type %s", n, k.alg, r.Kty)
+		}
+		set.keys = append(set.keys, k)
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("jwks has no signature keys")
+	}
+	return set, nil
+}
+
+// candidates returns keys which may verify a signature of the algorithm and key id
+func (s *JWKS) candidates(alg, kid string) []jwk {
+	var res []jwk
+	for _, k := range s.keys {
+		if (kid == "" || k.kid == kid) && (k.alg == "" || k.alg == alg) && k.supports(alg) {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// supports returns whether the key type is used by the algorithm, so a public RSA key is never used as HMAC secret
+func (k jwk) supports(alg string) bool {
+	m, ok := algorithms[alg]
+	return ok && (m.hmac == (k.secret != nil))
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 used by HS256 and RS256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/trapck/kr.api/appconfig"
+)
+
+type algorithm struct {
+	hash crypto.Hash
+	hmac bool
+}
+
+// algorithms are supported JWT signature algorithms
+var algorithms = map[string]algorithm{
+	"HS256": {crypto.SHA256, true},
+	"HS384": {crypto.SHA384, true},
+	"HS512": {crypto.SHA512, true},
+	"RS256": {crypto.SHA256, false},
+	"RS384": {crypto.SHA384, false},
+	"RS512": {crypto.SHA512, false},
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *int64   `json:"exp"`
+	NotBefore *int64   `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Scp       []string `json:"scp"`
+}
+
+// audience is aud claim which is either a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	err := json.Unmarshal(b, &l)
+	*a = l
+	return err
+}
+
+func (a audience) contains(v string) bool {
+	for _, s := range a {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWT checks compact serialized JWT signature and claims. Tokens must expire.
+// Scopes are read from space separated scope claim or scp array claim
+func verifyJWT(token string, keys *JWKS, cfg appconfig.JWTConfig, now time.Time) (Principal, error) {
+	parts := strings.Split(token, ".")
+	var h jwtHeader
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+	alg, ok := algorithms[h.Alg]
+	if !ok {
+		return Principal{}, ErrInvalidCredentials
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+	verified := false
+	for _, k := range keys.candidates(h.Alg, h.Kid) {
+		if verified = verifySignature(alg, k, signed, sig); verified {
+			break
+		}
+	}
+	if !verified {
+		return Principal{}, ErrInvalidCredentials
+	}
+	var c jwtClaims
+	if err = decodeSegment(parts[1], &c); err != nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+	leeway := int64(cfg.Leeway.Seconds())
+	if c.ExpiresAt == nil || now.Unix() >= *c.ExpiresAt+leeway {
+		return Principal{}, ErrInvalidCredentials
+	}
+	if c.NotBefore != nil && now.Unix()+leeway < *c.NotBefore {
+		return Principal{}, ErrInvalidCredentials
+	}
+	if (cfg.Issuer != "" && c.Issuer != cfg.Issuer) || (cfg.Audience != "" && !c.Audience.contains(cfg.Audience)) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	scopes := strings.Fields(c.Scope)
+	if len(scopes) == 0 {
+		scopes = c.Scp
+	}
+	return Principal{Name: c.Subject, Method: MethodJWT, Scopes: scopes}, nil
+}
+
+func verifySignature(alg algorithm, k jwk, signed, sig []byte) bool {
+	if alg.hmac {
+		m := hmac.New(alg.hash.New, k.secret)
+		m.Write(signed)
+		return hmac.Equal(m.Sum(nil), sig)
+	}
+	h := alg.hash.New()
+	h.Write(signed)
+	return rsa.VerifyPKCS1v15(k.rsa, alg.hash, h.Sum(nil), sig) == nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
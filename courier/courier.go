@@ -0,0 +1,196 @@
+// Package courier queues messages for identity addresses and delivers them with retries
+package courier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/model"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// batchSize is a max number of messages delivered by a single Process call
+const batchSize = 100
+
+// maxBackoff limits delay between delivery attempts
+const maxBackoff = time.Hour
+
+// claimTimeout is a time after which a message claimed by a courier that stopped before updating it is claimed again
+const claimTimeout = 10 * time.Minute
+
+// ErrNoSender is returned when no sender is configured for an address channel
+var ErrNoSender = errors.New("no sender configured for address channel")
+
+// Queue persists messages waiting for delivery
+type Queue interface {
+	EnqueueMessage(m model.Message) error
+	// ClaimMessages atomically marks up to limit due messages as sending and returns them ordered by send time,
+	// so concurrent couriers never get the same message. Due messages are queued ones which should be sent
+	// not later than now and sending ones not updated since reclaimBefore
+	ClaimMessages(now, reclaimBefore time.Time, limit int) ([]model.Message, error)
+	// UpdateMessage replaces message with the same id
+	UpdateMessage(m model.Message) error
+	GetMessage(id string) (model.Message, error)
+}
+
+// Courier renders messages from templates, queues them and delivers them by senders of their channels
+type Courier struct {
+	queue     Queue
+	senders   map[string]Sender
+	templates *Templates
+	cfg       appconfig.CourierConfig
+	now       func() time.Time
+}
+
+// New creates a courier with senders and templates described by the configuration
+func New(q Queue, cfg appconfig.CourierConfig) (*Courier, error) {
+	t, err := LoadTemplates(cfg.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Courier{queue: q, senders: map[string]Sender{}, templates: t, cfg: cfg, now: time.Now}
+	for via, kind := range cfg.Senders {
+		s, err := NewSender(kind, cfg)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.senders[via] = s
+	}
+	return c, nil
+}
+
+// SetSender replaces sender of the address channel
+func (c *Courier) SetSender(via string, s Sender) {
+	c.senders[via] = s
+}
+
+// Close releases resources held by senders
+func (c *Courier) Close() error {
+	var err error
+	for _, s := range c.senders {
+		if cl, ok := s.(io.Closer); ok {
+			if e := cl.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// SendVerificationCode queues a message with address verification code
+func (c *Courier) SendVerificationCode(i model.Identity, a model.VerifiableAddress, code string) error {
+	_, err := c.Enqueue(VerificationCodeTemplate, TemplateData{Identity: i, Address: a.Address, Code: code})
+	return err
+}
+
+// SendRecoveryToken queues a message with account recovery token.
+// The plaintext token stays in the stored message body until the message is sent or abandoned,
+// so the message store must be protected like the recovery token store
+func (c *Courier) SendRecoveryToken(i model.Identity, a model.RecoveryAddress, token string) error {
+	_, err := c.Enqueue(RecoveryTokenTemplate, TemplateData{Identity: i, Address: a.Address, Token: token})
+	return err
+}
+
+// Enqueue renders the template and queues the message to data address
+func (c *Courier) Enqueue(template string, data TemplateData) (model.Message, error) {
+	if _, ok := c.senders[data.Address.Via]; !ok {
+		return model.Message{}, fmt.Errorf("%w %q", ErrNoSender, data.Address.Via)
+	}
+	subject, body, err := c.templates.Render(template, data)
+	if err != nil {
+		return model.Message{}, err
+	}
+	now := c.now().UTC().Truncate(time.Millisecond)
+	m := model.Message{
+		ID:         uuid.NewV4().String(),
+		Via:        data.Address.Via,
+		Recipient:  data.Address.Value,
+		IdentityID: data.Identity.ID,
+		Template:   template,
+		Subject:    subject,
+		Body:       body,
+		Status:     model.MessageQueued,
+		SendAfter:  now,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	return m, c.queue.EnqueueMessage(m)
+}
+
+// Process claims due messages and makes a delivery attempt of each of them. Failed messages are rescheduled
+// with exponential backoff until max attempts are made. A message which can't be updated doesn't stop
+// the rest of the batch, it stays claimed until claim timeout
+func (c *Courier) Process() error {
+	now := c.now().UTC().Truncate(time.Millisecond)
+	l, err := c.queue.ClaimMessages(now, now.Add(-claimTimeout), batchSize)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, m := range l {
+		if e := c.deliver(m, now); e != nil {
+			log.Printf("courier could not update message %s: %v", m.ID, e)
+			if failed++; err == nil {
+				err = e
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not update %d of %d messages: %v", failed, len(l), err)
+	}
+	return nil
+}
+
+// Run processes queued messages every poll interval until the context is done
+func (c *Courier) Run(ctx context.Context) {
+	t := time.NewTicker(c.cfg.PollInterval.Duration)
+	defer t.Stop()
+	for {
+		if err := c.Process(); err != nil {
+			log.Printf("courier could not process queued messages: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Courier) deliver(m model.Message, now time.Time) error {
+	m.Attempts++
+	m.UpdatedAt = now
+	err := ErrNoSender
+	if s, ok := c.senders[m.Via]; ok {
+		err = s.Send(m)
+	}
+	switch {
+	case err == nil:
+		m.Status, m.Body, m.LastError = model.MessageSent, "", ""
+	case m.Attempts >= c.cfg.MaxAttempts:
+		m.Status, m.Body, m.LastError = model.MessageFailed, "", err.Error()
+	default:
+		m.Status, m.LastError = model.MessageQueued, err.Error()
+		m.SendAfter = now.Add(c.backoff(m.Attempts))
+	}
+	return c.queue.UpdateMessage(m)
+}
+
+// backoff returns delay after the given number of failed attempts
+func (c *Courier) backoff(attempts int) time.Duration {
+	d := c.cfg.RetryBackoff.Duration
+	for n := 1; n < attempts && d < maxBackoff; n++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,146 @@
+package courier
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+)
+
+type stubSender struct {
+	sent []model.Message
+	err  error
+}
+
+func (s *stubSender) Send(m model.Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+// failingUpdates fails updates of the message with the given id
+type failingUpdates struct {
+	*memstore.Store
+	id string
+}
+
+func (q failingUpdates) UpdateMessage(m model.Message) error {
+	if m.ID == q.id {
+		return errors.New("connection reset")
+	}
+	return q.Store.UpdateMessage(m)
+}
+
+func newTestCourier(t *testing.T) (*Courier, *memstore.Store, *stubSender, *time.Time) {
+	store := &memstore.Store{}
+	require.NoError(t, store.Init())
+	cfg := appconfig.Default().Courier
+	cfg.Senders = map[string]string{}
+	c, err := New(store, cfg)
+	require.NoError(t, err)
+	sender := &stubSender{}
+	c.SetSender("email", sender)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	c.now = func() time.Time { return now }
+	return c, store, sender, &now
+}
+
+func TestCourier(t *testing.T) {
+	identity := model.Identity{ID: "identity"}
+	email := model.VerifiableAddress{Address: model.Address{ID: "address", Value: "a@example.com", Via: "email"}}
+
+	t.Run("should queue rendered message", func(t *testing.T) {
+		c, store, sender, _ := newTestCourier(t)
+		require.NoError(t, c.SendVerificationCode(identity, email, "123456"))
+		assert.Empty(t, sender.sent, "expected message to be queued, not sent")
+		l, err := store.ClaimMessages(c.now(), c.now().Add(-claimTimeout), 10)
+		require.NoError(t, err)
+		require.Len(t, l, 1)
+		assert.Equal(t, model.MessageSending, l[0].Status)
+		assert.Equal(t, "a@example.com", l[0].Recipient)
+		assert.Equal(t, identity.ID, l[0].IdentityID)
+		assert.Equal(t, "Verify your address", l[0].Subject)
+		assert.Contains(t, l[0].Body, "123456")
+	})
+	t.Run("should reject channel without sender", func(t *testing.T) {
+		c, _, _, _ := newTestCourier(t)
+		sms := model.RecoveryAddress{Address: model.Address{ID: "sms", Value: "+100", Via: "sms"}}
+		err := c.SendRecoveryToken(identity, sms, "token")
+		assert.True(t, errors.Is(err, ErrNoSender), "expected no sender error, got %v", err)
+	})
+	t.Run("should deliver due message and clear its body", func(t *testing.T) {
+		c, store, sender, _ := newTestCourier(t)
+		m, err := c.Enqueue(RecoveryTokenTemplate, TemplateData{Identity: identity, Address: email.Address, Token: "token"})
+		require.NoError(t, err)
+		require.NoError(t, c.Process())
+		require.Len(t, sender.sent, 1)
+		assert.Contains(t, sender.sent[0].Body, "token")
+		found, err := store.GetMessage(m.ID)
+		require.NoError(t, err)
+		assert.Equal(t, model.MessageSent, found.Status)
+		assert.Equal(t, 1, found.Attempts)
+		assert.Empty(t, found.Body, "expected body with secret to be cleared")
+	})
+	t.Run("should retry with backoff and abandon after max attempts", func(t *testing.T) {
+		c, store, sender, now := newTestCourier(t)
+		sender.err = errors.New("unavailable")
+		m, err := c.Enqueue(VerificationCodeTemplate, TemplateData{Identity: identity, Address: email.Address, Code: "1"})
+		require.NoError(t, err)
+		backoff := c.cfg.RetryBackoff.Duration
+		for n := 1; n < c.cfg.MaxAttempts; n++ {
+			require.NoError(t, c.Process())
+			found, _ := store.GetMessage(m.ID)
+			assert.Equal(t, model.MessageQueued, found.Status)
+			assert.Equal(t, n, found.Attempts)
+			assert.Equal(t, "unavailable", found.LastError)
+			assert.True(t, found.SendAfter.Equal(now.Add(backoff)), "expected attempt %d to be delayed by %s", n, backoff)
+			require.NoError(t, c.Process())
+			found, _ = store.GetMessage(m.ID)
+			assert.Equal(t, n, found.Attempts, "expected message not to be retried before backoff")
+			*now = found.SendAfter
+			backoff *= 2
+		}
+		require.NoError(t, c.Process())
+		found, _ := store.GetMessage(m.ID)
+		assert.Equal(t, model.MessageFailed, found.Status)
+		assert.Empty(t, found.Body)
+	})
+	t.Run("should skip messages claimed by other couriers until claim times out", func(t *testing.T) {
+		c, store, sender, now := newTestCourier(t)
+		m, err := c.Enqueue(VerificationCodeTemplate, TemplateData{Identity: identity, Address: email.Address, Code: "1"})
+		require.NoError(t, err)
+		l, err := store.ClaimMessages(*now, now.Add(-claimTimeout), 10)
+		require.NoError(t, err)
+		require.Len(t, l, 1)
+		require.NoError(t, c.Process())
+		assert.Empty(t, sender.sent, "expected claimed message not to be delivered twice")
+		*now = now.Add(claimTimeout + time.Millisecond)
+		require.NoError(t, c.Process())
+		require.Len(t, sender.sent, 1, "expected stale claim to be taken over")
+		found, _ := store.GetMessage(m.ID)
+		assert.Equal(t, model.MessageSent, found.Status)
+	})
+	t.Run("should update rest of the batch when one message can't be updated", func(t *testing.T) {
+		c, store, sender, _ := newTestCourier(t)
+		first, err := c.Enqueue(VerificationCodeTemplate, TemplateData{Identity: identity, Address: email.Address, Code: "1"})
+		require.NoError(t, err)
+		second, err := c.Enqueue(VerificationCodeTemplate, TemplateData{Identity: identity, Address: email.Address, Code: "2"})
+		require.NoError(t, err)
+		c.queue = failingUpdates{Store: store, id: first.ID}
+		assert.Error(t, c.Process(), "expected failed update to be reported")
+		assert.Len(t, sender.sent, 2, "expected whole batch to be delivered")
+		found, _ := store.GetMessage(second.ID)
+		assert.Equal(t, model.MessageSent, found.Status, "expected message after the failed one to be updated")
+	})
+	t.Run("should limit backoff", func(t *testing.T) {
+		c, _, _, _ := newTestCourier(t)
+		assert.Equal(t, maxBackoff, c.backoff(100))
+	})
+}
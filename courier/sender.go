@@ -0,0 +1,94 @@
+package courier
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/model"
+)
+
+// Sender delivers messages over a single address channel
+type Sender interface {
+	Send(m model.Message) error
+}
+
+// NewSender creates a sender of the configured kind
+func NewSender(kind string, cfg appconfig.CourierConfig) (Sender, error) {
+	switch kind {
+	case appconfig.SMTPSender:
+		return NewSMTPSender(cfg.SMTP), nil
+	case appconfig.StdoutSender:
+		return &WriterSender{W: os.Stdout}, nil
+	case appconfig.FileSender:
+		f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("could not open courier file: %v", err)
+		}
+		return &WriterSender{W: f}, nil
+	default:
+		return nil, fmt.Errorf("unknown sender %q", kind)
+	}
+}
+
+// WriterSender writes messages in a human readable form. It is meant for development only
+type WriterSender struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+// Send writes the message
+func (s *WriterSender) Send(m model.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.W, "To: %s (%s)\nSubject: %s\n\n%s\n\n", m.Recipient, m.Via, m.Subject, strings.TrimSpace(m.Body))
+	return err
+}
+
+// Close closes the underlying writer unless it is stdout
+func (s *WriterSender) Close() error {
+	if c, ok := s.W.(io.Closer); ok && s.W != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// SMTPSender sends messages as plain text emails
+type SMTPSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPSender creates a sender authenticating with username and password when username is set
+func NewSMTPSender(cfg appconfig.SMTPConfig) *SMTPSender {
+	s := &SMTPSender{addr: cfg.Addr, from: cfg.From}
+	if cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		s.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	return s
+}
+
+// Send sends the message to its recipient
+func (s *SMTPSender) Send(m model.Message) error {
+	for _, v := range []string{m.Recipient, m.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("message recipient and subject must be single line")
+		}
+	}
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.Recipient)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{m.Recipient}, []byte(b.String()))
+}
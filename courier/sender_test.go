@@ -0,0 +1,122 @@
+package courier
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/model"
+)
+
+// smtpMail is a mail received by stub SMTP server
+type smtpMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// startSMTPServer starts a minimal SMTP server accepting mails without authentication
+func startSMTPServer(t *testing.T) (string, <-chan smtpMail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	mails := make(chan smtpMail, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func serveSMTP(conn net.Conn, mails chan<- smtpMail) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { fmt.Fprintf(conn, "%s\r\n", s) }
+	reply("220 localhost ESMTP stub")
+	m := smtpMail{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			m.from = strings.Trim(strings.TrimSpace(line)[len("MAIL FROM:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			m.to = append(m.to, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			b := strings.Builder{}
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				b.WriteString(l)
+			}
+			m.data = b.String()
+			mails <- m
+			m = smtpMail{}
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	addr, mails := startSMTPServer(t)
+	s := NewSMTPSender(appconfig.SMTPConfig{Addr: addr, From: "no-reply@example.com"})
+
+	t.Run("should send plain text email", func(t *testing.T) {
+		err := s.Send(model.Message{Via: "email", Recipient: "a@example.com", Subject: "Verify your address", Body: "code 123456\n"})
+		require.NoError(t, err)
+		m := <-mails
+		assert.Equal(t, "no-reply@example.com", m.from)
+		assert.Equal(t, []string{"a@example.com"}, m.to)
+		assert.Contains(t, m.data, "To: a@example.com\r\n")
+		assert.Contains(t, m.data, "Subject: Verify your address\r\n")
+		assert.Contains(t, m.data, "\r\n\r\ncode 123456\r\n")
+	})
+	t.Run("should reject header injection", func(t *testing.T) {
+		err := s.Send(model.Message{Via: "email", Recipient: "a@example.com\r\nBcc: b@example.com", Subject: "s", Body: "b"})
+		assert.Error(t, err)
+	})
+	t.Run("should report unavailable server", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closed := l.Addr().String()
+		l.Close()
+		err = NewSMTPSender(appconfig.SMTPConfig{Addr: closed, From: "no-reply@example.com"}).Send(model.Message{Recipient: "a@example.com"})
+		assert.Error(t, err)
+	})
+}
+
+func TestWriterSender(t *testing.T) {
+	b := bytes.Buffer{}
+	s := &WriterSender{W: &b}
+	require.NoError(t, s.Send(model.Message{Via: "sms", Recipient: "+100", Subject: "subject", Body: "body\n"}))
+	assert.True(t, strings.HasPrefix(b.String(), "To: +100 (sms)\nSubject: subject\n\nbody\n"), b.String())
+}
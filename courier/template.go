@@ -0,0 +1,96 @@
+package courier
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// Message templates
+const (
+	VerificationCodeTemplate = "verification_code"
+	RecoveryTokenTemplate    = "recovery_token"
+)
+
+//go:embed templates
+var builtinTemplates embed.FS
+
+// TemplateData is passed to message templates
+type TemplateData struct {
+	Identity model.Identity
+	Address  model.Address
+	Code     string
+	Token    string
+}
+
+// Templates renders subjects and bodies of messages
+type Templates struct {
+	subjects map[string]*template.Template
+	bodies   map[string]*template.Template
+}
+
+// LoadTemplates parses built-in templates. Files <template>/subject.tmpl and <template>/body.tmpl
+// found in non empty dir override the built-in ones
+func LoadTemplates(dir string) (*Templates, error) {
+	builtin, err := fs.Sub(builtinTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	sources := []fs.FS{builtin}
+	if dir != "" {
+		sources = append([]fs.FS{os.DirFS(dir)}, sources...)
+	}
+	t := &Templates{subjects: map[string]*template.Template{}, bodies: map[string]*template.Template{}}
+	for _, name := range []string{VerificationCodeTemplate, RecoveryTokenTemplate} {
+		if t.subjects[name], err = parseTemplate(sources, path.Join(name, "subject.tmpl")); err != nil {
+			return nil, err
+		}
+		if t.bodies[name], err = parseTemplate(sources, path.Join(name, "body.tmpl")); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Render returns subject and body of the template
+func (t *Templates) Render(name string, data TemplateData) (string, string, error) {
+	subject, ok := t.subjects[name]
+	if !ok {
+		return "", "", fmt.Errorf("unknown message template %q", name)
+	}
+	s := bytes.Buffer{}
+	if err := subject.Execute(&s, data); err != nil {
+		return "", "", err
+	}
+	b := bytes.Buffer{}
+	if err := t.bodies[name].Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(s.String()), b.String(), nil
+}
+
+// parseTemplate parses the file from the first source having it
+func parseTemplate(sources []fs.FS, name string) (*template.Template, error) {
+	for _, src := range sources {
+		b, err := fs.ReadFile(src, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		t, err := template.New(name).Option("missingkey=error").Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse message template %s: %v", name, err)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("message template %s not found", name)
+}
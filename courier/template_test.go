@@ -0,0 +1,46 @@
+package courier
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/model"
+)
+
+func TestTemplates(t *testing.T) {
+	data := TemplateData{Address: model.Address{Value: "a@example.com", Via: "email"}, Code: "123456"}
+
+	t.Run("should render built-in templates", func(t *testing.T) {
+		tpl, err := LoadTemplates("")
+		require.NoError(t, err)
+		subject, body, err := tpl.Render(VerificationCodeTemplate, data)
+		require.NoError(t, err)
+		assert.Equal(t, "Verify your address", subject)
+		assert.Contains(t, body, "123456")
+		assert.Contains(t, body, "a@example.com")
+		_, _, err = tpl.Render("unknown", data)
+		assert.Error(t, err)
+	})
+	t.Run("should override templates from dir", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(dir, VerificationCodeTemplate), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, VerificationCodeTemplate, "body.tmpl"), []byte("code: {{ .Code }}"), 0600))
+		tpl, err := LoadTemplates(dir)
+		require.NoError(t, err)
+		subject, body, err := tpl.Render(VerificationCodeTemplate, data)
+		require.NoError(t, err)
+		assert.Equal(t, "Verify your address", subject, "expected not overridden file to be built-in")
+		assert.Equal(t, "code: 123456", body)
+	})
+	t.Run("should reject invalid template", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(dir, RecoveryTokenTemplate), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, RecoveryTokenTemplate, "subject.tmpl"), []byte("{{ .Token"), 0600))
+		_, err := LoadTemplates(dir)
+		assert.Error(t, err)
+	})
+}
@@ -1,8 +1,9 @@
 module github.com/trapck/kr.api
 
-go 1.14
+go 1.16
 
 require (
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	github.com/gofiber/fiber v1.13.3
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/lib/pq v1.8.0
@@ -10,4 +11,6 @@ require (
 	github.com/stretchr/testify v1.6.1
 	github.com/xeipuuv/gojsonschema v1.2.0
 	go.mongodb.org/mongo-driver v1.4.0
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,98 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/trapck/kr.api/appconfig"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Hasher hashes passwords with Argon2id. Hashes are encoded in PHC string format
+type Argon2Hasher struct {
+	params argon2Params
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  uint32
+	keyLength   uint32
+}
+
+// NewArgon2 creates Argon2id hasher
+func NewArgon2(cfg appconfig.Argon2Config) *Argon2Hasher {
+	return &Argon2Hasher{params: argon2Params{
+		memory:      uint32(cfg.Memory),
+		iterations:  uint32(cfg.Iterations),
+		parallelism: uint8(cfg.Parallelism),
+		saltLength:  uint32(cfg.SaltLength),
+		keyLength:   uint32(cfg.KeyLength),
+	}}
+}
+
+// Hash returns Argon2id hash of the password with a random salt
+func (h *Argon2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.params
+	key := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		appconfig.Argon2idHash, argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// NeedsRehash returns whether hash is not Argon2id hash made with the hasher parameters
+func (h *Argon2Hasher) NeedsRehash(hash string) bool {
+	p, salt, key, err := decodeArgon2(hash)
+	if err != nil {
+		return true
+	}
+	p.saltLength, p.keyLength = uint32(len(salt)), uint32(len(key))
+	return p != h.params
+}
+
+func compareArgon2(password, hash string) error {
+	p, salt, key, err := decodeArgon2(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// decodeArgon2 parses $argon2id$v=19$m=65536,t=3,p=2$salt$key hash
+func decodeArgon2(hash string) (argon2Params, []byte, []byte, error) {
+	p := argon2Params{}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != appconfig.Argon2idHash {
+		return p, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	return p, salt, key, nil
+}
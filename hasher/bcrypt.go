@@ -0,0 +1,58 @@
+package hasher
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptMaxPasswordBytes is a max password length bcrypt takes into account. Longer passwords are rejected,
+// so passwords sharing the first bytes don't match each other
+const BcryptMaxPasswordBytes = 72
+
+// ErrPasswordTooLong is returned when password is longer than the hash algorithm takes into account
+var ErrPasswordTooLong = errors.New("password is too long for bcrypt")
+
+// BcryptHasher hashes passwords with bcrypt
+type BcryptHasher struct {
+	cost int
+}
+
+// NewBcrypt creates bcrypt hasher
+func NewBcrypt(cost int) *BcryptHasher {
+	return &BcryptHasher{cost: cost}
+}
+
+// Hash returns bcrypt hash of the password not longer than BcryptMaxPasswordBytes
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	if len(password) > BcryptMaxPasswordBytes {
+		return "", ErrPasswordTooLong
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(b), err
+}
+
+// NeedsRehash returns whether hash is not bcrypt hash of the hasher cost
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	if !isBcrypt(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func compareBcrypt(password, hash string) error {
+	if len(password) > BcryptMaxPasswordBytes {
+		return ErrMismatch
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrMismatch
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+// Package hasher hashes passwords with Argon2id or bcrypt and compares them with stored hashes
+package hasher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/trapck/kr.api/appconfig"
+)
+
+// Errors returned by Compare
+var (
+	ErrMismatch    = errors.New("password does not match hash")
+	ErrUnknownHash = errors.New("unknown password hash format")
+)
+
+// Hasher hashes passwords with configured algorithm and parameters
+type Hasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash returns whether hash was made by other algorithm or with other parameters
+	NeedsRehash(hash string) bool
+}
+
+// New creates hasher of the configured algorithm
+func New(cfg appconfig.PasswordConfig) (Hasher, error) {
+	switch cfg.Algorithm {
+	case appconfig.Argon2idHash:
+		return NewArgon2(cfg.Argon2), nil
+	case appconfig.BcryptHash:
+		return NewBcrypt(cfg.BcryptCost), nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q. Expected %s or %s", cfg.Algorithm, appconfig.Argon2idHash, appconfig.BcryptHash)
+	}
+}
+
+// Compare checks password against hash made by any supported algorithm
+func Compare(password, hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$"+appconfig.Argon2idHash+"$"):
+		return compareArgon2(password, hash)
+	case isBcrypt(hash):
+		return compareBcrypt(password, hash)
+	default:
+		return ErrUnknownHash
+	}
+}
@@ -0,0 +1,78 @@
+package hasher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/appconfig"
+)
+
+func testConfig(algorithm string) appconfig.PasswordConfig {
+	cfg := appconfig.Default().Password
+	cfg.Algorithm = algorithm
+	cfg.Argon2.Memory = 64
+	cfg.BcryptCost = 4
+	return cfg
+}
+
+func TestHashers(t *testing.T) {
+	for _, algorithm := range []string{appconfig.Argon2idHash, appconfig.BcryptHash} {
+		t.Run(algorithm, func(t *testing.T) {
+			h, err := New(testConfig(algorithm))
+			require.NoError(t, err)
+			hash, err := h.Hash("correct horse")
+			require.NoError(t, err)
+			assert.NotContains(t, hash, "correct horse")
+
+			assert.NoError(t, Compare("correct horse", hash))
+			assert.Equal(t, ErrMismatch, Compare("wrong horse", hash))
+			assert.False(t, h.NeedsRehash(hash), "expected hash made with current parameters to be kept")
+
+			other, err := h.Hash("correct horse")
+			require.NoError(t, err)
+			assert.NotEqual(t, hash, other, "expected hashes to be salted")
+		})
+	}
+}
+
+func TestBcryptPasswordLength(t *testing.T) {
+	h := NewBcrypt(4)
+	prefix := strings.Repeat("a", BcryptMaxPasswordBytes)
+	_, err := h.Hash(prefix + "b")
+	assert.Equal(t, ErrPasswordTooLong, err)
+	hash, err := h.Hash(prefix)
+	require.NoError(t, err)
+	assert.NoError(t, Compare(prefix, hash))
+	assert.Equal(t, ErrMismatch, Compare(prefix+"b", hash), "expected bytes bcrypt ignores not to match")
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weak := testConfig(appconfig.Argon2idHash)
+	strong := weak
+	strong.Argon2.Iterations++
+	weakHash, err := NewArgon2(weak.Argon2).Hash("password")
+	require.NoError(t, err)
+	bcryptHash, err := NewBcrypt(4).Hash("password")
+	require.NoError(t, err)
+
+	assert.True(t, NewArgon2(strong.Argon2).NeedsRehash(weakHash), "expected changed parameters to require rehash")
+	assert.True(t, NewArgon2(weak.Argon2).NeedsRehash(bcryptHash), "expected other algorithm to require rehash")
+	assert.True(t, NewBcrypt(5).NeedsRehash(bcryptHash), "expected changed cost to require rehash")
+	assert.True(t, NewBcrypt(4).NeedsRehash(weakHash), "expected other algorithm to require rehash")
+}
+
+func TestCompareErrors(t *testing.T) {
+	assert.Equal(t, ErrUnknownHash, Compare("password", "plain"))
+	assert.Equal(t, ErrUnknownHash, Compare("password", "$argon2id$v=19$m=64,t=1$c2FsdA$a2V5"))
+	assert.Equal(t, ErrUnknownHash, Compare("password", "$argon2id$v=18$m=64,t=1,p=2$c2FsdA$a2V5"))
+	h, err := NewArgon2(testConfig(appconfig.Argon2idHash).Argon2).Hash("password")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(h, "$argon2id$v=19$m=64,t=1,p=2$"), h)
+}
+
+func TestNewUnknownAlgorithm(t *testing.T) {
+	_, err := New(testConfig("md5"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package identityschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/trapck/kr.api/model"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ErrUnknownSchema is returned when identity references not registered schema id
+var ErrUnknownSchema = errors.New("unknown identity schema")
+
+// entry is a registered schema document with its compiled form. Source is the document as it was synced,
+// so unchanged documents are not compiled again
+type entry struct {
+	raw      json.RawMessage
+	source   []byte
+	compiled *gojsonschema.Schema
+}
+
+// Registry holds compiled identity JSON schemas by schema id
+type Registry struct {
+	mu      sync.RWMutex
+	schemas map[string]entry
+}
+
+// NewRegistry creates a registry with embedded default schema registered
+func NewRegistry() *Registry {
+	r := &Registry{schemas: map[string]entry{}}
+	if err := r.Register(model.DefaultSchemaID, gojsonschema.NewBytesLoader(model.DefaultIdentitySchema)); err != nil {
+		panic(fmt.Sprintf("invalid embedded identity schema: %v", err))
+	}
+	return r
+}
+
+// Load creates a registry with embedded default schema and schemas read from the given paths or URLs by schema id.
+// Default schema can be overridden as well
+func Load(locations map[string]string) (*Registry, error) {
+	r := NewRegistry()
+	for id, location := range locations {
+		if err := r.Register(id, gojsonschema.NewReferenceLoader(URL(location))); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Register compiles the schema and registers it by id replacing previously registered one
+func (r *Registry) Register(id string, l gojsonschema.JSONLoader) error {
+	return r.register(id, l, nil)
+}
+
+// Sync registers the schema document by id unless the same document is registered already.
+// Returns whether the registered schema was replaced
+func (r *Registry) Sync(id string, doc []byte) (bool, error) {
+	r.mu.RLock()
+	e, ok := r.schemas[id]
+	r.mu.RUnlock()
+	if ok && e.source != nil && bytes.Equal(e.source, doc) {
+		return false, nil
+	}
+	if err := r.register(id, gojsonschema.NewBytesLoader(doc), doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *Registry) register(id string, l gojsonschema.JSONLoader, source []byte) error {
+	if id == "" {
+		return errors.New("schema id must not be empty")
+	}
+	doc, err := l.LoadJSON()
+	if err != nil {
+		return fmt.Errorf("could not load identity schema %q: %v", id, err)
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	s, err := gojsonschema.NewSchema(l)
+	if err != nil {
+		return fmt.Errorf("invalid identity schema %q: %v", id, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[id] = entry{raw: raw, source: source, compiled: s}
+	return nil
+}
+
+// Get returns JSON document of the schema with given id
+func (r *Registry) Get(id string) (json.RawMessage, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.schemas[id]
+	return e.raw, ok
+}
+
+// IDs returns sorted ids of all registered schemas
+func (r *Registry) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.schemas))
+	for id := range r.schemas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Validate validates the document against the schema with given id. Empty id stands for the default schema
+func (r *Registry) Validate(id string, doc gojsonschema.JSONLoader) (*gojsonschema.Result, error) {
+	if id == "" {
+		id = model.DefaultSchemaID
+	}
+	r.mu.RLock()
+	e, ok := r.schemas[id]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSchema, id)
+	}
+	return e.compiled.Validate(doc)
+}
+
+// URL converts file path to file URL keeping URLs as is
+func URL(location string) string {
+	if strings.Contains(location, "://") {
+		return location
+	}
+	if abs, err := filepath.Abs(location); err == nil {
+		location = abs
+	}
+	return "file://" + filepath.ToSlash(location)
+}
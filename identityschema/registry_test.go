@@ -0,0 +1,53 @@
+package identityschema
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+func TestRegistry(t *testing.T) {
+	r, err := Load(map[string]string{"file": "../model/schema.json"})
+	require.NoError(t, err)
+	require.NoError(t, r.Register("strict", gojsonschema.NewStringLoader(`{"type":"object","required":["traits"]}`)))
+	assert.Equal(t, []string{"default", "file", "strict"}, r.IDs())
+
+	t.Run("should validate against default schema for empty id", func(t *testing.T) {
+		res, err := r.Validate("", gojsonschema.NewStringLoader(`{"id":"not-a-uuid"}`))
+		require.NoError(t, err)
+		assert.False(t, res.Valid(), "expected default schema to require uuid id")
+	})
+	t.Run("should validate against schema by id", func(t *testing.T) {
+		res, err := r.Validate("strict", gojsonschema.NewStringLoader(`{"traits":{}}`))
+		require.NoError(t, err)
+		assert.True(t, res.Valid())
+	})
+	t.Run("should reject unknown schema id", func(t *testing.T) {
+		_, err := r.Validate("unknown", gojsonschema.NewStringLoader(`{}`))
+		assert.True(t, errors.Is(err, ErrUnknownSchema))
+	})
+	t.Run("should sync changed documents only", func(t *testing.T) {
+		replaced, err := r.Sync("synced", []byte(`{"type":"object","required":["traits"]}`))
+		require.NoError(t, err)
+		assert.True(t, replaced, "expected new document to be registered")
+		replaced, err = r.Sync("synced", []byte(`{"type":"object","required":["traits"]}`))
+		require.NoError(t, err)
+		assert.False(t, replaced, "expected same document not to be compiled again")
+		replaced, err = r.Sync("synced", []byte(`{"type":"object"}`))
+		require.NoError(t, err)
+		assert.True(t, replaced, "expected changed document to replace registered one")
+		res, err := r.Validate("synced", gojsonschema.NewStringLoader(`{}`))
+		require.NoError(t, err)
+		assert.True(t, res.Valid(), "expected changed document to be used for validation")
+		_, err = r.Sync("synced", []byte(`{"type":1}`))
+		assert.Error(t, err)
+	})
+	t.Run("should reject invalid schema", func(t *testing.T) {
+		assert.Error(t, r.Register("invalid", gojsonschema.NewStringLoader(`{"type":1}`)))
+		_, err := Load(map[string]string{"missing": "missing.json"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,74 @@
+// Package lifecycle runs the service until a termination signal and then releases its resources in order
+package lifecycle
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// Manager runs stop hooks once, in reverse order of their registration, sharing a single deadline
+type Manager struct {
+	timeout time.Duration
+	hooks   []hook
+	once    sync.Once
+	err     error
+}
+
+type hook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// New returns manager which gives stop hooks the timeout to finish
+func New(timeout time.Duration) *Manager {
+	return &Manager{timeout: timeout}
+}
+
+// OnStop registers a hook releasing a resource. Resources acquired later are released first,
+// so a hook may rely on resources registered before it
+func (m *Manager) OnStop(name string, stop func(ctx context.Context) error) {
+	m.hooks = append(m.hooks, hook{name, stop})
+}
+
+// Run calls serve and waits until it returns or one of the signals is received, then runs stop hooks.
+// It returns the serve error or the first stop hook error
+func (m *Manager) Run(serve func() error, signals ...os.Signal) error {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	defer signal.Stop(received)
+	errs := make(chan error, 1)
+	go func() { errs <- serve() }()
+	var err error
+	select {
+	case s := <-received:
+		log.Printf("received %s, shutting down", s)
+	case err = <-errs:
+	}
+	if e := m.Stop(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Stop runs stop hooks unless they were already run. Every hook is run even when previous ones fail
+// or the deadline is exceeded. It returns the first hook error
+func (m *Manager) Stop() error {
+	m.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+		for n := len(m.hooks) - 1; n >= 0; n-- {
+			h := m.hooks[n]
+			if err := h.stop(ctx); err != nil {
+				log.Printf("could not stop %s: %v", h.name, err)
+				if m.err == nil {
+					m.err = err
+				}
+			}
+		}
+	})
+	return m.err
+}
@@ -0,0 +1,65 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStop(t *testing.T) {
+	m := New(50 * time.Millisecond)
+	var stopped []string
+	failure := errors.New("failure")
+	m.OnStop("store", func(ctx context.Context) error {
+		stopped = append(stopped, "store")
+		assert.Error(t, ctx.Err(), "expected shared deadline to be exceeded by previous hook")
+		return nil
+	})
+	m.OnStop("courier", func(ctx context.Context) error {
+		stopped = append(stopped, "courier")
+		return failure
+	})
+	m.OnStop("server", func(ctx context.Context) error {
+		stopped = append(stopped, "server")
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Equal(t, context.DeadlineExceeded, m.Stop(), "expected the first hook error")
+	assert.Equal(t, []string{"server", "courier", "store"}, stopped, "expected hooks to run in reverse order")
+	assert.Equal(t, context.DeadlineExceeded, m.Stop())
+	assert.Len(t, stopped, 3, "expected hooks to run once")
+}
+
+func TestRunUntilSignal(t *testing.T) {
+	m := New(time.Second)
+	stop := make(chan struct{})
+	m.OnStop("server", func(ctx context.Context) error {
+		close(stop)
+		return nil
+	})
+	p, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	err = m.Run(func() error {
+		require.NoError(t, p.Signal(os.Interrupt))
+		<-stop
+		return nil
+	}, os.Interrupt)
+	assert.NoError(t, err)
+}
+
+func TestRunUntilServeFails(t *testing.T) {
+	m := New(time.Second)
+	stopped := false
+	m.OnStop("store", func(ctx context.Context) error {
+		stopped = true
+		return nil
+	})
+	failure := errors.New("address already in use")
+	assert.Equal(t, failure, m.Run(func() error { return failure }, os.Interrupt))
+	assert.True(t, stopped, "expected resources to be released after serve failure")
+}
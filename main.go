@@ -1,35 +1,169 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"syscall"
 
 	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/auth"
+	"github.com/trapck/kr.api/courier"
+	"github.com/trapck/kr.api/lifecycle"
+	"github.com/trapck/kr.api/memstore"
 	"github.com/trapck/kr.api/mongostore"
 	"github.com/trapck/kr.api/postgresstore"
 	"github.com/trapck/kr.api/server"
 )
 
 func main() {
-	var s server.Store
-	switch appconfig.Store {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "api-key" {
+		if err := printAPIKey(); err != nil {
+			log.Fatalf("could not generate api key %v", err)
+		}
+		return
+	}
+	isMigrate := len(args) > 0 && args[0] == "migrate"
+	if isMigrate {
+		args = args[1:]
+	}
+	cfg, args, err := appconfig.Load(args, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("invalid configuration %v\nusage: kr.api [migrate | api-key] [flags]\n%s", err, appconfig.Usage())
+	}
+	if isMigrate {
+		if err := migrate(cfg, args); err != nil {
+			log.Fatalf("migration failed %v", err)
+		}
+		return
+	}
+	if err := serve(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs the application until SIGINT or SIGTERM, then drains in-flight requests
+// and stops the courier before closing the store
+func serve(cfg appconfig.Config) error {
+	lc := lifecycle.New(cfg.ShutdownTimeout.Duration)
+	s, err := openStore(cfg, lc)
+	if err != nil {
+		return err
+	}
+	app, err := server.NewApp(s, cfg)
+	if err != nil {
+		lc.Stop()
+		return fmt.Errorf("could not init app %v", err)
+	}
+	if len(cfg.Auth.APIKeys) == 0 && cfg.Auth.JWT.JWKSFile == "" {
+		log.Printf("no api keys or jwks file configured, identity management api rejects all requests")
+	}
+	c, err := courier.New(s, cfg.Courier)
+	if err != nil {
+		lc.Stop()
+		return fmt.Errorf("could not init courier %v", err)
+	}
+	app.SetNotifier(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	lc.OnStop("courier", func(stopCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+		case <-stopCtx.Done():
+			return stopCtx.Err()
+		}
+		return c.Close()
+	})
+	lc.OnStop("server", app.Shutdown)
+	err = lc.Run(func() error { return app.Start(cfg.Port, cfg.AdminPort) }, os.Interrupt, syscall.SIGTERM)
+	if err != nil {
+		return fmt.Errorf("could not serve on ports %d and %d %v", cfg.Port, cfg.AdminPort, err)
+	}
+	return nil
+}
+
+// openStore opens configured store and registers its closing
+func openStore(cfg appconfig.Config, lc *lifecycle.Manager) (server.Store, error) {
+	switch cfg.Store {
 	case appconfig.PostgresStore:
 		ps := &postgresstore.Store{}
-		if err := ps.Init(); err != nil {
-			log.Fatalf("could not open postgres db connection %q", err)
+		if err := ps.Init(cfg.Postgres); err != nil {
+			return nil, fmt.Errorf("could not open postgres db connection %q", err)
 		}
-		s = ps
-		defer ps.Close()
+		lc.OnStop("postgres store", func(context.Context) error { return ps.Close() })
+		return ps, nil
 	case appconfig.MongoStore:
 		ms := &mongostore.Store{}
+		if err := ms.Init(cfg.Mongo); err != nil {
+			return nil, fmt.Errorf("could not open mongo db connection %q", err)
+		}
+		lc.OnStop("mongo store", func(context.Context) error { return ms.Close() })
+		return ms, nil
+	case appconfig.MemoryStore:
+		ms := &memstore.Store{}
 		if err := ms.Init(); err != nil {
-			log.Fatalf("could not open mongo db connection %q", err)
+			return nil, fmt.Errorf("could not init memory store %q", err)
 		}
-		s = ms
-		defer ms.Close()
+		lc.OnStop("memory store", func(context.Context) error { return ms.Close() })
+		return ms, nil
 	default:
-		log.Fatalf("unknown store type")
+		return nil, fmt.Errorf("unknown store type")
+	}
+}
+
+// printAPIKey prints a new random API key with its hash to be put into auth.api_keys config
+func printAPIKey() error {
+	key, err := auth.NewAPIKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("key: %s\nhash: %s\n", key, auth.HashAPIKey(key))
+	return nil
+}
+
+// migrate runs "migrate [up | down [steps] | status]" command against postgres store
+func migrate(cfg appconfig.Config, args []string) error {
+	ps := &postgresstore.Store{}
+	if err := ps.Open(cfg.Postgres); err != nil {
+		return fmt.Errorf("could not open postgres db connection %q", err)
 	}
-	if err := server.NewApp(s).Start(appconfig.Port); err != nil {
-		log.Fatalf("could not listen on port %d %v", appconfig.Port, err)
+	defer ps.Close()
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		return ps.Migrate()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		return ps.MigrateDown(steps)
+	case "status":
+		st, err := ps.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("current version: %d\nlatest version: %d\n", st.Current, st.Latest)
+		for _, m := range st.Pending {
+			fmt.Printf("pending: %d_%s\n", m.Version, m.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", cmd)
 	}
 }
@@ -0,0 +1,194 @@
+package memstore
+
+import (
+	"errors"
+	"time"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// ErrCredentialsNotFound is returned when no identity has credentials with the identifier
+var ErrCredentialsNotFound = errors.New("credentials not found")
+
+// credentialsKey identifies credentials identifier which must be unique per type
+type credentialsKey struct {
+	credType   string
+	identifier string
+}
+
+// PutCredentials inserts or replaces identity credentials of c.Type
+func (s *Store) PutCredentials(c model.Credentials) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[c.IdentityID]; !ok {
+		return ErrNotFound
+	}
+	seen := map[string]bool{}
+	for _, v := range c.Identifiers {
+		if o, ok := s.identifiers[credentialsKey{c.Type, v}]; (ok && o != c.IdentityID) || seen[v] {
+			return ErrDuplicate
+		}
+		seen[v] = true
+	}
+	if s.credentials == nil {
+		s.credentials = map[string]map[string]model.Credentials{}
+		s.identifiers = map[credentialsKey]string{}
+	}
+	if previous, ok := s.credentials[c.IdentityID][c.Type]; ok {
+		for _, v := range previous.Identifiers {
+			delete(s.identifiers, credentialsKey{c.Type, v})
+		}
+	}
+	if s.credentials[c.IdentityID] == nil {
+		s.credentials[c.IdentityID] = map[string]model.Credentials{}
+	}
+	s.credentials[c.IdentityID][c.Type] = copyCredentials(c)
+	for _, v := range c.Identifiers {
+		s.identifiers[credentialsKey{c.Type, v}] = c.IdentityID
+	}
+	return nil
+}
+
+// FindCredentials returns credentials of the type having the identifier
+func (s *Store) FindCredentials(credType, identifier string) (model.Credentials, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.identifiers[credentialsKey{credType, identifier}]
+	if !ok {
+		return model.Credentials{}, ErrCredentialsNotFound
+	}
+	return copyCredentials(s.credentials[id][credType]), nil
+}
+
+// MergeCredentialsConfig sets and deletes keys of identity credentials config of the type keeping its other keys
+func (s *Store) MergeCredentialsConfig(identityID, credType string, set model.JSONObject, unset []string, updatedAt time.Time) error {
+	return s.changeCredentials(identityID, credType, func(c *model.Credentials) bool {
+		for k, v := range set {
+			c.Config[k] = v
+		}
+		for _, k := range unset {
+			delete(c.Config, k)
+		}
+		c.UpdatedAt = updatedAt
+		return true
+	})
+}
+
+// IncrementTOTPAttempts counts a second factor attempt and returns totp credentials of the identity.
+// The count restarts at now when its window started at or before windowStart
+func (s *Store) IncrementTOTPAttempts(identityID string, now, windowStart time.Time) (model.Credentials, error) {
+	var res model.Credentials
+	err := s.changeCredentials(identityID, model.CredentialsTOTP, func(c *model.Credentials) bool {
+		if c.TOTPAttemptsSince() <= model.UnixMillis(windowStart) {
+			c.Config[model.TOTPAttemptsKey] = int64(1)
+			c.Config[model.TOTPAttemptsSinceKey] = model.UnixMillis(now)
+		} else {
+			c.Config[model.TOTPAttemptsKey] = c.TOTPAttempts() + 1
+		}
+		res = copyCredentials(*c)
+		return true
+	})
+	return res, err
+}
+
+// ConsumeTOTPStep sets the last accepted totp step of the identity and resets counted attempts.
+// It fails with ErrCredentialsNotFound unless the stored step is before step
+func (s *Store) ConsumeTOTPStep(identityID string, step int64, updatedAt time.Time) error {
+	return s.changeCredentials(identityID, model.CredentialsTOTP, func(c *model.Credentials) bool {
+		if c.TOTPLastStep() >= step {
+			return false
+		}
+		c.Config[model.TOTPLastStepKey] = step
+		c.Config[model.TOTPAttemptsKey] = int64(0)
+		c.UpdatedAt = updatedAt
+		return true
+	})
+}
+
+// UseTOTPRecoveryCode removes the recovery code hash from totp credentials of the identity and resets counted attempts.
+// It fails with ErrCredentialsNotFound when the hash is not stored
+func (s *Store) UseTOTPRecoveryCode(identityID, hash string, updatedAt time.Time) error {
+	return s.changeCredentials(identityID, model.CredentialsTOTP, func(c *model.Credentials) bool {
+		hashes := c.TOTPRecoveryCodes()
+		left := make([]string, 0, len(hashes))
+		for _, h := range hashes {
+			if h != hash {
+				left = append(left, h)
+			}
+		}
+		if len(left) == len(hashes) {
+			return false
+		}
+		c.Config[model.TOTPRecoveryCodesKey] = left
+		c.Config[model.TOTPAttemptsKey] = int64(0)
+		c.UpdatedAt = updatedAt
+		return true
+	})
+}
+
+// changeCredentials applies change to identity credentials of the type under the store lock.
+// Credentials are kept as they were when change returns false
+func (s *Store) changeCredentials(identityID, credType string, change func(c *model.Credentials) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.credentials[identityID][credType]
+	if !ok {
+		return ErrCredentialsNotFound
+	}
+	c = copyCredentials(c)
+	if c.Config == nil {
+		c.Config = model.JSONObject{}
+	}
+	if !change(&c) {
+		return ErrCredentialsNotFound
+	}
+	s.credentials[identityID][credType] = c
+	return nil
+}
+
+// identityCredentials returns copy of all identity credentials by type or nil when there are none
+func (s *Store) identityCredentials(id string) map[string]model.Credentials {
+	if len(s.credentials[id]) == 0 {
+		return nil
+	}
+	res := map[string]model.Credentials{}
+	for t, c := range s.credentials[id] {
+		res[t] = copyCredentials(c)
+	}
+	return res
+}
+
+// moveCredentials moves credentials of identity to its new id
+func (s *Store) moveCredentials(from, to string) {
+	m, ok := s.credentials[from]
+	if !ok {
+		return
+	}
+	delete(s.credentials, from)
+	for t, c := range m {
+		c.IdentityID = to
+		m[t] = c
+		for _, v := range c.Identifiers {
+			s.identifiers[credentialsKey{t, v}] = to
+		}
+	}
+	s.credentials[to] = m
+}
+
+// deleteCredentials deletes all identity credentials
+func (s *Store) deleteCredentials(id string) {
+	for t, c := range s.credentials[id] {
+		for _, v := range c.Identifiers {
+			delete(s.identifiers, credentialsKey{t, v})
+		}
+	}
+	delete(s.credentials, id)
+}
+
+func copyCredentials(c model.Credentials) model.Credentials {
+	if c.Identifiers != nil {
+		c.Identifiers = append([]string{}, c.Identifiers...)
+	}
+	c.Config = c.Config.Copy()
+	return c
+}
@@ -0,0 +1,8 @@
+package memstore
+
+import "context"
+
+// Ping always succeeds as memory store has no connection
+func (s *Store) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package memstore
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// ErrMessageNotFound is returned when message is not queued
+var ErrMessageNotFound = errors.New("message not found")
+
+// EnqueueMessage inserts message
+func (s *Store) EnqueueMessage(m model.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.messages == nil {
+		s.messages = map[string]model.Message{}
+	}
+	if _, ok := s.messages[m.ID]; ok {
+		return ErrDuplicate
+	}
+	s.messages[m.ID] = m
+	return nil
+}
+
+// ClaimMessages marks up to limit due messages as sending and returns them ordered by send time.
+// Due messages are queued ones which should be sent not later than now and sending ones not updated since reclaimBefore
+func (s *Store) ClaimMessages(now, reclaimBefore time.Time, limit int) ([]model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []model.Message{}
+	for _, m := range s.messages {
+		if (m.Status == model.MessageQueued && !m.SendAfter.After(now)) || (m.Status == model.MessageSending && m.UpdatedAt.Before(reclaimBefore)) {
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].SendAfter.Equal(res[j].SendAfter) {
+			return res[i].ID < res[j].ID
+		}
+		return res[i].SendAfter.Before(res[j].SendAfter)
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	for k := range res {
+		res[k].Status, res[k].UpdatedAt = model.MessageSending, now
+		s.messages[res[k].ID] = res[k]
+	}
+	return res, nil
+}
+
+// UpdateMessage replaces message with the same id
+func (s *Store) UpdateMessage(m model.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[m.ID]; !ok {
+		return ErrMessageNotFound
+	}
+	s.messages[m.ID] = m
+	return nil
+}
+
+// ListMessages returns up to q.Limit messages matching q filters ordered from the newest
+func (s *Store) ListMessages(q model.MessageQuery) ([]model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := []model.Message{}
+	for _, m := range s.messages {
+		if q.MatchMessage(m) {
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CreatedAt.Equal(res[j].CreatedAt) {
+			return res[i].ID > res[j].ID
+		}
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	if len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res, nil
+}
+
+// GetMessage returns message by id
+func (s *Store) GetMessage(id string) (model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return m, ErrMessageNotFound
+	}
+	return m, nil
+}
@@ -0,0 +1,65 @@
+package memstore
+
+import (
+	"errors"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// ErrTokenNotFound is returned when recovery token is unknown or already used
+var ErrTokenNotFound = errors.New("recovery token not found")
+
+// SaveRecoveryToken inserts recovery token
+func (s *Store) SaveRecoveryToken(t model.RecoveryToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		s.tokens = map[string]model.RecoveryToken{}
+	}
+	if _, ok := s.tokens[t.TokenHash]; ok {
+		return ErrDuplicate
+	}
+	s.tokens[t.TokenHash] = t
+	return nil
+}
+
+// GetLatestRecoveryToken returns the most recently created recovery token of the identity
+func (s *Store) GetLatestRecoveryToken(identityID string) (model.RecoveryToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var latest model.RecoveryToken
+	found := false
+	for _, v := range s.tokens {
+		if v.IdentityID == identityID && (!found || v.CreatedAt.After(latest.CreatedAt)) {
+			latest, found = v, true
+		}
+	}
+	if !found {
+		return latest, ErrTokenNotFound
+	}
+	return latest, nil
+}
+
+// UseRecoveryToken deletes recovery token and returns it, so every token can be used once
+func (s *Store) UseRecoveryToken(tokenHash string) (model.RecoveryToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[tokenHash]
+	if !ok {
+		return t, ErrTokenNotFound
+	}
+	delete(s.tokens, tokenHash)
+	return t, nil
+}
+
+// DeleteRecoveryTokens deletes all recovery tokens of the identity
+func (s *Store) DeleteRecoveryTokens(identityID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.tokens {
+		if v.IdentityID == identityID {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
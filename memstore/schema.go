@@ -0,0 +1,51 @@
+package memstore
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// ErrSchemaNotFound is returned when identity schema is not stored
+var ErrSchemaNotFound = errors.New("identity schema not found")
+
+// ListSchemas returns all stored identity schemas ordered by id
+func (s *Store) ListSchemas() ([]model.IdentitySchema, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]model.IdentitySchema, 0, len(s.schemas))
+	for _, v := range s.schemas {
+		res = append(res, copySchema(v))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// GetSchema returns identity schema by id
+func (s *Store) GetSchema(id string) (model.IdentitySchema, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.schemas[id]
+	if !ok {
+		return model.IdentitySchema{}, ErrSchemaNotFound
+	}
+	return copySchema(v), nil
+}
+
+// PutSchema inserts or replaces identity schema
+func (s *Store) PutSchema(schema model.IdentitySchema) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schemas == nil {
+		s.schemas = map[string]model.IdentitySchema{}
+	}
+	s.schemas[schema.ID] = copySchema(schema)
+	return nil
+}
+
+func copySchema(s model.IdentitySchema) model.IdentitySchema {
+	s.Schema = append(json.RawMessage(nil), s.Schema...)
+	return s
+}
@@ -0,0 +1,55 @@
+package memstore
+
+import (
+	"errors"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// ErrSessionNotFound is returned when session token is unknown or revoked
+var ErrSessionNotFound = errors.New("session not found")
+
+// CreateSession inserts session
+func (s *Store) CreateSession(v model.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = map[string]model.Session{}
+	}
+	if _, ok := s.sessions[v.TokenHash]; ok {
+		return ErrDuplicate
+	}
+	s.sessions[v.TokenHash] = v
+	return nil
+}
+
+// GetSession returns session by hash of its token
+func (s *Store) GetSession(tokenHash string) (model.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.sessions[tokenHash]
+	if !ok {
+		return v, ErrSessionNotFound
+	}
+	return v, nil
+}
+
+// DeleteSession deletes session by hash of its token if any
+func (s *Store) DeleteSession(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+// DeleteOtherSessions deletes all sessions of the identity except the one with the token hash
+func (s *Store) DeleteOtherSessions(identityID, exceptTokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.sessions {
+		if v.IdentityID == identityID && k != exceptTokenHash {
+			delete(s.sessions, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package memstore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// Errors returned by the in-memory store
+var (
+	ErrNotFound        = errors.New("identity not found")
+	ErrDuplicate       = errors.New("identity or address already exists")
+	ErrVersionMismatch = errors.New("identity version mismatch")
+)
+
+// addressKey identifies an address which must be unique across identities
+type addressKey struct {
+	verifiable bool
+	via        string
+	value      string
+}
+
+// Store is in-memory storage implementation. The zero value is ready to use
+type Store struct {
+	mu         sync.RWMutex
+	identities []model.Identity
+	index      map[string]int
+	addresses  map[addressKey]string
+	schemas    map[string]model.IdentitySchema
+	codes      map[string]model.VerificationCode
+	tokens     map[string]model.RecoveryToken
+	sessions   map[string]model.Session
+	messages   map[string]model.Message
+	// credentials are kept apart from identities, so identity updates don't change them
+	credentials map[string]map[string]model.Credentials
+	identifiers map[credentialsKey]string
+}
+
+// Init initializes the storage
+func (s *Store) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identities = nil
+	s.index = map[string]int{}
+	s.addresses = map[addressKey]string{}
+	s.schemas = map[string]model.IdentitySchema{}
+	s.codes = map[string]model.VerificationCode{}
+	s.tokens = map[string]model.RecoveryToken{}
+	s.sessions = map[string]model.Session{}
+	s.messages = map[string]model.Message{}
+	s.credentials = map[string]map[string]model.Credentials{}
+	s.identifiers = map[credentialsKey]string{}
+	return nil
+}
+
+// Close releases the storage data
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identities = nil
+	s.index = nil
+	s.addresses = nil
+	s.schemas = nil
+	s.codes = nil
+	s.tokens = nil
+	s.sessions = nil
+	s.messages = nil
+	s.credentials = nil
+	s.identifiers = nil
+	return nil
+}
+
+// List returns all identities
+func (s *Store) List() ([]model.Identity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]model.Identity, len(s.identities))
+	for i, v := range s.identities {
+		res[i] = copyIdentity(v)
+	}
+	return res, nil
+}
+
+// ListPage returns up to q.Limit identities matching q filters with id greater than q.After ordered by id
+func (s *Store) ListPage(q model.IdentityQuery) ([]model.Identity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.identities))
+	for _, v := range s.identities {
+		if v.ID > q.After && q.MatchIdentity(v) {
+			ids = append(ids, v.ID)
+		}
+	}
+	sort.Strings(ids)
+	if q.Limit < len(ids) {
+		ids = ids[:q.Limit]
+	}
+	res := make([]model.Identity, len(ids))
+	for n, id := range ids {
+		res[n] = copyIdentity(s.identities[s.index[id]])
+	}
+	return res, nil
+}
+
+// Get returns identity by id
+func (s *Store) Get(id string) (model.Identity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pos, ok := s.index[id]
+	if !ok {
+		return model.Identity{}, ErrNotFound
+	}
+	i := copyIdentity(s.identities[pos])
+	i.Credentials = s.identityCredentials(id)
+	return i, nil
+}
+
+// Create inserts identity
+func (s *Store) Create(i model.Identity) (model.Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[i.ID]; ok {
+		return i, ErrDuplicate
+	}
+	if !s.addressesAvailable("", i) {
+		return i, ErrDuplicate
+	}
+	if s.index == nil {
+		s.index = map[string]int{}
+	}
+	i.Version = 1
+	i.Touch(nil, time.Now())
+	s.index[i.ID] = len(s.identities)
+	s.identities = append(s.identities, copyIdentity(i))
+	s.addAddresses(i)
+	return i, nil
+}
+
+// Update replaces identity stored under id. Non zero i.Version must match the stored one
+func (s *Store) Update(id string, i model.Identity) (model.Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos, ok := s.index[id]
+	if !ok {
+		return i, ErrNotFound
+	}
+	previous := s.identities[pos]
+	if i.Version != 0 && i.Version != previous.Version {
+		return i, ErrVersionMismatch
+	}
+	i.Version = previous.Version + 1
+	i.Touch(&previous, time.Now())
+	if id != i.ID {
+		if _, ok := s.index[i.ID]; ok {
+			return i, ErrDuplicate
+		}
+	}
+	if !s.addressesAvailable(id, i) {
+		return i, ErrDuplicate
+	}
+	if id != i.ID {
+		delete(s.index, id)
+		s.index[i.ID] = pos
+		s.moveCredentials(id, i.ID)
+		s.moveIdentityRecords(id, i.ID)
+	}
+	s.removeAddresses(s.identities[pos])
+	s.identities[pos] = copyIdentity(i)
+	s.addAddresses(i)
+	return i, nil
+}
+
+// Delete deletes identity. Non zero version must match the stored one
+func (s *Store) Delete(id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos, ok := s.index[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != 0 && version != s.identities[pos].Version {
+		return ErrVersionMismatch
+	}
+	s.removeAddresses(s.identities[pos])
+	s.deleteCredentials(id)
+	s.moveIdentityRecords(id, "")
+	s.identities = append(s.identities[:pos], s.identities[pos+1:]...)
+	delete(s.index, id)
+	for i := pos; i < len(s.identities); i++ {
+		s.index[s.identities[i].ID] = i
+	}
+	return nil
+}
+
+// NoRows returns whether error is no rows error
+func (s *Store) NoRows(e error) bool {
+	return e == ErrNotFound || e == ErrSchemaNotFound || e == ErrCodeNotFound ||
+		e == ErrTokenNotFound || e == ErrSessionNotFound || e == ErrMessageNotFound ||
+		e == ErrCredentialsNotFound
+}
+
+// Duplicate returns whether error is caused by already existing identity id or address
+func (s *Store) Duplicate(e error) bool {
+	return e == ErrDuplicate
+}
+
+// VersionMismatch returns whether error is caused by outdated identity version
+func (s *Store) VersionMismatch(e error) bool {
+	return e == ErrVersionMismatch
+}
+
+// addressesAvailable checks that identity addresses are not used twice and are not owned by other identity than owner
+func (s *Store) addressesAvailable(owner string, i model.Identity) bool {
+	seen := map[addressKey]bool{}
+	for _, k := range addressKeys(i) {
+		if o, ok := s.addresses[k]; (ok && o != owner) || seen[k] {
+			return false
+		}
+		seen[k] = true
+	}
+	return true
+}
+
+func (s *Store) addAddresses(i model.Identity) {
+	if s.addresses == nil {
+		s.addresses = map[addressKey]string{}
+	}
+	for _, k := range addressKeys(i) {
+		s.addresses[k] = i.ID
+	}
+}
+
+func (s *Store) removeAddresses(i model.Identity) {
+	for _, k := range addressKeys(i) {
+		delete(s.addresses, k)
+	}
+}
+
+func addressKeys(i model.Identity) []addressKey {
+	keys := make([]addressKey, 0, len(i.VerifiableAddresses)+len(i.RecoveryAddresses))
+	for _, a := range i.VerifiableAddresses {
+		keys = append(keys, addressKey{verifiable: true, via: a.Via, value: a.Value})
+	}
+	for _, a := range i.RecoveryAddresses {
+		keys = append(keys, addressKey{via: a.Via, value: a.Value})
+	}
+	return keys
+}
+
+// moveIdentityRecords points verification codes, recovery tokens and sessions of identity to its new id.
+// Records are deleted when the new id is empty, so a reused id never gets them
+func (s *Store) moveIdentityRecords(from, to string) {
+	for k, v := range s.codes {
+		if v.IdentityID == from {
+			if v.IdentityID = to; to == "" {
+				delete(s.codes, k)
+			} else {
+				s.codes[k] = v
+			}
+		}
+	}
+	for k, v := range s.tokens {
+		if v.IdentityID == from {
+			if v.IdentityID = to; to == "" {
+				delete(s.tokens, k)
+			} else {
+				s.tokens[k] = v
+			}
+		}
+	}
+	for k, v := range s.sessions {
+		if v.IdentityID == from {
+			if v.IdentityID = to; to == "" {
+				delete(s.sessions, k)
+			} else {
+				s.sessions[k] = v
+			}
+		}
+	}
+	for k, v := range s.messages {
+		if v.IdentityID == from {
+			if v.IdentityID = to; to == "" {
+				delete(s.messages, k)
+			} else {
+				s.messages[k] = v
+			}
+		}
+	}
+}
+
+func copyIdentity(i model.Identity) model.Identity {
+	if i.RecoveryAddresses != nil {
+		ra := make([]model.RecoveryAddress, len(i.RecoveryAddresses))
+		copy(ra, i.RecoveryAddresses)
+		i.RecoveryAddresses = ra
+	}
+	if i.VerifiableAddresses != nil {
+		va := make([]model.VerifiableAddress, len(i.VerifiableAddresses))
+		for n, a := range i.VerifiableAddresses {
+			a.ExpiresAt = copyTime(a.ExpiresAt)
+			a.VerifiedAt = copyTime(a.VerifiedAt)
+			va[n] = a
+		}
+		i.VerifiableAddresses = va
+	}
+	i.Traits = i.Traits.Copy()
+	i.MetadataPublic = i.MetadataPublic.Copy()
+	i.MetadataAdmin = i.MetadataAdmin.Copy()
+	i.Credentials = nil
+	return i
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
@@ -0,0 +1,199 @@
+package memstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/server"
+	"github.com/trapck/kr.api/storetest"
+	"github.com/trapck/kr.api/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	input := []model.Identity{{ID: uuid.NewV4().String(), Version: 1}, {ID: uuid.NewV4().String(), Version: 1}}
+	for _, i := range input {
+		_, err := db.Create(i)
+		testutil.FailOnNotEqual(t, err, nil, "error when inserting identity for comparison")
+	}
+	actual, err := db.List()
+	testutil.FailOnNotEqual(t, err, nil, "expected db operation to be finished with no errors")
+	testutil.FailOnNotEqual(t, len(actual), len(input), "result list count doesn't match inserted identities count")
+	for n := range input {
+		storetest.AssertIdentity(t, input[n], actual[n], "result list doesn't match inserted identities")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	input := createIdentity()
+
+	t.Run("should create identity", func(t *testing.T) {
+		output, err := db.Create(input)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+		storetest.AssertIdentity(t, input, output, "created identity must be equal to input")
+		found, err := db.Get(input.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to find identity in db")
+		storetest.AssertIdentity(t, input, found, "stored identity must be equal to input")
+	})
+	t.Run("should return an error for duplicate id", func(t *testing.T) {
+		_, err := db.Create(model.Identity{ID: input.ID})
+		assert.Equal(t, ErrDuplicate, err, "expected to get duplicate error")
+	})
+	t.Run("should not share addresses with caller", func(t *testing.T) {
+		input.VerifiableAddresses[0].Value = "changed"
+		*input.VerifiableAddresses[0].VerifiedAt = time.Time{}
+		found, _ := db.Get(input.ID)
+		assert.NotEqual(t, "changed", found.VerifiableAddresses[0].Value, "stored address was changed through input slice")
+		assert.False(t, found.VerifiableAddresses[0].VerifiedAt.IsZero(), "stored time was changed through input pointer")
+	})
+}
+
+func TestGet(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	data := createIdentity()
+	db.Create(data)
+
+	t.Run("should return an existing entity", func(t *testing.T) {
+		found, err := db.Get(data.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		storetest.AssertIdentity(t, data, found, "expected to find identity in db with desired struct")
+	})
+	t.Run("should not share addresses with store", func(t *testing.T) {
+		found, _ := db.Get(data.ID)
+		found.RecoveryAddresses[0].Value = "changed"
+		again, _ := db.Get(data.ID)
+		storetest.AssertIdentity(t, data, again, "stored identity was changed through returned value")
+	})
+	t.Run("should return not found error for not existing entity", func(t *testing.T) {
+		_, err := db.Get(uuid.NewV4().String())
+		assert.True(t, db.NoRows(err), "expected to get not found error")
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	oldData := createIdentity()
+	newData := createIdentity()
+	other := model.Identity{ID: uuid.NewV4().String()}
+	db.Create(oldData)
+	db.Create(other)
+
+	t.Run("should update existing entity", func(t *testing.T) {
+		_, err := db.Update(oldData.ID, newData)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		found, err := db.Get(newData.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to find identity with new data in db")
+		assert.Equal(t, int64(2), found.Version, "expected version to be incremented")
+		storetest.AssertIdentity(t, newData, found, "expected to find identity with new data in db")
+		_, err = db.Get(oldData.ID)
+		assert.True(t, db.NoRows(err), "expected old id to be released")
+	})
+	t.Run("should return an error when changing id to existing one", func(t *testing.T) {
+		_, err := db.Update(newData.ID, model.Identity{ID: other.ID})
+		assert.Equal(t, ErrDuplicate, err, "expected to get duplicate error")
+	})
+	t.Run("should return not found error for not existing entity", func(t *testing.T) {
+		_, err := db.Update(uuid.NewV4().String(), newData)
+		assert.True(t, db.NoRows(err), "expected to get not found error")
+	})
+}
+
+func TestDelete(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	ids := []string{uuid.NewV4().String(), uuid.NewV4().String(), uuid.NewV4().String()}
+	for _, id := range ids {
+		db.Create(model.Identity{ID: id})
+	}
+
+	t.Run("should delete an existing entity", func(t *testing.T) {
+		err := db.Delete(ids[0], 0)
+		testutil.FailOnNotEqual(t, err, nil, "expected to delete identity without error")
+		_, err = db.Get(ids[0])
+		assert.True(t, db.NoRows(err), "expected identity to be not found in db")
+		for _, id := range ids[1:] {
+			_, err = db.Get(id)
+			assert.NoError(t, err, "expected remaining identities to be found in db")
+		}
+	})
+	t.Run("should return not found error for not existing entity", func(t *testing.T) {
+		err := db.Delete(uuid.NewV4().String(), 0)
+		assert.True(t, db.NoRows(err), "expected to get not found error")
+	})
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	wg := sync.WaitGroup{}
+	for n := 0; n < 50; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i := createIdentity()
+			db.Create(i)
+			db.List()
+			db.Update(i.ID, i)
+			db.Get(i.ID)
+			db.Delete(i.ID, 0)
+		}()
+	}
+	wg.Wait()
+	l, _ := db.List()
+	assert.Equal(t, 0, len(l), "expected all identities to be deleted")
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) server.Store {
+		db := initDB(t)
+		t.Cleanup(func() { closeDB(t, db) })
+		return db
+	})
+}
+
+func initDB(t *testing.T) *Store {
+	t.Helper()
+	s := Store{}
+	if err := s.Init(); err != nil {
+		assert.FailNow(t, "store was not initialized. ", err)
+	}
+	return &s
+}
+
+func closeDB(t *testing.T, db *Store) {
+	t.Helper()
+	if err := db.Close(); err != nil {
+		assert.FailNow(t, "store was not closed. ", err)
+	}
+}
+
+func createIdentity() model.Identity {
+	time := time.Now()
+	return model.Identity{
+		ID: uuid.NewV4().String(),
+		RecoveryAddresses: []model.RecoveryAddress{
+			{Address: model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String() + "@example.com", Via: "email"}},
+		},
+		SchemaID:  "default",
+		SchemaURL: "1.com",
+		Version:   1,
+		VerifiableAddresses: []model.VerifiableAddress{
+			{
+				Address:    model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String() + "@example.com", Via: "email"},
+				Verified:   true,
+				VerifiedAt: &time,
+			},
+		},
+	}
+}
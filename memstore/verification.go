@@ -0,0 +1,53 @@
+package memstore
+
+import (
+	"errors"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// ErrCodeNotFound is returned when address has no pending verification code
+var ErrCodeNotFound = errors.New("verification code not found")
+
+// SaveVerificationCode inserts or replaces verification code of the address
+func (s *Store) SaveVerificationCode(v model.VerificationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.codes == nil {
+		s.codes = map[string]model.VerificationCode{}
+	}
+	s.codes[v.AddressID] = v
+	return nil
+}
+
+// GetVerificationCode returns pending verification code of the address
+func (s *Store) GetVerificationCode(addressID string) (model.VerificationCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.codes[addressID]
+	if !ok {
+		return v, ErrCodeNotFound
+	}
+	return v, nil
+}
+
+// IncrementVerificationAttempts counts an attempt to use verification code of the address and returns the code
+func (s *Store) IncrementVerificationAttempts(addressID string) (model.VerificationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.codes[addressID]
+	if !ok {
+		return v, ErrCodeNotFound
+	}
+	v.Attempts++
+	s.codes[addressID] = v
+	return v, nil
+}
+
+// DeleteVerificationCode deletes verification code of the address if any
+func (s *Store) DeleteVerificationCode(addressID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.codes, addressID)
+	return nil
+}
@@ -0,0 +1,146 @@
+package model
+
+import "time"
+
+// Credential types
+const (
+	CredentialsPassword = "password"
+	CredentialsTOTP     = "totp"
+)
+
+// Credentials are secrets of a single type an identity authenticates with.
+// Identifiers are unique per type across all identities, config holds hashed secrets
+type Credentials struct {
+	IdentityID  string     `json:"identity_id" db:"identity_id" bson:"identity_id"`
+	Type        string     `json:"type" db:"type" bson:"type"`
+	Identifiers []string   `json:"identifiers" db:"-" bson:"identifiers"`
+	Config      JSONObject `json:"config" db:"config" bson:"config"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at" bson:"updated_at"`
+}
+
+// PasswordConfigKey is a key of password hash in password credentials config
+const PasswordConfigKey = "hashed_password"
+
+// HashedPassword returns password hash stored in password credentials config
+func (c Credentials) HashedPassword() string {
+	v, _ := c.Config[PasswordConfigKey].(string)
+	return v
+}
+
+// PasswordRequest sets password credentials of an identity
+type PasswordRequest struct {
+	Identifiers []string `json:"identifiers"`
+	Password    string   `json:"password"`
+}
+
+// PasswordResetRequest sets a new password of the identity of a privileged session keeping its identifiers
+type PasswordResetRequest struct {
+	Password string `json:"password"`
+}
+
+// Keys of totp credentials config. Pending secret awaits confirmation by its first code,
+// pending session is the only session allowed to confirm a secret started by a recovery code,
+// recovery codes are stored as hashes and removed once used. Attempts count second factor attempts since
+// the last accepted code within the window which started at attempts since, stored in unix milliseconds
+const (
+	TOTPSecretKey         = "secret"
+	TOTPPendingSecretKey  = "pending_secret"
+	TOTPPendingSessionKey = "pending_session"
+	TOTPLastStepKey       = "last_step"
+	TOTPRecoveryCodesKey  = "recovery_codes"
+	TOTPAttemptsKey       = "attempts"
+	TOTPAttemptsSinceKey  = "attempts_since"
+)
+
+// TOTPSecret returns confirmed secret stored in totp credentials config
+func (c Credentials) TOTPSecret() string {
+	v, _ := c.Config[TOTPSecretKey].(string)
+	return v
+}
+
+// TOTPPendingSecret returns not yet confirmed secret stored in totp credentials config
+func (c Credentials) TOTPPendingSecret() string {
+	v, _ := c.Config[TOTPPendingSecretKey].(string)
+	return v
+}
+
+// TOTPPendingSession returns id of the session which started pending secret by a recovery code
+func (c Credentials) TOTPPendingSession() string {
+	v, _ := c.Config[TOTPPendingSessionKey].(string)
+	return v
+}
+
+// TOTPLastStep returns the period number of the last accepted totp code
+func (c Credentials) TOTPLastStep() int64 {
+	return c.configInt(TOTPLastStepKey)
+}
+
+// TOTPAttempts returns the number of second factor attempts counted in the current window
+func (c Credentials) TOTPAttempts() int64 {
+	return c.configInt(TOTPAttemptsKey)
+}
+
+// TOTPAttemptsSince returns unix milliseconds when the window counting second factor attempts started
+func (c Credentials) TOTPAttemptsSince() int64 {
+	return c.configInt(TOTPAttemptsSinceKey)
+}
+
+// UnixMillis returns t in unix milliseconds as totp attempts since is stored
+func UnixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// configInt returns config number as decoded by any store
+func (c Credentials) configInt(key string) int64 {
+	switch v := c.Config[key].(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	}
+	return 0
+}
+
+// TOTPRecoveryCodes returns hashes of unused recovery codes stored in totp credentials config
+func (c Credentials) TOTPRecoveryCodes() []string {
+	switch v := c.Config[TOTPRecoveryCodesKey].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, h := range v {
+			if s, ok := h.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// TOTPEnrollment is a generated totp secret awaiting confirmation
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// TOTPStartRequest starts totp enrollment. Recovery code allows sessions without a second factor
+// to replace enabled totp, e.g. after a lost device
+type TOTPStartRequest struct {
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// TOTPConfirmRequest confirms pending totp secret by its current code
+type TOTPConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+// TOTPRecoveryCodes are single-use codes accepted instead of totp codes. They are returned to the client only once
+type TOTPRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
@@ -0,0 +1,21 @@
+package model
+
+// Health statuses
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthStatus is a result of health check
+type HealthStatus struct {
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"`
+	Migrations *MigrationStatus `json:"migrations,omitempty"`
+}
+
+// MigrationStatus describes schema version of a store with versioned schema
+type MigrationStatus struct {
+	Current int64   `json:"current"`
+	Latest  int64   `json:"latest"`
+	Pending []int64 `json:"pending"`
+}
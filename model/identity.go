@@ -6,9 +6,11 @@ import (
 
 //Address describes a base address model
 type Address struct {
-	ID    string `json:"id" db:"id" bson:"id"`
-	Value string `json:"value" db:"value" bson:"value"`
-	Via   string `json:"via" db:"via" bson:"via"`
+	ID        string    `json:"id" db:"id" bson:"id"`
+	Value     string    `json:"value" db:"value" bson:"value"`
+	Via       string    `json:"via" db:"via" bson:"via"`
+	CreatedAt time.Time `json:"created_at" db:"created_at" bson:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at" bson:"updated_at"`
 }
 
 //RecoveryAddress is a recovery address model
@@ -32,5 +34,73 @@ type Identity struct {
 	RecoveryAddresses   []RecoveryAddress   `json:"recovery_addresses" bson:"recovery_addresses,omitempty"`
 	SchemaID            string              `json:"schema_id" db:"schema_id" bson:"schema_id"`
 	SchemaURL           string              `json:"schema_url" db:"schema_url" bson:"schema_url"`
+	Traits              JSONObject          `json:"traits" db:"traits" bson:"traits,omitempty"`
+	MetadataPublic      JSONObject          `json:"metadata_public" db:"metadata_public" bson:"metadata_public,omitempty"`
+	MetadataAdmin       JSONObject          `json:"metadata_admin,omitempty" db:"metadata_admin" bson:"metadata_admin,omitempty"`
 	VerifiableAddresses []VerifiableAddress `json:"verifiable_addresses" bson:"verifiable_address,omitempty"`
+	Version             int64               `json:"version" db:"version" bson:"version"`
+	CreatedAt           time.Time           `json:"created_at" db:"created_at" bson:"created_at"`
+	UpdatedAt           time.Time           `json:"updated_at" db:"updated_at" bson:"updated_at"`
+	// Credentials by type are filled by Store.Get only and are never serialized
+	Credentials map[string]Credentials `json:"-" db:"-" bson:"-"`
+}
+
+// Touch sets creation and update times of identity and its addresses saved at the given time.
+// Creation times are kept from the previous identity state and its addresses with the same id,
+// update times are kept for not changed addresses. Previous is nil for a new identity.
+// Times are truncated to milliseconds, the precision shared by all stores.
+// Address lists are copied, so the caller's slices are not changed
+func (i *Identity) Touch(previous *Identity, now time.Time) {
+	now = now.UTC().Truncate(time.Millisecond)
+	if i.RecoveryAddresses != nil {
+		i.RecoveryAddresses = append([]RecoveryAddress{}, i.RecoveryAddresses...)
+	}
+	if i.VerifiableAddresses != nil {
+		i.VerifiableAddresses = append([]VerifiableAddress{}, i.VerifiableAddresses...)
+	}
+	i.CreatedAt, i.UpdatedAt = now, now
+	recovery := map[string]RecoveryAddress{}
+	verifiable := map[string]VerifiableAddress{}
+	if previous != nil {
+		i.CreatedAt = previous.CreatedAt
+		for _, a := range previous.RecoveryAddresses {
+			recovery[a.ID] = a
+		}
+		for _, a := range previous.VerifiableAddresses {
+			verifiable[a.ID] = a
+		}
+	}
+	for n := range i.RecoveryAddresses {
+		a := &i.RecoveryAddresses[n]
+		p, ok := recovery[a.ID]
+		a.touch(p.Address, ok && a.sameAs(p.Address), now)
+	}
+	for n := range i.VerifiableAddresses {
+		a := &i.VerifiableAddresses[n]
+		p, ok := verifiable[a.ID]
+		a.touch(p.Address, ok && a.sameAs(p.Address) && a.Verified == p.Verified &&
+			sameTime(a.VerifiedAt, p.VerifiedAt) && sameTime(a.ExpiresAt, p.ExpiresAt), now)
+	}
+}
+
+func (a *Address) touch(previous Address, unchanged bool, now time.Time) {
+	a.CreatedAt, a.UpdatedAt = now, now
+	if previous.ID == "" {
+		return
+	}
+	a.CreatedAt = previous.CreatedAt
+	if unchanged {
+		a.UpdatedAt = previous.UpdatedAt
+	}
+}
+
+func (a Address) sameAs(b Address) bool {
+	return a.ID == b.ID && a.Value == b.Value && a.Via == b.Via
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
 }
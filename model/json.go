@@ -0,0 +1,79 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// JSONObject is an arbitrary JSON object stored as JSONB in postgres and as a subdocument in mongo
+type JSONObject map[string]interface{}
+
+// Value implements driver.Valuer. Nil object is stored as an empty one
+func (o JSONObject) Value() (driver.Value, error) {
+	if o == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(o)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner
+func (o *JSONObject) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*o = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("could not scan %T into json object", src)
+	}
+	return json.Unmarshal(b, o)
+}
+
+// MarshalBSONValue implements bson.ValueMarshaler keeping JSON types of values
+func (o JSONObject) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return 0, nil, err
+	}
+	var doc bson.D
+	if err = bson.UnmarshalExtJSON(b, false, &doc); err != nil {
+		return 0, nil, err
+	}
+	return bson.MarshalValue(doc)
+}
+
+// UnmarshalBSONValue implements bson.ValueUnmarshaler
+func (o *JSONObject) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bsontype.Null || t == bsontype.Undefined {
+		*o = nil
+		return nil
+	}
+	if t != bsontype.EmbeddedDocument {
+		return fmt.Errorf("could not decode bson %s into json object", t)
+	}
+	b, err := bson.MarshalExtJSON(bson.Raw(data), false, false)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, o)
+}
+
+// Copy returns a deep copy of the object
+func (o JSONObject) Copy() JSONObject {
+	if o == nil {
+		return nil
+	}
+	b, _ := json.Marshal(o)
+	var c JSONObject
+	json.Unmarshal(b, &c)
+	return c
+}
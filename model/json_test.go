@@ -0,0 +1,41 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestJSONObject(t *testing.T) {
+	o := JSONObject{"email": "a@example.com", "age": float64(42), "name": map[string]interface{}{"first": "A"}, "tags": []interface{}{"x"}}
+
+	t.Run("should round trip sql value", func(t *testing.T) {
+		v, err := o.Value()
+		require.NoError(t, err)
+		var scanned JSONObject
+		require.NoError(t, scanned.Scan([]byte(v.(string))))
+		assert.Equal(t, o, scanned)
+		v, _ = JSONObject(nil).Value()
+		assert.Equal(t, "{}", v)
+	})
+	t.Run("should round trip bson subdocument", func(t *testing.T) {
+		b, err := bson.Marshal(struct {
+			Traits JSONObject `bson:"traits"`
+		}{o})
+		require.NoError(t, err)
+		raw := bson.Raw(b)
+		assert.Equal(t, "A", raw.Lookup("traits", "name", "first").StringValue(), "expected traits to be stored as subdocument")
+		decoded := struct {
+			Traits JSONObject `bson:"traits"`
+		}{}
+		require.NoError(t, bson.Unmarshal(b, &decoded))
+		assert.Equal(t, o, decoded.Traits)
+	})
+	t.Run("should deep copy", func(t *testing.T) {
+		c := o.Copy()
+		c["name"].(map[string]interface{})["first"] = "B"
+		assert.Equal(t, "A", o["name"].(map[string]interface{})["first"])
+	})
+}
@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// Message delivery statuses
+const (
+	// MessageQueued is a message waiting for the first or next delivery attempt
+	MessageQueued = "queued"
+	// MessageSending is a message claimed by a courier for a delivery attempt
+	MessageSending = "sending"
+	// MessageSent is a message accepted by its sender
+	MessageSent = "sent"
+	// MessageFailed is a message abandoned after max delivery attempts
+	MessageFailed = "failed"
+)
+
+// Message is a rendered message queued for delivery to an identity address.
+// The body may contain secrets, so it is never exposed by API and is cleared once the message is sent or abandoned
+type Message struct {
+	ID         string    `json:"id" db:"id" bson:"id"`
+	Via        string    `json:"via" db:"via" bson:"via"`
+	Recipient  string    `json:"recipient" db:"recipient" bson:"recipient"`
+	IdentityID string    `json:"identity_id" db:"identity_id" bson:"identity_id"`
+	Template   string    `json:"template" db:"template" bson:"template"`
+	Subject    string    `json:"subject" db:"subject" bson:"subject"`
+	Body       string    `json:"-" db:"body" bson:"body"`
+	Status     string    `json:"status" db:"status" bson:"status"`
+	Attempts   int       `json:"attempts" db:"attempts" bson:"attempts"`
+	LastError  string    `json:"last_error,omitempty" db:"last_error" bson:"last_error"`
+	SendAfter  time.Time `json:"send_after" db:"send_after" bson:"send_after"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at" bson:"updated_at"`
+}
@@ -0,0 +1,63 @@
+package model
+
+//IdentityQuery describes a page of identities ordered by id.
+//Address, Via and Verified filters must be matched by the same address of an identity.
+//Recovery addresses are taken into account only when Verified filter is not set
+type IdentityQuery struct {
+	After    string
+	Limit    int
+	Address  string
+	Via      string
+	Verified *bool
+	SchemaID string
+}
+
+//MessageQuery describes up to Limit newest messages matching all not empty filters
+type MessageQuery struct {
+	Limit      int
+	Recipient  string
+	Via        string
+	IdentityID string
+	Status     string
+}
+
+//MatchMessage returns whether message satisfies query filters. Limit is ignored
+func (q MessageQuery) MatchMessage(m Message) bool {
+	return (q.Recipient == "" || m.Recipient == q.Recipient) &&
+		(q.Via == "" || m.Via == q.Via) &&
+		(q.IdentityID == "" || m.IdentityID == q.IdentityID) &&
+		(q.Status == "" || m.Status == q.Status)
+}
+
+//HasAddressFilter returns whether query filters identities by their addresses
+func (q IdentityQuery) HasAddressFilter() bool {
+	return q.Address != "" || q.Via != "" || q.Verified != nil
+}
+
+//MatchIdentity returns whether identity satisfies query filters. Paging fields are ignored
+func (q IdentityQuery) MatchIdentity(i Identity) bool {
+	if q.SchemaID != "" && i.SchemaID != q.SchemaID {
+		return false
+	}
+	if !q.HasAddressFilter() {
+		return true
+	}
+	for _, a := range i.VerifiableAddresses {
+		if q.matchAddress(a.Address) && (q.Verified == nil || *q.Verified == a.Verified) {
+			return true
+		}
+	}
+	if q.Verified != nil {
+		return false
+	}
+	for _, a := range i.RecoveryAddresses {
+		if q.matchAddress(a.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q IdentityQuery) matchAddress(a Address) bool {
+	return (q.Address == "" || a.Value == q.Address) && (q.Via == "" || a.Via == q.Via)
+}
@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// RecoveryToken is a single-use token issued to a recovery address. Only a hash of the token is stored
+type RecoveryToken struct {
+	TokenHash  string    `json:"-" db:"token_hash" bson:"token_hash"`
+	IdentityID string    `json:"identity_id" db:"identity_id" bson:"identity_id"`
+	AddressID  string    `json:"address_id" db:"address_id" bson:"address_id"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at" bson:"expires_at"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at" bson:"created_at"`
+}
+
+// Expired returns whether the token can't be used at the given time
+func (t RecoveryToken) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+// RecoveryRequest requests a recovery token sent to a recovery address
+type RecoveryRequest struct {
+	Address string `json:"address"`
+	Via     string `json:"via"`
+}
+
+// RecoveryCompleteRequest redeems a recovery token
+type RecoveryCompleteRequest struct {
+	Token string `json:"token"`
+}
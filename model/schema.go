@@ -0,0 +1,27 @@
+package model
+
+import (
+	// embed is required for go:embed directive
+	_ "embed"
+	"encoding/json"
+)
+
+// DefaultSchemaID is an id of the identity schema used when identity has no schema_id
+const DefaultSchemaID = "default"
+
+// DefaultIdentitySchema is a JSON schema of identities with default schema id
+//
+//go:embed schema.json
+var DefaultIdentitySchema []byte
+
+// IdentitySchema is a JSON schema identities reference by schema_id
+type IdentitySchema struct {
+	ID     string          `json:"id" db:"id"`
+	Schema json.RawMessage `json:"schema" db:"schema"`
+}
+
+// IdentitySchemaRef describes where a registered identity schema can be fetched from
+type IdentitySchemaRef struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
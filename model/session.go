@@ -0,0 +1,50 @@
+package model
+
+import "time"
+
+// Authenticator assurance levels of sessions
+const (
+	// AAL1 is reached by a single factor such as password or recovery
+	AAL1 = "aal1"
+	// AAL2 is reached by a password followed by a second factor such as totp
+	AAL2 = "aal2"
+)
+
+// Session is an authenticated session of an identity. Only a hash of the session token is stored
+type Session struct {
+	ID         string    `json:"id" db:"id" bson:"id"`
+	TokenHash  string    `json:"-" db:"token_hash" bson:"token_hash"`
+	IdentityID string    `json:"identity_id" db:"identity_id" bson:"identity_id"`
+	Privileged bool      `json:"privileged" db:"privileged" bson:"privileged"`
+	AAL        string    `json:"aal" db:"aal" bson:"aal"`
+	IP         string    `json:"ip" db:"ip" bson:"ip"`
+	UserAgent  string    `json:"user_agent" db:"user_agent" bson:"user_agent"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at" bson:"expires_at"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at" bson:"created_at"`
+}
+
+// Expired returns whether the session can't be used at the given time
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// SessionToken is an issued session with its token which is returned to the client only once
+type SessionToken struct {
+	Token   string  `json:"session_token"`
+	Session Session `json:"session"`
+}
+
+// SessionInfo is a session resolved to its identity
+type SessionInfo struct {
+	Session  Session  `json:"session"`
+	Identity Identity `json:"identity"`
+}
+
+// LoginRequest authenticates identity by password credentials.
+// Identities with totp credentials also provide either a totp code or an unused recovery code
+type LoginRequest struct {
+	Identifier   string `json:"identifier"`
+	Password     string `json:"password"`
+	TOTPCode     string `json:"totp_code"`
+	RecoveryCode string `json:"recovery_code"`
+}
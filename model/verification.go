@@ -0,0 +1,30 @@
+package model
+
+import "time"
+
+// VerificationCode is a pending verification of an address. Only a hash of the code is stored
+type VerificationCode struct {
+	AddressID  string    `json:"address_id" db:"address_id" bson:"address_id"`
+	IdentityID string    `json:"identity_id" db:"identity_id" bson:"identity_id"`
+	CodeHash   string    `json:"-" db:"code_hash" bson:"code_hash"`
+	Attempts   int       `json:"attempts" db:"attempts" bson:"attempts"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at" bson:"expires_at"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at" bson:"created_at"`
+}
+
+// Expired returns whether the code can't be used at the given time
+func (v VerificationCode) Expired(now time.Time) bool {
+	return !now.Before(v.ExpiresAt)
+}
+
+// VerificationRequest starts verification of an address
+type VerificationRequest struct {
+	Address string `json:"address"`
+	Via     string `json:"via"`
+}
+
+// VerificationCompleteRequest completes verification of an address with a code sent to it
+type VerificationCompleteRequest struct {
+	VerificationRequest
+	Code string `json:"code"`
+}
@@ -0,0 +1,152 @@
+package mongostore
+
+import (
+	"context"
+	"time"
+
+	"github.com/trapck/kr.api/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PutCredentials inserts or replaces identity credentials of c.Type
+func (s *Store) PutCredentials(c model.Credentials) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	cnt, err := s.identity.CountDocuments(ctx, idFilter(c.IdentityID))
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return mongo.ErrNoDocuments
+	}
+	if c.Identifiers == nil {
+		c.Identifiers = []string{}
+	}
+	_, err = s.cred.ReplaceOne(
+		ctx,
+		bson.M{"identity_id": c.IdentityID, "type": c.Type},
+		c,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// FindCredentials returns credentials of the type having the identifier
+func (s *Store) FindCredentials(credType, identifier string) (model.Credentials, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var c model.Credentials
+	err := s.cred.FindOne(ctx, bson.M{"type": credType, "identifiers": identifier}).Decode(&c)
+	return c, err
+}
+
+// MergeCredentialsConfig sets and deletes keys of identity credentials config of the type keeping its other keys
+func (s *Store) MergeCredentialsConfig(identityID, credType string, set model.JSONObject, unset []string, updatedAt time.Time) error {
+	fields := bson.M{"updated_at": updatedAt}
+	for k, v := range set {
+		fields["config."+k] = v
+	}
+	update := bson.M{"$set": fields}
+	if len(unset) > 0 {
+		removed := bson.M{}
+		for _, k := range unset {
+			removed["config."+k] = ""
+		}
+		update["$unset"] = removed
+	}
+	return s.updateCredentials(credentialsFilter(identityID, credType), update)
+}
+
+// IncrementTOTPAttempts atomically counts a second factor attempt and returns totp credentials of the identity.
+// The count restarts at now when its window started at or before windowStart. Either update is atomic, so they are
+// retried once when another attempt restarted the window between them
+func (s *Store) IncrementTOTPAttempts(identityID string, now, windowStart time.Time) (model.Credentials, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	since := "config." + model.TOTPAttemptsSinceKey
+	current := credentialsFilter(identityID, model.CredentialsTOTP)
+	current[since] = bson.M{"$gt": model.UnixMillis(windowStart)}
+	expired := credentialsFilter(identityID, model.CredentialsTOTP)
+	expired["$or"] = bson.A{bson.M{since: bson.M{"$lte": model.UnixMillis(windowStart)}}, bson.M{since: bson.M{"$exists": false}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var c model.Credentials
+	var err error
+	for n := 0; n < 2; n++ {
+		err = s.cred.FindOneAndUpdate(
+			ctx, current, bson.M{"$inc": bson.M{"config." + model.TOTPAttemptsKey: int64(1)}}, opts,
+		).Decode(&c)
+		if err != mongo.ErrNoDocuments {
+			return c, err
+		}
+		err = s.cred.FindOneAndUpdate(
+			ctx, expired, bson.M{"$set": bson.M{"config." + model.TOTPAttemptsKey: int64(1), since: model.UnixMillis(now)}}, opts,
+		).Decode(&c)
+		if err != mongo.ErrNoDocuments {
+			return c, err
+		}
+	}
+	return c, err
+}
+
+// ConsumeTOTPStep atomically sets the last accepted totp step of the identity and resets counted attempts.
+// It fails with mongo.ErrNoDocuments unless the stored step is before step
+func (s *Store) ConsumeTOTPStep(identityID string, step int64, updatedAt time.Time) error {
+	last := "config." + model.TOTPLastStepKey
+	filter := credentialsFilter(identityID, model.CredentialsTOTP)
+	filter["$or"] = bson.A{bson.M{last: bson.M{"$lt": step}}, bson.M{last: bson.M{"$exists": false}}}
+	return s.updateCredentials(filter, bson.M{"$set": bson.M{
+		last:                              step,
+		"config." + model.TOTPAttemptsKey: int64(0),
+		"updated_at":                      updatedAt,
+	}})
+}
+
+// UseTOTPRecoveryCode atomically removes the recovery code hash from totp credentials of the identity and resets
+// counted attempts. It fails with mongo.ErrNoDocuments when the hash is not stored
+func (s *Store) UseTOTPRecoveryCode(identityID, hash string, updatedAt time.Time) error {
+	codes := "config." + model.TOTPRecoveryCodesKey
+	filter := credentialsFilter(identityID, model.CredentialsTOTP)
+	filter[codes] = hash
+	return s.updateCredentials(filter, bson.M{
+		"$pull": bson.M{codes: hash},
+		"$set":  bson.M{"config." + model.TOTPAttemptsKey: int64(0), "updated_at": updatedAt},
+	})
+}
+
+// updateCredentials updates credentials matching the filter, reporting mongo.ErrNoDocuments when there are none
+func (s *Store) updateCredentials(filter, update bson.M) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	r, err := s.cred.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if r.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func credentialsFilter(identityID, credType string) bson.M {
+	return bson.M{"identity_id": identityID, "type": credType}
+}
+
+// identityCredentials returns all identity credentials by type or nil when there are none
+func (s *Store) identityCredentials(ctx context.Context, id string) (map[string]model.Credentials, error) {
+	cur, err := s.cred.Find(ctx, bson.M{"identity_id": id})
+	if err != nil {
+		return nil, err
+	}
+	l := []model.Credentials{}
+	if err = cur.All(ctx, &l); err != nil || len(l) == 0 {
+		return nil, err
+	}
+	res := map[string]model.Credentials{}
+	for _, c := range l {
+		res[c.Type] = c
+	}
+	return res, nil
+}
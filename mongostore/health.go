@@ -0,0 +1,8 @@
+package mongostore
+
+import "context"
+
+// Ping checks that the primary node is reachable
+func (s *Store) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
@@ -0,0 +1,93 @@
+package mongostore
+
+import (
+	"time"
+
+	"github.com/trapck/kr.api/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnqueueMessage inserts message
+func (s *Store) EnqueueMessage(m model.Message) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.message.InsertOne(ctx, m)
+	return err
+}
+
+// ClaimMessages marks up to limit due messages as sending and returns them ordered by send time.
+// Due messages are queued ones which should be sent not later than now and sending ones not updated since reclaimBefore.
+// Messages are claimed one by one with atomic updates, so every message is claimed once
+func (s *Store) ClaimMessages(now, reclaimBefore time.Time, limit int) ([]model.Message, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": model.MessageQueued, "send_after": bson.M{"$lte": now}},
+		bson.M{"status": model.MessageSending, "updated_at": bson.M{"$lt": reclaimBefore}},
+	}}
+	update := bson.M{"$set": bson.M{"status": model.MessageSending, "updated_at": now}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "send_after", Value: 1}, {Key: "id", Value: 1}}).
+		SetReturnDocument(options.After)
+	l := []model.Message{}
+	for len(l) < limit {
+		var m model.Message
+		err := s.message.FindOneAndUpdate(ctx, filter, update, opts).Decode(&m)
+		if err == mongo.ErrNoDocuments {
+			break
+		} else if err != nil {
+			return l, err
+		}
+		l = append(l, m)
+	}
+	return l, nil
+}
+
+// UpdateMessage replaces message with the same id
+func (s *Store) UpdateMessage(m model.Message) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	r, err := s.message.ReplaceOne(ctx, idFilter(m.ID), m)
+	if err != nil {
+		return err
+	}
+	if r.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// ListMessages returns up to q.Limit messages matching q filters ordered from the newest
+func (s *Store) ListMessages(q model.MessageQuery) ([]model.Message, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	filter := bson.M{}
+	for k, v := range map[string]string{"recipient": q.Recipient, "via": q.Via, "identity_id": q.IdentityID, "status": q.Status} {
+		if v != "" {
+			filter[k] = v
+		}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "id", Value: -1}}).SetLimit(int64(q.Limit))
+	cur, err := s.message.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	l := []model.Message{}
+	if err = cur.All(ctx, &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetMessage returns message by id
+func (s *Store) GetMessage(id string) (model.Message, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var m model.Message
+	err := s.message.FindOne(ctx, idFilter(id)).Decode(&m)
+	return m, err
+}
@@ -0,0 +1,50 @@
+package mongostore
+
+import (
+	"github.com/trapck/kr.api/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SaveRecoveryToken inserts recovery token
+func (s *Store) SaveRecoveryToken(t model.RecoveryToken) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.token.InsertOne(ctx, t)
+	return err
+}
+
+// GetLatestRecoveryToken returns the most recently created recovery token of the identity
+func (s *Store) GetLatestRecoveryToken(identityID string) (model.RecoveryToken, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var t model.RecoveryToken
+	err := s.token.FindOne(
+		ctx,
+		bson.M{"identity_id": identityID},
+		options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	).Decode(&t)
+	return t, err
+}
+
+// UseRecoveryToken deletes recovery token and returns it, so every token can be used once
+func (s *Store) UseRecoveryToken(tokenHash string) (model.RecoveryToken, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var t model.RecoveryToken
+	err := s.token.FindOneAndDelete(ctx, tokenHashFilter(tokenHash)).Decode(&t)
+	return t, err
+}
+
+// DeleteRecoveryTokens deletes all recovery tokens of the identity
+func (s *Store) DeleteRecoveryTokens(identityID string) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.token.DeleteMany(ctx, bson.M{"identity_id": identityID})
+	return err
+}
+
+func tokenHashFilter(hash string) bson.M {
+	return bson.M{"token_hash": hash}
+}
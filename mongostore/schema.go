@@ -0,0 +1,63 @@
+package mongostore
+
+import (
+	"encoding/json"
+
+	"github.com/trapck/kr.api/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// schemaDocument is a stored identity schema. The schema is kept as a string
+// because JSON schema keywords like $ref and $id are not welcome in mongo field names
+type schemaDocument struct {
+	ID     string `bson:"id"`
+	Schema string `bson:"schema"`
+}
+
+// ListSchemas returns all stored identity schemas ordered by id
+func (s *Store) ListSchemas() ([]model.IdentitySchema, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	cur, err := s.schema.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	res := []model.IdentitySchema{}
+	for cur.Next(ctx) {
+		var d schemaDocument
+		if err = cur.Decode(&d); err != nil {
+			return nil, err
+		}
+		res = append(res, d.toSchema())
+	}
+	return res, cur.Err()
+}
+
+// GetSchema returns identity schema by id
+func (s *Store) GetSchema(id string) (model.IdentitySchema, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var d schemaDocument
+	err := s.schema.FindOne(ctx, idFilter(id)).Decode(&d)
+	return d.toSchema(), err
+}
+
+// PutSchema inserts or replaces identity schema
+func (s *Store) PutSchema(schema model.IdentitySchema) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	d := schemaDocument{ID: schema.ID, Schema: string(schema.Schema)}
+	_, err := s.schema.ReplaceOne(ctx, idFilter(schema.ID), d, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (d schemaDocument) toSchema() model.IdentitySchema {
+	s := model.IdentitySchema{ID: d.ID}
+	if d.Schema != "" {
+		s.Schema = json.RawMessage(d.Schema)
+	}
+	return s
+}
@@ -0,0 +1,39 @@
+package mongostore
+
+import (
+	"github.com/trapck/kr.api/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// CreateSession inserts session
+func (s *Store) CreateSession(v model.Session) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.session.InsertOne(ctx, v)
+	return err
+}
+
+// GetSession returns session by hash of its token
+func (s *Store) GetSession(tokenHash string) (model.Session, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var v model.Session
+	err := s.session.FindOne(ctx, tokenHashFilter(tokenHash)).Decode(&v)
+	return v, err
+}
+
+// DeleteSession deletes session by hash of its token if any
+func (s *Store) DeleteSession(tokenHash string) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.session.DeleteOne(ctx, tokenHashFilter(tokenHash))
+	return err
+}
+
+// DeleteOtherSessions deletes all sessions of the identity except the one with the token hash
+func (s *Store) DeleteOtherSessions(identityID, exceptTokenHash string) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.session.DeleteMany(ctx, bson.M{"identity_id": identityID, "token_hash": bson.M{"$ne": exceptTokenHash}})
+	return err
+}
@@ -2,6 +2,7 @@ package mongostore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,18 +14,50 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Identity document field names
+const (
+	verifiableAddressesField = "verifiable_address"
+	recoveryAddressesField   = "recovery_addresses"
+)
+
+// ErrVersionMismatch is returned when identity is changed with outdated version
+var ErrVersionMismatch = errors.New("identity version mismatch")
+
+// ErrDuplicateAddress is returned when identity has the same address twice, which unique multikey indexes don't prevent
+var ErrDuplicateAddress = errors.New("identity has duplicate address")
+
+// maxUpdateAttempts limits retries of unconditional update racing with other writers
+const maxUpdateAttempts = 3
+
+// duplicateKeyCode is mongodb error code of unique index violation
+const duplicateKeyCode = 11000
+
+// Error codes of dropping an index which doesn't exist
+const (
+	namespaceNotFoundCode = 26
+	indexNotFoundCode     = 27
+)
+
 //Store is mongodb storage implementation
 type Store struct {
 	client   *mongo.Client
 	db       *mongo.Database
 	identity *mongo.Collection
+	schema   *mongo.Collection
+	code     *mongo.Collection
+	token    *mongo.Collection
+	session  *mongo.Collection
+	message  *mongo.Collection
+	cred     *mongo.Collection
+	timeout  time.Duration
 }
 
 // Init initializes connetion
-func (s *Store) Init() error {
-	ctx, cancel := ctx()
+func (s *Store) Init(cfg appconfig.MongoConfig) error {
+	s.timeout = cfg.Timeout.Duration
+	ctx, cancel := s.ctx()
 	defer cancel()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(appconfig.MongoHost))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.Host))
 	if err != nil {
 		return fmt.Errorf("Unable to connect to mongodb: %+v", err)
 	}
@@ -34,7 +67,7 @@ func (s *Store) Init() error {
 		return fmt.Errorf("Mongo ping failed: %+v", err)
 	}
 	s.client = client
-	s.db = client.Database(appconfig.MongoDBName)
+	s.db = client.Database(cfg.DBName)
 	err = s.initDocuments(ctx)
 	if err != nil {
 		client.Disconnect(ctx)
@@ -45,16 +78,29 @@ func (s *Store) Init() error {
 
 // Close closes connetion
 func (s *Store) Close() error {
-	ctx, cancel := ctx()
+	ctx, cancel := s.ctx()
 	defer cancel()
 	return s.client.Disconnect(ctx)
 }
 
 // List returns all identities
 func (s *Store) List() ([]model.Identity, error) {
-	ctx, cancel := ctx()
+	return s.find(bson.D{})
+}
+
+// ListPage returns up to q.Limit identities matching q filters with id greater than q.After ordered by id
+func (s *Store) ListPage(q model.IdentityQuery) ([]model.Identity, error) {
+	filter := queryFilter(q)
+	if q.After != "" {
+		filter["id"] = bson.M{"$gt": q.After}
+	}
+	return s.find(filter, options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetLimit(int64(q.Limit)))
+}
+
+func (s *Store) find(filter interface{}, opts ...*options.FindOptions) ([]model.Identity, error) {
+	ctx, cancel := s.ctx()
 	defer cancel()
-	cur, err := s.identity.Find(ctx, bson.D{})
+	cur, err := s.identity.Find(ctx, filter, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -76,64 +122,328 @@ func (s *Store) List() ([]model.Identity, error) {
 
 // Get returns all identities
 func (s *Store) Get(id string) (model.Identity, error) {
-	ctx, cancel := ctx()
+	ctx, cancel := s.ctx()
 	defer cancel()
 	var i model.Identity
 	r := s.identity.FindOne(ctx, idFilter(id))
 	if err := r.Err(); err != nil {
 		return i, err
 	}
-	err := r.Decode(&i)
-
+	if err := r.Decode(&i); err != nil {
+		return i, err
+	}
+	var err error
+	i.Credentials, err = s.identityCredentials(ctx, id)
 	return i, err
 }
 
 // Create inserts identity
 func (s *Store) Create(i model.Identity) (model.Identity, error) {
-	ctx, cancel := ctx()
+	ctx, cancel := s.ctx()
 	defer cancel()
+	if hasDuplicateAddress(i) {
+		return i, ErrDuplicateAddress
+	}
+	i.Version = 1
+	i.Touch(nil, time.Now())
 	_, err := s.identity.InsertOne(ctx, i)
 	return i, err
 }
 
-// Update updates identity
+// Update updates identity. Non zero i.Version must match the stored one
 func (s *Store) Update(id string, i model.Identity) (model.Identity, error) {
-	ctx, cancel := ctx()
+	if hasDuplicateAddress(i) {
+		return i, ErrDuplicateAddress
+	}
+	expected := i.Version
+	for attempt := 0; ; attempt++ {
+		current, err := s.Get(id)
+		if err != nil {
+			return i, err
+		}
+		if expected != 0 && expected != current.Version {
+			return i, ErrVersionMismatch
+		}
+		i.Version = current.Version
+		i.Touch(&current, time.Now())
+		u, err := s.replace(id, i)
+		if err == ErrVersionMismatch && expected == 0 && attempt < maxUpdateAttempts {
+			continue
+		}
+		return u, err
+	}
+}
+
+func (s *Store) replace(id string, i model.Identity) (model.Identity, error) {
+	ctx, cancel := s.ctx()
 	defer cancel()
-	r, err := s.identity.ReplaceOne(ctx, idFilter(id), i)
+	filter := versionFilter(id, i.Version)
+	i.Version++
+	r, err := s.identity.ReplaceOne(ctx, filter, i)
 	if err == nil && r.MatchedCount == 0 {
-		err = mongo.ErrNoDocuments
+		err = s.missingOrMismatch(ctx, id)
+	}
+	if err == nil && id != i.ID {
+		err = s.moveIdentityRecords(ctx, id, i.ID)
 	}
 	return i, err
 }
 
-//Delete deletes identity
-func (s *Store) Delete(id string) error {
-	ctx, cancel := ctx()
+// identityCollections hold records of identities which follow identity id changes and deletion.
+// Records are moved and deleted collection by collection after the identity document is written, without a transaction,
+// since transactions need a replica set. When one of the writes fails the caller gets the error while records of
+// the remaining collections still point to the old id. Delete removes records of a missing identity as well,
+// so retrying it cleans up what was left behind
+func (s *Store) identityCollections() []*mongo.Collection {
+	return []*mongo.Collection{s.cred, s.code, s.token, s.session, s.message}
+}
+
+// moveIdentityRecords points credentials, verification codes, recovery tokens, sessions and messages of identity to its new id
+func (s *Store) moveIdentityRecords(ctx context.Context, from, to string) error {
+	for _, c := range s.identityCollections() {
+		if _, err := c.UpdateMany(ctx, bson.M{"identity_id": from}, bson.M{"$set": bson.M{"identity_id": to}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIdentityRecords deletes credentials, verification codes, recovery tokens, sessions and messages of identity
+func (s *Store) deleteIdentityRecords(ctx context.Context, id string) error {
+	for _, c := range s.identityCollections() {
+		if _, err := c.DeleteMany(ctx, bson.M{"identity_id": id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Delete deletes identity. Non zero version must match the stored one
+func (s *Store) Delete(id string, version int64) error {
+	ctx, cancel := s.ctx()
 	defer cancel()
-	r, err := s.identity.DeleteOne(ctx, idFilter(id))
+	filter := idFilter(id)
+	if version != 0 {
+		filter = versionFilter(id, version)
+	}
+	r, err := s.identity.DeleteOne(ctx, filter)
 	if err == nil && r.DeletedCount == 0 {
-		err = mongo.ErrNoDocuments
+		err = s.missingOrMismatch(ctx, id)
+	}
+	if err == nil || err == mongo.ErrNoDocuments {
+		if rerr := s.deleteIdentityRecords(ctx, id); rerr != nil {
+			return rerr
+		}
 	}
 	return err
 }
 
+// missingOrMismatch explains why identity was not matched by versioned filter
+func (s *Store) missingOrMismatch(ctx context.Context, id string) error {
+	cnt, err := s.identity.CountDocuments(ctx, idFilter(id))
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return ErrVersionMismatch
+}
+
+//VersionMismatch returns whether error is caused by outdated identity version
+func (s *Store) VersionMismatch(e error) bool {
+	return e == ErrVersionMismatch
+}
+
 //NoRows returns whether error is no rows error
 func (s *Store) NoRows(e error) bool {
 	return e == mongo.ErrNoDocuments
 }
 
+//Duplicate returns whether error is caused by already existing identity id or address
+func (s *Store) Duplicate(e error) bool {
+	if e == ErrDuplicateAddress {
+		return true
+	}
+	if we, ok := e.(mongo.WriteException); ok {
+		for _, v := range we.WriteErrors {
+			if v.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *Store) initDocuments(ctx context.Context) error {
 	s.identity = s.db.Collection("identity")
-	_, err := s.identity.Indexes().CreateOne(
+	_, err := s.identity.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			addressIndex(verifiableAddressesField),
+			addressIndex(recoveryAddressesField),
+			{Keys: bson.D{{Key: "schema_id", Value: 1}, {Key: "id", Value: 1}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = s.identity.UpdateMany(ctx, bson.M{"version": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"version": 1}})
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	_, err = s.identity.UpdateMany(
+		ctx,
+		bson.M{"created_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"created_at": now, "updated_at": now}},
+	)
+	if err != nil {
+		return err
+	}
+	s.schema = s.db.Collection("identity_schema")
+	_, err = s.schema.Indexes().CreateOne(
 		ctx,
 		mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
 	)
+	if err != nil {
+		return err
+	}
+	s.code = s.db.Collection("verification_code")
+	_, err = s.code.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "address_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "identity_id", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	s.token = s.db.Collection("recovery_token")
+	_, err = s.token.Indexes().CreateMany(ctx, secretIndexes())
+	if err != nil {
+		return err
+	}
+	s.session = s.db.Collection("session")
+	_, err = s.session.Indexes().CreateMany(ctx, secretIndexes())
+	if err != nil {
+		return err
+	}
+	s.cred = s.db.Collection("identity_credentials")
+	// identifiers index used to cover credentials without identifiers, which made them duplicates of each other
+	_, err = s.cred.Indexes().DropOne(ctx, "type_1_identifiers_1")
+	if ce, ok := err.(mongo.CommandError); err != nil && (!ok || (ce.Code != indexNotFoundCode && ce.Code != namespaceNotFoundCode)) {
+		return err
+	}
+	_, err = s.cred.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "identity_id", Value: 1}, {Key: "type", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{
+				Keys: bson.D{{Key: "type", Value: 1}, {Key: "identifiers", Value: 1}},
+				Options: options.Index().
+					SetName("type_1_identifiers_1_present").
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"identifiers.0": bson.M{"$exists": true}}),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	s.message = s.db.Collection("courier_message")
+	_, err = s.message.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "send_after", Value: 1}, {Key: "id", Value: 1}}},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}}},
+			{Keys: bson.D{{Key: "recipient", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "identity_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		},
+	)
 	return err
 }
 
-func ctx(timeout ...time.Duration) (context.Context, context.CancelFunc) {
-	t := appconfig.MongoDefTimeout
+// secretIndexes makes documents unique by token hash, searchable by identity and removed once expired
+func secretIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "identity_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	}
+}
+
+// addressIndex makes address value unique per via across all identities having addresses of the given field
+func addressIndex(field string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: field + ".value", Value: 1}, {Key: field + ".via", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{field + ".value": bson.M{"$exists": true}}),
+	}
+}
+
+// hasDuplicateAddress returns whether identity has the same address value via the same channel twice
+// among verifiable or among recovery addresses
+func hasDuplicateAddress(i model.Identity) bool {
+	type key struct {
+		verifiable bool
+		value, via string
+	}
+	seen := map[key]bool{}
+	for _, a := range i.VerifiableAddresses {
+		k := key{verifiable: true, value: a.Value, via: a.Via}
+		if seen[k] {
+			return true
+		}
+		seen[k] = true
+	}
+	for _, a := range i.RecoveryAddresses {
+		k := key{value: a.Value, via: a.Via}
+		if seen[k] {
+			return true
+		}
+		seen[k] = true
+	}
+	return false
+}
+
+func queryFilter(q model.IdentityQuery) bson.M {
+	filter := bson.M{}
+	if q.SchemaID != "" {
+		filter["schema_id"] = q.SchemaID
+	}
+	if !q.HasAddressFilter() {
+		return filter
+	}
+	address := bson.M{}
+	if q.Address != "" {
+		address["value"] = q.Address
+	}
+	if q.Via != "" {
+		address["via"] = q.Via
+	}
+	if q.Verified != nil {
+		verifiable := bson.M{"verified": *q.Verified}
+		for k, v := range address {
+			verifiable[k] = v
+		}
+		filter[verifiableAddressesField] = bson.M{"$elemMatch": verifiable}
+		return filter
+	}
+	filter["$or"] = bson.A{
+		bson.M{verifiableAddressesField: bson.M{"$elemMatch": address}},
+		bson.M{recoveryAddressesField: bson.M{"$elemMatch": address}},
+	}
+	return filter
+}
+
+func (s *Store) ctx(timeout ...time.Duration) (context.Context, context.CancelFunc) {
+	t := s.timeout
 	if len(timeout) > 0 {
 		t = timeout[0]
 	}
@@ -143,3 +453,7 @@ func ctx(timeout ...time.Duration) (context.Context, context.CancelFunc) {
 func idFilter(id string) bson.M {
 	return bson.M{"id": id}
 }
+
+func versionFilter(id string, version int64) bson.M {
+	return bson.M{"id": id, "version": version}
+}
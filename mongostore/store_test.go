@@ -3,6 +3,7 @@ package mongostore
 import (
 	"fmt"
 	"math/rand"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -11,7 +12,10 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	uuid "github.com/satori/go.uuid"
+	"github.com/trapck/kr.api/appconfig"
 	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/server"
+	"github.com/trapck/kr.api/storetest"
 	"github.com/trapck/kr.api/testutil"
 
 	"github.com/stretchr/testify/assert"
@@ -20,7 +24,7 @@ import (
 func TestList(t *testing.T) {
 	db := initDB(t)
 	defer closeDB(t, db)
-	context, cancel := ctx()
+	context, cancel := db.ctx()
 	defer cancel()
 	cnt, err := db.identity.CountDocuments(context, bson.M{})
 	testutil.FailOnNotEqual(t, err, nil, "error when counting identities for comparison")
@@ -34,7 +38,7 @@ func TestCreate(t *testing.T) {
 	time := time.Now()
 	db := initDB(t)
 	defer closeDB(t, db)
-	context, cancel := ctx()
+	context, cancel := db.ctx()
 	defer cancel()
 	defer clearAllTestData(db, sessionID)
 
@@ -68,7 +72,8 @@ func TestCreate(t *testing.T) {
 	}
 	output, err := db.Create(input)
 	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
-	assert.Equal(t, input, output, fmt.Sprintf("created identity must be equal to input"))
+	assert.Equal(t, int64(1), output.Version, "created identity must have initial version")
+	storetest.AssertIdentity(t, input, output, "created identity must be equal to input")
 	cnt, err := db.identity.CountDocuments(context, idFilter(output.ID))
 	testutil.FailOnNotEqual(t, err, nil, "error when counting identities for comparison")
 	assert.NotEqual(t, 0, cnt, fmt.Sprintf("expected to find identity in db"))
@@ -79,7 +84,7 @@ func TestGet(t *testing.T) {
 	id := uuid.NewV4().String()
 	db := initDB(t)
 	defer closeDB(t, db)
-	context, cancel := ctx()
+	context, cancel := db.ctx()
 	defer cancel()
 	defer clearAllTestData(db, sessionID)
 
@@ -106,7 +111,7 @@ func TestUpdate(t *testing.T) {
 	sessionID := createSessionID()
 	db := initDB(t)
 	defer closeDB(t, db)
-	context, cancel := ctx()
+	context, cancel := db.ctx()
 	defer cancel()
 	defer clearAllTestData(db, sessionID)
 
@@ -134,29 +139,41 @@ func TestDelete(t *testing.T) {
 	id := uuid.NewV4().String()
 	db := initDB(t)
 	defer closeDB(t, db)
-	context, cancel := ctx()
+	context, cancel := db.ctx()
 	defer cancel()
 	defer clearAllTestData(db, sessionID)
 
 	_, err := db.identity.InsertOne(context, model.Identity{ID: id, SchemaID: sessionID})
 	testutil.FailOnNotEqual(t, err, nil, "error when inserting identity for comparison")
 	t.Run("should delete an existing entity", func(t *testing.T) {
-		err = db.Delete(id)
+		err = db.Delete(id, 0)
 		testutil.FailOnNotEqual(t, err, nil, "expected to delete identity without error")
 		cnt, err := db.identity.CountDocuments(context, idFilter(id))
 		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
 		assert.Equal(t, 0, int(cnt), "expected identity to be not found in db")
 	})
 	t.Run("should return error for not existing entity", func(t *testing.T) {
-		err = db.Delete(uuid.NewV4().String())
+		err = db.Delete(uuid.NewV4().String(), 0)
 		assert.Error(t, err, "expected to get an error for not existing identity delete")
 	})
 }
 
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) server.Store {
+		db := initDB(t)
+		t.Cleanup(func() { closeDB(t, db) })
+		return db
+	})
+}
+
 func initDB(t *testing.T) *Store {
 	t.Helper()
+	cfg, _, err := appconfig.Load(nil, os.LookupEnv)
+	if err != nil {
+		assert.FailNow(t, "config was not loaded. ", err)
+	}
 	s := Store{}
-	if err := s.Init(); err != nil {
+	if err := s.Init(cfg.Mongo); err != nil {
 		assert.FailNow(t, "db connection was not established. ", err)
 	}
 	return &s
@@ -175,7 +192,7 @@ func createSessionID() string {
 }
 
 func clearAllTestData(db *Store, sessionID string) {
-	context, cancel := ctx()
+	context, cancel := db.ctx()
 	defer cancel()
 	db.identity.DeleteMany(context, bson.M{"schema_id": primitive.Regex{Pattern: sessionID + "$", Options: ""}})
 }
@@ -0,0 +1,51 @@
+package mongostore
+
+import (
+	"github.com/trapck/kr.api/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SaveVerificationCode inserts or replaces verification code of the address
+func (s *Store) SaveVerificationCode(v model.VerificationCode) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.code.ReplaceOne(ctx, addressIDFilter(v.AddressID), v, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetVerificationCode returns pending verification code of the address
+func (s *Store) GetVerificationCode(addressID string) (model.VerificationCode, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var v model.VerificationCode
+	err := s.code.FindOne(ctx, addressIDFilter(addressID)).Decode(&v)
+	return v, err
+}
+
+// IncrementVerificationAttempts atomically counts an attempt to use verification code of the address and returns the code
+func (s *Store) IncrementVerificationAttempts(addressID string) (model.VerificationCode, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var v model.VerificationCode
+	err := s.code.FindOneAndUpdate(
+		ctx,
+		addressIDFilter(addressID),
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&v)
+	return v, err
+}
+
+// DeleteVerificationCode deletes verification code of the address if any
+func (s *Store) DeleteVerificationCode(addressID string) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.code.DeleteOne(ctx, addressIDFilter(addressID))
+	return err
+}
+
+func addressIDFilter(id string) bson.M {
+	return bson.M{"address_id": id}
+}
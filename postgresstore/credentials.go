@@ -0,0 +1,156 @@
+package postgresstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/trapck/kr.api/model"
+)
+
+// selectCredentials selects credentials with their identifiers aggregated to json array
+const selectCredentials = `SELECT c.*,
+	COALESCE((SELECT json_agg(x.identifier ORDER BY x.identifier) FROM identity_credentials_identifier x
+		WHERE x.identity_id = c.identity_id AND x.type = c.type), '[]') AS identifiers
+FROM identity_credentials c`
+
+// credentialsRow is a result row of selectCredentials query
+type credentialsRow struct {
+	model.Credentials
+	IdentifiersJSON []byte `db:"identifiers"`
+}
+
+// PutCredentials inserts or replaces identity credentials of c.Type
+func (s *Store) PutCredentials(c model.Credentials) error {
+	return s.execTxChain(func(t *sqlx.Tx) error {
+		var id string
+		if e := t.QueryRow("SELECT id FROM identity WHERE id = $1 FOR SHARE", c.IdentityID).Scan(&id); e != nil {
+			return e
+		}
+		_, e := t.Exec(
+			`INSERT INTO identity_credentials (identity_id, type, config, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (identity_id, type) DO UPDATE SET config = EXCLUDED.config,
+					created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at`,
+			c.IdentityID, c.Type, c.Config, c.CreatedAt, c.UpdatedAt,
+		)
+		if e != nil {
+			return e
+		}
+		_, e = t.Exec("DELETE FROM identity_credentials_identifier WHERE identity_id = $1 AND type = $2", c.IdentityID, c.Type)
+		if e != nil {
+			return e
+		}
+		for _, v := range c.Identifiers {
+			_, e = t.Exec(
+				"INSERT INTO identity_credentials_identifier (type, identifier, identity_id) VALUES ($1, $2, $3)",
+				c.Type, v, c.IdentityID,
+			)
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+// FindCredentials returns credentials of the type having the identifier
+func (s *Store) FindCredentials(credType, identifier string) (model.Credentials, error) {
+	row := credentialsRow{}
+	e := s.db.Get(
+		&row,
+		selectCredentials+` WHERE c.type = $1 AND c.identity_id =
+			(SELECT identity_id FROM identity_credentials_identifier WHERE type = $1 AND identifier = $2)`,
+		credType, identifier,
+	)
+	if e != nil {
+		return row.Credentials, e
+	}
+	return row.toCredentials()
+}
+
+// MergeCredentialsConfig sets and deletes keys of identity credentials config of the type keeping its other keys
+func (s *Store) MergeCredentialsConfig(identityID, credType string, set model.JSONObject, unset []string, updatedAt time.Time) error {
+	if set == nil {
+		set = model.JSONObject{}
+	}
+	return s.updateCredentials(
+		`UPDATE identity_credentials SET config = (config || $3::jsonb) - $4::text[], updated_at = $5
+			WHERE identity_id = $1 AND type = $2`,
+		identityID, credType, set, pq.Array(unset), updatedAt,
+	)
+}
+
+// IncrementTOTPAttempts atomically counts a second factor attempt and returns totp credentials of the identity.
+// The count restarts at now when its window started at or before windowStart
+func (s *Store) IncrementTOTPAttempts(identityID string, now, windowStart time.Time) (model.Credentials, error) {
+	c := model.Credentials{}
+	e := s.db.Get(
+		&c,
+		`UPDATE identity_credentials SET config = config || CASE
+				WHEN COALESCE((config->>'attempts_since')::numeric, 0) <= $3::bigint THEN jsonb_build_object('attempts', 1, 'attempts_since', $4::bigint)
+				ELSE jsonb_build_object('attempts', COALESCE((config->>'attempts')::numeric, 0) + 1) END
+			WHERE identity_id = $1 AND type = $2 RETURNING *`,
+		identityID, model.CredentialsTOTP, model.UnixMillis(windowStart), model.UnixMillis(now),
+	)
+	return c, e
+}
+
+// ConsumeTOTPStep atomically sets the last accepted totp step of the identity and resets counted attempts.
+// It fails with sql.ErrNoRows unless the stored step is before step
+func (s *Store) ConsumeTOTPStep(identityID string, step int64, updatedAt time.Time) error {
+	return s.updateCredentials(
+		`UPDATE identity_credentials SET config = config || jsonb_build_object('last_step', $3::bigint, 'attempts', 0), updated_at = $4
+			WHERE identity_id = $1 AND type = $2 AND COALESCE((config->>'last_step')::numeric, 0) < $3::bigint`,
+		identityID, model.CredentialsTOTP, step, updatedAt,
+	)
+}
+
+// UseTOTPRecoveryCode atomically removes the recovery code hash from totp credentials of the identity and resets
+// counted attempts. It fails with sql.ErrNoRows when the hash is not stored
+func (s *Store) UseTOTPRecoveryCode(identityID, hash string, updatedAt time.Time) error {
+	return s.updateCredentials(
+		`UPDATE identity_credentials SET config = config ||
+				jsonb_build_object('recovery_codes', (config->'recovery_codes') - $3::text, 'attempts', 0), updated_at = $4
+			WHERE identity_id = $1 AND type = $2 AND config->'recovery_codes' @> jsonb_build_array($3::text)`,
+		identityID, model.CredentialsTOTP, hash, updatedAt,
+	)
+}
+
+// updateCredentials executes credentials update, reporting sql.ErrNoRows when no credentials are updated
+func (s *Store) updateCredentials(query string, args ...interface{}) error {
+	r, e := s.db.Exec(query, args...)
+	if e != nil {
+		return e
+	}
+	if n, e := r.RowsAffected(); e != nil {
+		return e
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// identityCredentials returns all identity credentials by type or nil when there are none
+func (s *Store) identityCredentials(id string) (map[string]model.Credentials, error) {
+	rows := []credentialsRow{}
+	if e := s.db.Select(&rows, selectCredentials+" WHERE c.identity_id = $1", id); e != nil || len(rows) == 0 {
+		return nil, e
+	}
+	res := map[string]model.Credentials{}
+	for _, r := range rows {
+		c, e := r.toCredentials()
+		if e != nil {
+			return nil, e
+		}
+		res[c.Type] = c
+	}
+	return res, nil
+}
+
+func (r credentialsRow) toCredentials() (model.Credentials, error) {
+	c := r.Credentials
+	e := json.Unmarshal(r.IdentifiersJSON, &c.Identifiers)
+	return c, e
+}
@@ -0,0 +1,37 @@
+package postgresstore
+
+import (
+	"context"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// Ping checks that the database is reachable
+func (s *Store) Ping(ctx context.Context) error {
+	if success, e := s.ensureConnection(); !success {
+		return e
+	}
+	return s.db.PingContext(ctx)
+}
+
+// SchemaStatus returns applied and pending migration versions
+func (s *Store) SchemaStatus(ctx context.Context) (model.MigrationStatus, error) {
+	res := model.MigrationStatus{Pending: []int64{}}
+	if success, e := s.ensureConnection(); !success {
+		return res, e
+	}
+	c, err := s.db.Conn(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer c.Close()
+	st, err := migrationStatus(ctx, c)
+	if err != nil {
+		return res, err
+	}
+	res.Current, res.Latest = st.Current, st.Latest
+	for _, m := range st.Pending {
+		res.Pending = append(res.Pending, m.Version)
+	}
+	return res, nil
+}
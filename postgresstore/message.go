@@ -0,0 +1,88 @@
+package postgresstore
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// EnqueueMessage inserts message
+func (s *Store) EnqueueMessage(m model.Message) error {
+	_, e := s.db.NamedExec(
+		`INSERT INTO courier_message (id, via, recipient, identity_id, template, subject, body, status, attempts, last_error, send_after, created_at, updated_at)
+			VALUES (:id, :via, :recipient, :identity_id, :template, :subject, :body, :status, :attempts, :last_error, :send_after, :created_at, :updated_at)`,
+		m,
+	)
+	return e
+}
+
+// ClaimMessages marks up to limit due messages as sending and returns them ordered by send time.
+// Due messages are queued ones which should be sent not later than now and sending ones not updated since reclaimBefore.
+// Rows locked by concurrent claims are skipped, so every message is claimed once
+func (s *Store) ClaimMessages(now, reclaimBefore time.Time, limit int) ([]model.Message, error) {
+	l := []model.Message{}
+	e := s.db.Select(
+		&l,
+		`UPDATE courier_message SET status = $1, updated_at = $2
+			WHERE id IN (
+				SELECT id FROM courier_message
+					WHERE (status = $3 AND send_after <= $2) OR (status = $1 AND updated_at < $4)
+					ORDER BY send_after, id LIMIT $5
+					FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *`,
+		model.MessageSending, now, model.MessageQueued, reclaimBefore, limit,
+	)
+	if e != nil {
+		return nil, e
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].SendAfter.Equal(l[j].SendAfter) {
+			return l[i].ID < l[j].ID
+		}
+		return l[i].SendAfter.Before(l[j].SendAfter)
+	})
+	return l, nil
+}
+
+// UpdateMessage replaces message with the same id
+func (s *Store) UpdateMessage(m model.Message) error {
+	r, e := s.db.NamedExec(
+		`UPDATE courier_message SET via = :via, recipient = :recipient, identity_id = :identity_id, template = :template,
+			subject = :subject, body = :body, status = :status, attempts = :attempts, last_error = :last_error,
+			send_after = :send_after, created_at = :created_at, updated_at = :updated_at
+			WHERE id = :id`,
+		m,
+	)
+	if e != nil {
+		return e
+	}
+	if n, e := r.RowsAffected(); e != nil {
+		return e
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListMessages returns up to q.Limit messages matching q filters ordered from the newest
+func (s *Store) ListMessages(q model.MessageQuery) ([]model.Message, error) {
+	l := []model.Message{}
+	e := s.db.Select(
+		&l,
+		`SELECT * FROM courier_message
+			WHERE ($1 = '' OR recipient = $1) AND ($2 = '' OR via = $2) AND ($3 = '' OR identity_id = $3) AND ($4 = '' OR status = $4)
+			ORDER BY created_at DESC, id DESC LIMIT $5`,
+		q.Recipient, q.Via, q.IdentityID, q.Status, q.Limit,
+	)
+	return l, e
+}
+
+// GetMessage returns message by id
+func (s *Store) GetMessage(id string) (model.Message, error) {
+	m := model.Message{}
+	e := s.db.Get(&m, "SELECT * FROM courier_message WHERE id = $1", id)
+	return m, e
+}
@@ -0,0 +1,243 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is a key of postgres advisory lock held while migrations are applied
+const migrationLockID = 4170532815
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint PRIMARY KEY,
+	name text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// Migration describes a single versioned schema change
+type Migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus describes a database schema version
+type MigrationStatus struct {
+	Current int64
+	Latest  int64
+	Pending []Migration
+}
+
+// Migrations returns all embedded migrations ordered by version
+func Migrations() ([]Migration, error) {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, f := range files {
+		name := f.Name()
+		parts := strings.SplitN(strings.TrimSuffix(name, ".sql"), "_", 2)
+		ext := path.Ext(strings.TrimSuffix(name, ".sql"))
+		if len(parts) != 2 || (ext != ".up" && ext != ".down") {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		v, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q: %v", name, err)
+		}
+		b, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[v]
+		if !ok {
+			m = &Migration{Version: v, Name: strings.TrimSuffix(parts[1], ext)}
+			byVersion[v] = m
+		}
+		if ext == ".up" {
+			m.up = string(b)
+		} else {
+			m.down = string(b)
+		}
+	}
+	res := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d must have both up and down files", m.Version)
+		}
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+	return res, nil
+}
+
+// Migrate applies all pending migrations
+func (s *Store) Migrate() error {
+	return s.withMigrationLock(func(c *sql.Conn) error {
+		st, err := migrationStatus(context.Background(), c)
+		if err != nil {
+			return err
+		}
+		for _, m := range st.Pending {
+			if err = applyMigration(c, m, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts the given number of the last applied migrations
+func (s *Store) MigrateDown(steps int) error {
+	return s.withMigrationLock(func(c *sql.Conn) error {
+		all, err := Migrations()
+		if err != nil {
+			return err
+		}
+		applied, err := appliedVersions(context.Background(), c, "SELECT version FROM schema_migrations ORDER BY version DESC")
+		if err != nil {
+			return err
+		}
+		for n := 0; n < steps && n < len(applied); n++ {
+			m, ok := findMigration(all, applied[n])
+			if !ok {
+				return fmt.Errorf("migration %d is applied but not known to this build", applied[n])
+			}
+			if err = applyMigration(c, m, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MigrationStatus returns current schema version and pending migrations
+func (s *Store) MigrationStatus() (MigrationStatus, error) {
+	var st MigrationStatus
+	if success, e := s.ensureConnection(); !success {
+		return st, e
+	}
+	ctx := context.Background()
+	c, err := s.db.Conn(ctx)
+	if err != nil {
+		return st, err
+	}
+	defer c.Close()
+	return migrationStatus(ctx, c)
+}
+
+func (s *Store) withMigrationLock(f func(*sql.Conn) error) error {
+	if success, e := s.ensureConnection(); !success {
+		return e
+	}
+	ctx := context.Background()
+	c, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err = c.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("could not acquire migration lock: %v", err)
+	}
+	defer c.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	if _, err = c.ExecContext(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+	return f(c)
+}
+
+func migrationStatus(ctx context.Context, c *sql.Conn) (MigrationStatus, error) {
+	st := MigrationStatus{}
+	all, err := Migrations()
+	if err != nil {
+		return st, err
+	}
+	var table sql.NullString
+	err = c.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations')::text").Scan(&table)
+	if err != nil {
+		return st, err
+	}
+	applied := []int64{}
+	if table.Valid {
+		applied, err = appliedVersions(ctx, c, "SELECT version FROM schema_migrations ORDER BY version")
+		if err != nil {
+			return st, err
+		}
+	}
+	isApplied := map[int64]bool{}
+	for _, v := range applied {
+		isApplied[v] = true
+		st.Current = v
+	}
+	for _, m := range all {
+		st.Latest = m.Version
+		if !isApplied[m.Version] {
+			st.Pending = append(st.Pending, m)
+		}
+	}
+	return st, nil
+}
+
+func appliedVersions(ctx context.Context, c *sql.Conn, q string) ([]int64, error) {
+	rows, err := c.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []int64{}
+	for rows.Next() {
+		var v int64
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+func applyMigration(c *sql.Conn, m Migration, up bool) error {
+	ctx := context.Background()
+	t, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	q, record := m.up, func(t *sql.Tx) error {
+		_, e := t.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+		return e
+	}
+	if !up {
+		q, record = m.down, func(t *sql.Tx) error {
+			_, e := t.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			return e
+		}
+	}
+	if _, err = t.Exec(q); err != nil {
+		t.Rollback()
+		return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+	}
+	if err = record(t); err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.Commit()
+}
+
+func findMigration(all []Migration, version int64) (Migration, bool) {
+	for _, m := range all {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
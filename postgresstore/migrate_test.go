@@ -0,0 +1,41 @@
+package postgresstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trapck/kr.api/testutil"
+)
+
+func TestMigrations(t *testing.T) {
+	m, err := Migrations()
+	testutil.FailOnNotEqual(t, err, nil, "expected embedded migrations to be loaded without errors")
+	testutil.FailOnEqual(t, len(m), 0, "expected at least one embedded migration")
+	for i := range m {
+		assert.NotEmpty(t, m[i].Name, "migration name must not be empty")
+		assert.NotEmpty(t, m[i].up, "migration must have up script")
+		assert.NotEmpty(t, m[i].down, "migration must have down script")
+		if i > 0 {
+			assert.Less(t, m[i-1].Version, m[i].Version, "migrations must be ordered by version")
+		}
+	}
+}
+
+func TestMigrationStatus(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	st, err := db.MigrationStatus()
+	testutil.FailOnNotEqual(t, err, nil, "expected to get migration status without errors")
+	assert.Empty(t, st.Pending, "expected all migrations to be applied by Init")
+	assert.Equal(t, st.Latest, st.Current, "expected db to be at the latest version")
+}
+
+func TestSchemaStatus(t *testing.T) {
+	db := initDB(t)
+	defer closeDB(t, db)
+	st, err := db.SchemaStatus(context.Background())
+	testutil.FailOnNotEqual(t, err, nil, "expected to get schema status without errors")
+	assert.Empty(t, st.Pending, "expected all migrations to be applied by Init")
+	assert.Equal(t, st.Latest, st.Current, "expected db to be at the latest version")
+}
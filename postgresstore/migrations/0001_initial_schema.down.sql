@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS recovery_address;
+DROP TABLE IF EXISTS verifiable_address;
+DROP TABLE IF EXISTS identity;
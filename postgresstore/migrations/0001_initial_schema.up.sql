@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS identity (
+    id uuid PRIMARY KEY,
+    schema_id text NOT NULL DEFAULT '',
+    schema_url text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS verifiable_address (
+    id text PRIMARY KEY,
+    value text NOT NULL DEFAULT '',
+    via text NOT NULL DEFAULT '',
+    verified boolean NOT NULL DEFAULT false,
+    verified_at timestamptz,
+    expires_at timestamptz,
+    identity uuid NOT NULL REFERENCES identity (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS verifiable_address_identity_idx ON verifiable_address (identity);
+
+CREATE TABLE IF NOT EXISTS recovery_address (
+    id text PRIMARY KEY,
+    value text NOT NULL DEFAULT '',
+    via text NOT NULL DEFAULT '',
+    identity uuid NOT NULL REFERENCES identity (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS recovery_address_identity_idx ON recovery_address (identity);
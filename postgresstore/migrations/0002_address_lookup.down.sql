@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS identity_schema_id_idx;
+DROP INDEX IF EXISTS recovery_address_value_via_idx;
+DROP INDEX IF EXISTS verifiable_address_value_via_idx;
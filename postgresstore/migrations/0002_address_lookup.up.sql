@@ -0,0 +1,5 @@
+CREATE UNIQUE INDEX verifiable_address_value_via_idx ON verifiable_address (value, via);
+
+CREATE UNIQUE INDEX recovery_address_value_via_idx ON recovery_address (value, via);
+
+CREATE INDEX identity_schema_id_idx ON identity (schema_id, id);
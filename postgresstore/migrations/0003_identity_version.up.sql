@@ -0,0 +1 @@
+ALTER TABLE identity ADD COLUMN version bigint NOT NULL DEFAULT 1;
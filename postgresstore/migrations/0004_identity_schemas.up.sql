@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS identity_schema (
+	id text PRIMARY KEY,
+	schema jsonb NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE identity ADD COLUMN traits jsonb NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+ALTER TABLE identity DROP COLUMN metadata_admin;
+ALTER TABLE identity DROP COLUMN metadata_public;
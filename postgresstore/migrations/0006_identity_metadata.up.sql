@@ -0,0 +1,2 @@
+ALTER TABLE identity ADD COLUMN metadata_public jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE identity ADD COLUMN metadata_admin jsonb NOT NULL DEFAULT '{}';
@@ -0,0 +1,6 @@
+ALTER TABLE recovery_address DROP COLUMN updated_at;
+ALTER TABLE recovery_address DROP COLUMN created_at;
+ALTER TABLE verifiable_address DROP COLUMN updated_at;
+ALTER TABLE verifiable_address DROP COLUMN created_at;
+ALTER TABLE identity DROP COLUMN updated_at;
+ALTER TABLE identity DROP COLUMN created_at;
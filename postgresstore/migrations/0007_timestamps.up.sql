@@ -0,0 +1,6 @@
+ALTER TABLE identity ADD COLUMN created_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE identity ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE verifiable_address ADD COLUMN created_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE verifiable_address ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE recovery_address ADD COLUMN created_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE recovery_address ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
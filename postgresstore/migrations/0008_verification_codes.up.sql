@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS verification_code (
+	address_id text PRIMARY KEY,
+	identity_id uuid NOT NULL REFERENCES identity (id) ON DELETE CASCADE ON UPDATE CASCADE,
+	code_hash text NOT NULL,
+	attempts integer NOT NULL DEFAULT 0,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
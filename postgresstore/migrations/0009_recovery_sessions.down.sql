@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS session;
+DROP TABLE IF EXISTS recovery_token;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS recovery_token (
+	token_hash text PRIMARY KEY,
+	identity_id uuid NOT NULL REFERENCES identity (id) ON DELETE CASCADE ON UPDATE CASCADE,
+	address_id text NOT NULL,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS recovery_token_identity_id_idx ON recovery_token (identity_id);
+
+CREATE TABLE IF NOT EXISTS session (
+	id uuid PRIMARY KEY,
+	token_hash text NOT NULL UNIQUE,
+	identity_id uuid NOT NULL REFERENCES identity (id) ON DELETE CASCADE ON UPDATE CASCADE,
+	privileged boolean NOT NULL DEFAULT false,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS session_identity_id_idx ON session (identity_id);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS courier_message (
+	id uuid PRIMARY KEY,
+	via text NOT NULL,
+	recipient text NOT NULL,
+	identity_id text NOT NULL DEFAULT '',
+	template text NOT NULL,
+	subject text NOT NULL DEFAULT '',
+	body text NOT NULL DEFAULT '',
+	status text NOT NULL,
+	attempts integer NOT NULL DEFAULT 0,
+	last_error text NOT NULL DEFAULT '',
+	send_after timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS courier_message_due_idx ON courier_message (send_after, id) WHERE status = 'queued';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS identity_credentials_identifier;
+DROP TABLE IF EXISTS identity_credentials;
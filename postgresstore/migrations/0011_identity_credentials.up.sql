@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS identity_credentials (
+	identity_id uuid NOT NULL REFERENCES identity (id) ON DELETE CASCADE ON UPDATE CASCADE,
+	type text NOT NULL,
+	config jsonb NOT NULL DEFAULT '{}',
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (identity_id, type)
+);
+
+CREATE TABLE IF NOT EXISTS identity_credentials_identifier (
+	type text NOT NULL,
+	identifier text NOT NULL,
+	identity_id uuid NOT NULL,
+	PRIMARY KEY (type, identifier),
+	FOREIGN KEY (identity_id, type) REFERENCES identity_credentials (identity_id, type) ON DELETE CASCADE ON UPDATE CASCADE
+);
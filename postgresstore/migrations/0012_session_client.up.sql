@@ -0,0 +1,2 @@
+ALTER TABLE session ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+ALTER TABLE session ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE session ADD COLUMN IF NOT EXISTS aal text NOT NULL DEFAULT 'aal1';
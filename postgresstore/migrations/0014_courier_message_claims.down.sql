@@ -0,0 +1,2 @@
+UPDATE courier_message SET status = 'queued' WHERE status = 'sending';
+DROP INDEX IF EXISTS courier_message_claimed_idx;
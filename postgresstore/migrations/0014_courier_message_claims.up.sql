@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS courier_message_claimed_idx ON courier_message (updated_at) WHERE status = 'sending';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS courier_message_identity_idx;
+DROP INDEX IF EXISTS courier_message_recipient_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS courier_message_recipient_idx ON courier_message (recipient, created_at DESC);
+CREATE INDEX IF NOT EXISTS courier_message_identity_idx ON courier_message (identity_id, created_at DESC);
@@ -0,0 +1,35 @@
+package postgresstore
+
+import (
+	"github.com/trapck/kr.api/model"
+)
+
+// SaveRecoveryToken inserts recovery token
+func (s *Store) SaveRecoveryToken(t model.RecoveryToken) error {
+	_, e := s.db.Exec(
+		`INSERT INTO recovery_token (token_hash, identity_id, address_id, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5)`,
+		t.TokenHash, t.IdentityID, t.AddressID, t.ExpiresAt, t.CreatedAt,
+	)
+	return e
+}
+
+// GetLatestRecoveryToken returns the most recently created recovery token of the identity
+func (s *Store) GetLatestRecoveryToken(identityID string) (model.RecoveryToken, error) {
+	t := model.RecoveryToken{}
+	e := s.db.Get(&t, "SELECT * FROM recovery_token WHERE identity_id = $1 ORDER BY created_at DESC LIMIT 1", identityID)
+	return t, e
+}
+
+// UseRecoveryToken deletes recovery token and returns it, so every token can be used once
+func (s *Store) UseRecoveryToken(tokenHash string) (model.RecoveryToken, error) {
+	t := model.RecoveryToken{}
+	e := s.db.Get(&t, "DELETE FROM recovery_token WHERE token_hash = $1 RETURNING *", tokenHash)
+	return t, e
+}
+
+// DeleteRecoveryTokens deletes all recovery tokens of the identity
+func (s *Store) DeleteRecoveryTokens(identityID string) error {
+	_, e := s.db.Exec("DELETE FROM recovery_token WHERE identity_id = $1", identityID)
+	return e
+}
@@ -0,0 +1,28 @@
+package postgresstore
+
+import (
+	"github.com/trapck/kr.api/model"
+)
+
+// ListSchemas returns all stored identity schemas ordered by id
+func (s *Store) ListSchemas() ([]model.IdentitySchema, error) {
+	res := []model.IdentitySchema{}
+	e := s.db.Select(&res, "SELECT id, schema FROM identity_schema ORDER BY id")
+	return res, e
+}
+
+// GetSchema returns identity schema by id
+func (s *Store) GetSchema(id string) (model.IdentitySchema, error) {
+	res := model.IdentitySchema{}
+	e := s.db.Get(&res, "SELECT id, schema FROM identity_schema WHERE id = $1", id)
+	return res, e
+}
+
+// PutSchema inserts or replaces identity schema
+func (s *Store) PutSchema(schema model.IdentitySchema) error {
+	_, e := s.db.Exec(
+		"INSERT INTO identity_schema (id, schema) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET schema = EXCLUDED.schema",
+		schema.ID, string(schema.Schema),
+	)
+	return e
+}
@@ -0,0 +1,34 @@
+package postgresstore
+
+import (
+	"github.com/trapck/kr.api/model"
+)
+
+// CreateSession inserts session
+func (s *Store) CreateSession(v model.Session) error {
+	_, e := s.db.Exec(
+		`INSERT INTO session (id, token_hash, identity_id, privileged, aal, ip, user_agent, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		v.ID, v.TokenHash, v.IdentityID, v.Privileged, v.AAL, v.IP, v.UserAgent, v.ExpiresAt, v.CreatedAt,
+	)
+	return e
+}
+
+// GetSession returns session by hash of its token
+func (s *Store) GetSession(tokenHash string) (model.Session, error) {
+	v := model.Session{}
+	e := s.db.Get(&v, "SELECT * FROM session WHERE token_hash = $1", tokenHash)
+	return v, e
+}
+
+// DeleteSession deletes session by hash of its token if any
+func (s *Store) DeleteSession(tokenHash string) error {
+	_, e := s.db.Exec("DELETE FROM session WHERE token_hash = $1", tokenHash)
+	return e
+}
+
+// DeleteOtherSessions deletes all sessions of the identity except the one with the token hash
+func (s *Store) DeleteOtherSessions(identityID, exceptTokenHash string) error {
+	_, e := s.db.Exec("DELETE FROM session WHERE identity_id = $1 AND token_hash <> $2", identityID, exceptTokenHash)
+	return e
+}
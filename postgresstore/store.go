@@ -2,22 +2,57 @@ package postgresstore
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // db driver
+	"github.com/lib/pq"
 	"github.com/trapck/kr.api/appconfig"
 	"github.com/trapck/kr.api/model"
 )
 
+// selectIdentities selects identities with their addresses aggregated to json arrays in a single query
+const selectIdentities = `SELECT i.*,
+	COALESCE((SELECT json_agg(a ORDER BY a.id) FROM recovery_address a WHERE a.identity = i.id), '[]') AS recovery_addresses,
+	COALESCE((SELECT json_agg(a ORDER BY a.id) FROM verifiable_address a WHERE a.identity = i.id), '[]') AS verifiable_addresses
+FROM identity i`
+
+// ErrVersionMismatch is returned when identity is changed with outdated version
+var ErrVersionMismatch = errors.New("identity version mismatch")
+
+// uniqueViolationCode is postgres error code of unique constraint violation
+const uniqueViolationCode = "23505"
+
+// identityRow is a result row of selectIdentities query
+type identityRow struct {
+	model.Identity
+	RecoveryAddressesJSON   []byte `db:"recovery_addresses"`
+	VerifiableAddressesJSON []byte `db:"verifiable_addresses"`
+}
+
 //Store is postgres storage implementation
 type Store struct {
 	db *sqlx.DB
 }
 
-// Init initializes connetion
-func (s *Store) Init() error {
-	db, e := sqlx.Connect(appconfig.PostgresDriver, appconfig.PostgresConnStr)
+// Init initializes connetion and applies pending migrations if auto migration is enabled
+func (s *Store) Init(cfg appconfig.PostgresConfig) error {
+	e := s.Open(cfg)
+	if e != nil || !cfg.AutoMigrate {
+		return e
+	}
+	if e = s.Migrate(); e != nil {
+		return fmt.Errorf("could not apply migrations: %v", e)
+	}
+	return nil
+}
+
+// Open initializes connetion without touching db schema
+func (s *Store) Open(cfg appconfig.PostgresConfig) error {
+	db, e := sqlx.Connect(cfg.Driver, cfg.ConnStr)
 	s.db = db
 	return e
 }
@@ -27,135 +62,120 @@ func (s *Store) Close() error {
 	if success, e := s.ensureConnection(); !success {
 		return e
 	}
-	return nil
+	return s.db.Close()
 }
 
 // List returns all identities
 func (s *Store) List() ([]model.Identity, error) {
-	verifiableAddresses := []model.VerifiableAddress{}
-	recoveryAddresses := []model.RecoveryAddress{}
-	identities := []model.Identity{}
-	e := s.db.Select(&identities, "SELECT * FROM identity")
+	rows := []identityRow{}
+	e := s.db.Select(&rows, selectIdentities+" ORDER BY i.id")
 	if e != nil {
 		return nil, e
 	}
-	e = s.db.Select(&verifiableAddresses, "SELECT * FROM verifiable_address")
-	if e != nil && !s.NoRows(e) {
-		return nil, e
-	}
-	e = s.db.Select(&recoveryAddresses, "SELECT * FROM recovery_address")
-	if e != nil && !s.NoRows(e) {
+	return mapIdentityRows(rows)
+}
+
+// ListPage returns up to q.Limit identities matching q filters with id greater than q.After ordered by id
+func (s *Store) ListPage(q model.IdentityQuery) ([]model.Identity, error) {
+	rows := []identityRow{}
+	where, args := queryFilter(q)
+	args = append(args, q.Limit)
+	e := s.db.Select(&rows, fmt.Sprintf("%s%s ORDER BY i.id LIMIT $%d", selectIdentities, where, len(args)), args...)
+	if e != nil {
 		return nil, e
 	}
-	return s.mapIdentityEntities(identities, verifiableAddresses, recoveryAddresses), nil
+	return mapIdentityRows(rows)
 }
 
 // Get returns all identities
 func (s *Store) Get(id string) (model.Identity, error) {
-	identitiy := model.Identity{}
-	e := s.db.Get(&identitiy, "SELECT * FROM identity WHERE id = $1", id)
+	row := identityRow{}
+	e := s.db.Get(&row, selectIdentities+" WHERE i.id = $1", id)
 	if e != nil {
-		return identitiy, e
-	}
-	va := []model.VerifiableAddress{}
-	e = s.db.Select(&va, "SELECT * FROM verifiable_address WHERE identity=$1", id)
-	if e != nil && !s.NoRows(e) {
-		return identitiy, e
+		return row.Identity, e
 	}
-	identitiy.VerifiableAddresses = va
-	ra := []model.RecoveryAddress{}
-	e = s.db.Select(&ra, "SELECT * FROM recovery_address WHERE identity=$1", id)
-	if e != nil && !s.NoRows(e) {
-		return identitiy, e
+	i, e := row.toIdentity()
+	if e != nil {
+		return i, e
 	}
-	identitiy.RecoveryAddresses = ra
-	return identitiy, e
+	i.Credentials, e = s.identityCredentials(id)
+	return i, e
 }
 
 // Create inserts identity
 func (s *Store) Create(i model.Identity) (model.Identity, error) {
-	t, e := s.createTx(&i, nil)
-	if e != nil && t != nil {
-		t.Rollback()
-		return i, e
-	}
-
-	return i, t.Commit()
+	i.Version = 1
+	i.Touch(nil, time.Now())
+	return i, s.execTxChain(func(t *sqlx.Tx) error {
+		e := s.insertIdentity(t, i)
+		if e != nil {
+			return e
+		}
+		return s.insertAddresses(t, i)
+	})
 }
 
-func (s *Store) createTx(i *model.Identity, existingTx *sql.Tx) (*sql.Tx, error) {
-	var e error
-	if existingTx == nil {
-		existingTx, e = s.db.Begin()
-	}
-	if e != nil {
-		return existingTx, e
-	}
-	e = s.insertIdentity(existingTx, *i)
-	if e != nil {
-		return existingTx, e
-	}
-	if len(i.RecoveryAddresses) > 0 {
-		e = s.insertRecoveryAddresses(existingTx, i.ID, i.RecoveryAddresses)
+// Update updates identity. Non zero i.Version must match the stored one
+func (s *Store) Update(id string, i model.Identity) (model.Identity, error) {
+	e := s.execTxChain(func(t *sqlx.Tx) error {
+		current, e := s.lockVersion(t, id)
 		if e != nil {
-			return existingTx, e
+			return e
 		}
-	}
-
-	if len(i.VerifiableAddresses) > 0 {
-		e = s.insertVerifiableAddresses(existingTx, i.ID, i.VerifiableAddresses)
+		if i.Version != 0 && i.Version != current {
+			return ErrVersionMismatch
+		}
+		previous := identityRow{}
+		if e = t.Get(&previous, selectIdentities+" WHERE i.id = $1", id); e != nil {
+			return e
+		}
+		p, e := previous.toIdentity()
 		if e != nil {
-			return existingTx, e
+			return e
 		}
-	}
-	return existingTx, nil
-}
-
-// Update updates identity
-func (s *Store) Update(id string, i model.Identity) (model.Identity, error) {
-	return i, s.execTxChain(
-		func(t *sql.Tx) error {
-			_, e := s.deleteTx(id, t)
+		i.Version = current + 1
+		i.Touch(&p, time.Now())
+		if e = s.deleteAddresses(t, id); e != nil {
 			return e
-		}, func(t *sql.Tx) error {
-			_, e := s.createTx(&i, t)
+		}
+		_, e = t.Exec(
+			`UPDATE identity SET id = $1, schema_id = $2, schema_url = $3, traits = $4,
+				metadata_public = $5, metadata_admin = $6, version = $7, created_at = $8, updated_at = $9 WHERE id = $10`,
+			i.ID, i.SchemaID, i.SchemaURL, i.Traits, i.MetadataPublic, i.MetadataAdmin, i.Version, i.CreatedAt, i.UpdatedAt, id,
+		)
+		if e != nil {
 			return e
-		},
-	)
+		}
+		if id != i.ID {
+			// messages may be queued without identity, so they don't reference it and follow id changes here
+			if _, e = t.Exec("UPDATE courier_message SET identity_id = $1 WHERE identity_id = $2", i.ID, id); e != nil {
+				return e
+			}
+		}
+		return s.insertAddresses(t, i)
+	})
+	return i, e
 }
 
-//Delete deletes identity
-func (s *Store) Delete(id string) error {
-	t, e := s.deleteTx(id, nil)
-	if e != nil && t != nil {
-		t.Rollback()
+//Delete deletes identity. Non zero version must match the stored one
+func (s *Store) Delete(id string, version int64) error {
+	return s.execTxChain(func(t *sqlx.Tx) error {
+		current, e := s.lockVersion(t, id)
+		if e != nil {
+			return e
+		}
+		if version != 0 && version != current {
+			return ErrVersionMismatch
+		}
+		if e = s.deleteAddresses(t, id); e != nil {
+			return e
+		}
+		if _, e = t.Exec("DELETE FROM courier_message WHERE identity_id = $1", id); e != nil {
+			return e
+		}
+		_, e = t.Exec("DELETE FROM identity WHERE id = $1", id)
 		return e
-	}
-	return t.Commit()
-}
-
-//Delete deletes identity
-func (s *Store) deleteTx(id string, existingTx *sql.Tx) (*sql.Tx, error) {
-	var e error
-	if existingTx == nil {
-		existingTx, e = s.db.Begin()
-	}
-	if e != nil {
-		return existingTx, e
-	}
-	_, e = existingTx.Exec("DELETE FROM verifiable_address WHERE identity = $1", id)
-	if e != nil {
-		return existingTx, e
-	}
-	_, e = existingTx.Exec("DELETE FROM recovery_address WHERE identity = $1", id)
-	if e != nil {
-		return existingTx, e
-	}
-	r, e := existingTx.Exec("DELETE FROM identity WHERE id = $1", id)
-	if cnt, _ := r.RowsAffected(); e == nil && cnt == 0 {
-		e = sql.ErrNoRows
-	}
-	return existingTx, e
+	})
 }
 
 //NoRows returns whether error is no rows error
@@ -163,6 +183,17 @@ func (s *Store) NoRows(e error) bool {
 	return e == sql.ErrNoRows
 }
 
+//VersionMismatch returns whether error is caused by outdated identity version
+func (s *Store) VersionMismatch(e error) bool {
+	return e == ErrVersionMismatch
+}
+
+//Duplicate returns whether error is caused by already existing identity id or address
+func (s *Store) Duplicate(e error) bool {
+	pe, ok := e.(*pq.Error)
+	return ok && pe.Code == uniqueViolationCode
+}
+
 func (s *Store) ensureConnection() (isConnected bool, e error) {
 	isConnected = s.db != nil
 	if !isConnected {
@@ -171,86 +202,142 @@ func (s *Store) ensureConnection() (isConnected bool, e error) {
 	return
 }
 
-func (s *Store) insertIdentity(t *sql.Tx, i model.Identity) error {
-	_, e := t.Exec("INSERT INTO identity (id, schema_id, schema_url) VALUES ($1, $2, $3)", i.ID, i.SchemaID, i.SchemaURL)
+func (s *Store) insertIdentity(t *sqlx.Tx, i model.Identity) error {
+	_, e := t.Exec(
+		`INSERT INTO identity (id, schema_id, schema_url, traits, metadata_public, metadata_admin, version, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		i.ID, i.SchemaID, i.SchemaURL, i.Traits, i.MetadataPublic, i.MetadataAdmin, i.Version, i.CreatedAt, i.UpdatedAt,
+	)
+	return e
+}
+
+func (s *Store) insertAddresses(t *sqlx.Tx, i model.Identity) error {
+	if len(i.RecoveryAddresses) > 0 {
+		if e := s.insertRecoveryAddresses(t, i.ID, i.RecoveryAddresses); e != nil {
+			return e
+		}
+	}
+	if len(i.VerifiableAddresses) > 0 {
+		return s.insertVerifiableAddresses(t, i.ID, i.VerifiableAddresses)
+	}
+	return nil
+}
+
+func (s *Store) deleteAddresses(t *sqlx.Tx, identity string) error {
+	_, e := t.Exec("DELETE FROM verifiable_address WHERE identity = $1", identity)
+	if e != nil {
+		return e
+	}
+	_, e = t.Exec("DELETE FROM recovery_address WHERE identity = $1", identity)
 	return e
 }
 
-func (s *Store) insertRecoveryAddresses(t *sql.Tx, identity string, a []model.RecoveryAddress) error {
+// lockVersion returns current identity version and locks identity row until transaction end
+func (s *Store) lockVersion(t *sqlx.Tx, id string) (int64, error) {
+	var v int64
+	e := t.QueryRow("SELECT version FROM identity WHERE id = $1 FOR UPDATE", id).Scan(&v)
+	return v, e
+}
+
+func (s *Store) insertRecoveryAddresses(t *sqlx.Tx, identity string, a []model.RecoveryAddress) error {
 	cnt := len(a)
-	q := "INSERT INTO recovery_address (id, value, via, identity) VALUES "
+	q := "INSERT INTO recovery_address (id, value, via, identity, created_at, updated_at) VALUES "
 	p := []interface{}{}
 	for index, a := range a {
-		pos := index * 4
-		q += fmt.Sprintf("($%d,$%d,$%d,$%d)", pos+1, pos+2, pos+3, pos+4)
+		pos := index * 6
+		q += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d)", pos+1, pos+2, pos+3, pos+4, pos+5, pos+6)
 		if index != cnt-1 {
 			q += ","
 		}
-		p = append(p, a.ID, a.Value, a.Via, identity)
+		p = append(p, a.ID, a.Value, a.Via, identity, a.CreatedAt, a.UpdatedAt)
 	}
 	_, e := t.Exec(q, p...)
 	return e
 }
 
-func (s *Store) insertVerifiableAddresses(t *sql.Tx, identity string, a []model.VerifiableAddress) error {
+func (s *Store) insertVerifiableAddresses(t *sqlx.Tx, identity string, a []model.VerifiableAddress) error {
 	cnt := len(a)
-	q := "INSERT INTO verifiable_address (id, value, via, verified, verified_at, expires_at, identity) VALUES "
+	q := "INSERT INTO verifiable_address (id, value, via, verified, verified_at, expires_at, identity, created_at, updated_at) VALUES "
 	p := []interface{}{}
 	for index, a := range a {
-		pos := index * 7
-		q += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d)", pos+1, pos+2, pos+3, pos+4, pos+5, pos+6, pos+7)
+		pos := index * 9
+		q += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d,$%d,$%d)", pos+1, pos+2, pos+3, pos+4, pos+5, pos+6, pos+7, pos+8, pos+9)
 		if index != cnt-1 {
 			q += ","
 		}
-		p = append(p, a.ID, a.Value, a.Via, a.Verified, a.VerifiedAt, a.ExpiresAt, identity)
+		p = append(p, a.ID, a.Value, a.Via, a.Verified, a.VerifiedAt, a.ExpiresAt, identity, a.CreatedAt, a.UpdatedAt)
 	}
 	_, e := t.Exec(q, p...)
 	return e
 }
 
-func (s *Store) findIdentity(id string, identities []model.Identity) (model.Identity, error) {
-	for _, i := range identities {
-		if i.ID == id {
-			return i, nil
+// queryFilter builds WHERE clause of selectIdentities query and its arguments
+func queryFilter(q model.IdentityQuery) (string, []interface{}) {
+	cond := []string{}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q.After != "" {
+		cond = append(cond, "i.id > "+arg(q.After))
+	}
+	if q.SchemaID != "" {
+		cond = append(cond, "i.schema_id = "+arg(q.SchemaID))
+	}
+	if q.HasAddressFilter() {
+		address := ""
+		if q.Address != "" {
+			address += " AND a.value = " + arg(q.Address)
 		}
+		if q.Via != "" {
+			address += " AND a.via = " + arg(q.Via)
+		}
+		exists := "EXISTS (SELECT 1 FROM %s a WHERE a.identity = i.id%s)"
+		if q.Verified != nil {
+			address += " AND a.verified = " + arg(*q.Verified)
+			cond = append(cond, fmt.Sprintf(exists, "verifiable_address", address))
+		} else {
+			cond = append(cond, fmt.Sprintf("("+exists+" OR "+exists+")", "verifiable_address", address, "recovery_address", address))
+		}
+	}
+	if len(cond) == 0 {
+		return "", args
 	}
-	return model.Identity{}, fmt.Errorf("not found")
+	return " WHERE " + strings.Join(cond, " AND "), args
 }
 
-func (s *Store) mapIdentityEntities(identities []model.Identity, verifiableAddresses []model.VerifiableAddress, recoveryAddresses []model.RecoveryAddress) []model.Identity {
-	iMap := map[string]model.Identity{}
-	for _, a := range verifiableAddresses {
-		_, ok := iMap[a.Identity]
-		if !ok {
-			i, _ := s.findIdentity(a.Identity, identities)
-			iMap[a.Identity] = i
-		}
-		va := iMap[a.Identity].VerifiableAddresses
-		va = append(va, a)
+func (r identityRow) toIdentity() (model.Identity, error) {
+	i := r.Identity
+	if e := json.Unmarshal(r.RecoveryAddressesJSON, &i.RecoveryAddresses); e != nil {
+		return i, e
 	}
-	for _, a := range recoveryAddresses {
-		_, ok := iMap[a.Identity]
-		if !ok {
-			i, _ := s.findIdentity(a.Identity, identities)
-			iMap[a.Identity] = i
-		}
-		ra := iMap[a.Identity].RecoveryAddresses
-		ra = append(ra, a)
+	if e := json.Unmarshal(r.VerifiableAddressesJSON, &i.VerifiableAddresses); e != nil {
+		return i, e
+	}
+	for n := range i.RecoveryAddresses {
+		i.RecoveryAddresses[n].Identity = i.ID
+	}
+	for n := range i.VerifiableAddresses {
+		i.VerifiableAddresses[n].Identity = i.ID
 	}
+	return i, nil
+}
 
-	result := []model.Identity{}
-	for _, i := range identities {
-		if mappedIdentity, ok := iMap[i.ID]; ok {
-			result = append(result, mappedIdentity)
-		} else {
-			result = append(result, i)
+func mapIdentityRows(rows []identityRow) ([]model.Identity, error) {
+	result := make([]model.Identity, len(rows))
+	for n, r := range rows {
+		i, e := r.toIdentity()
+		if e != nil {
+			return nil, e
 		}
+		result[n] = i
 	}
-	return result
+	return result, nil
 }
 
-func (s *Store) execTxChain(operations ...func(*sql.Tx) error) error {
-	t, e := s.db.Begin()
+func (s *Store) execTxChain(operations ...func(*sqlx.Tx) error) error {
+	t, e := s.db.Beginx()
 	if e != nil {
 		return e
 	}
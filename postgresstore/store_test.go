@@ -4,12 +4,16 @@ import (
 	"database/sql"
 	"fmt"
 	"math/rand"
+	"os"
 	"strconv"
 	"testing"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
+	"github.com/trapck/kr.api/appconfig"
 	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/server"
+	"github.com/trapck/kr.api/storetest"
 	"github.com/trapck/kr.api/testutil"
 
 	"github.com/stretchr/testify/assert"
@@ -23,6 +27,30 @@ func TestList(t *testing.T) {
 	actual, err := db.List()
 	testutil.FailOnNotEqual(t, err, nil, "expected db operation to be finished with no errors")
 	assert.Equal(t, len(expected), len(actual), "result list count doesn't match desired count")
+
+	t.Run("should return identities with addresses", func(t *testing.T) {
+		sessionID := createSessionID()
+		defer clearAllTestData(db, sessionID)
+		input := storetest.NewIdentity()
+		input.SchemaID = sessionID
+		for n := range input.RecoveryAddresses {
+			input.RecoveryAddresses[n].Value = sessionID
+		}
+		for n := range input.VerifiableAddresses {
+			input.VerifiableAddresses[n].Value = sessionID
+		}
+		_, err := db.Create(input)
+		testutil.FailOnNotEqual(t, err, nil, "error when inserting identity for comparison")
+		actual, err := db.List()
+		testutil.FailOnNotEqual(t, err, nil, "expected db operation to be finished with no errors")
+		for _, i := range actual {
+			if i.ID == input.ID {
+				storetest.AssertIdentity(t, input, i, "listed identity must contain all addresses")
+				return
+			}
+		}
+		assert.FailNow(t, "expected to find created identity in list")
+	})
 }
 
 func TestCreate(t *testing.T) {
@@ -62,7 +90,8 @@ func TestCreate(t *testing.T) {
 	}
 	output, err := db.Create(input)
 	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
-	assert.Equal(t, input, output, fmt.Sprintf("created identity must be equal to input"))
+	assert.Equal(t, int64(1), output.Version, "created identity must have initial version")
+	storetest.AssertIdentity(t, input, output, "created identity must be equal to input")
 	var found model.Identity
 	err = db.db.Get(&found, "SELECT * FROM identity WHERE id = $1", output.ID)
 	assert.NoError(t, err, fmt.Sprintf("expected to find identity in db"))
@@ -80,6 +109,10 @@ func TestGet(t *testing.T) {
 		SchemaID:            sessionID,
 		RecoveryAddresses:   []model.RecoveryAddress{model.RecoveryAddress{Address: model.Address{ID: id, Value: sessionID}, Identity: id}},
 		VerifiableAddresses: []model.VerifiableAddress{model.VerifiableAddress{Address: model.Address{ID: id, Value: sessionID}, Identity: id}},
+		Traits:              model.JSONObject{},
+		MetadataPublic:      model.JSONObject{},
+		MetadataAdmin:       model.JSONObject{},
+		Version:             1,
 	}
 
 	db.db.Exec("INSERT INTO identity (id, schema_id) VALUES ($1, $2)", id, sessionID)
@@ -87,7 +120,7 @@ func TestGet(t *testing.T) {
 	db.db.Exec("INSERT INTO verifiable_address (id, value, identity) VALUES ($1, $2, $3)", id, sessionID, id)
 	found, err := db.Get(id)
 	testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
-	assert.Equal(t, data, found, "expected to find identity in db with desired struct")
+	storetest.AssertIdentity(t, data, found, "expected to find identity in db with desired struct")
 }
 
 func TestDelete(t *testing.T) {
@@ -100,17 +133,29 @@ func TestDelete(t *testing.T) {
 	db.db.Exec("INSERT INTO identity (id, schema_id) VALUES ($1, $2)", id, sessionID)
 	db.db.Exec("INSERT INTO recovery_address (id, value, identity) VALUES ($1, $2, $3)", id, sessionID, id)
 	db.db.Exec("INSERT INTO verifiable_address (id, value, identity) VALUES ($1, $2, $3)", id, sessionID, id)
-	err := db.Delete(id)
+	err := db.Delete(id, 0)
 	testutil.FailOnNotEqual(t, err, nil, "expected to delete identity without error")
 	found := model.Identity{}
 	err = db.db.Get(&found, "SELECT * FROM identity WHERE id = $1", id)
 	assert.Error(t, err, "expected identity to be not found in db")
 }
 
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) server.Store {
+		db := initDB(t)
+		t.Cleanup(func() { closeDB(t, db) })
+		return db
+	})
+}
+
 func initDB(t *testing.T) *Store {
 	t.Helper()
+	cfg, _, err := appconfig.Load(nil, os.LookupEnv)
+	if err != nil {
+		assert.FailNow(t, "config was not loaded. ", err)
+	}
 	db := Store{}
-	err := db.Init()
+	err = db.Init(cfg.Postgres)
 	if err != nil {
 		assert.FailNow(t, "db connection was not established. ", err)
 	}
@@ -0,0 +1,37 @@
+package postgresstore
+
+import (
+	"github.com/trapck/kr.api/model"
+)
+
+// SaveVerificationCode inserts or replaces verification code of the address
+func (s *Store) SaveVerificationCode(v model.VerificationCode) error {
+	_, e := s.db.Exec(
+		`INSERT INTO verification_code (address_id, identity_id, code_hash, attempts, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (address_id) DO UPDATE SET identity_id = EXCLUDED.identity_id, code_hash = EXCLUDED.code_hash,
+				attempts = EXCLUDED.attempts, expires_at = EXCLUDED.expires_at, created_at = EXCLUDED.created_at`,
+		v.AddressID, v.IdentityID, v.CodeHash, v.Attempts, v.ExpiresAt, v.CreatedAt,
+	)
+	return e
+}
+
+// GetVerificationCode returns pending verification code of the address
+func (s *Store) GetVerificationCode(addressID string) (model.VerificationCode, error) {
+	v := model.VerificationCode{}
+	e := s.db.Get(&v, "SELECT * FROM verification_code WHERE address_id = $1", addressID)
+	return v, e
+}
+
+// IncrementVerificationAttempts atomically counts an attempt to use verification code of the address and returns the code
+func (s *Store) IncrementVerificationAttempts(addressID string) (model.VerificationCode, error) {
+	v := model.VerificationCode{}
+	e := s.db.Get(&v, "UPDATE verification_code SET attempts = attempts + 1 WHERE address_id = $1 RETURNING *", addressID)
+	return v, e
+}
+
+// DeleteVerificationCode deletes verification code of the address if any
+func (s *Store) DeleteVerificationCode(addressID string) error {
+	_, e := s.db.Exec("DELETE FROM verification_code WHERE address_id = $1", addressID)
+	return e
+}
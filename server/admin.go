@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+)
+
+// localKeyAdmin is a request local marking requests served by admin routes
+const localKeyAdmin = "admin"
+
+// markAdmin marks requests of admin routes, which can read and change admin metadata of identities
+func markAdmin(c *fiber.Ctx) {
+	c.Locals(localKeyAdmin, true)
+	c.Next()
+}
+
+func isAdmin(c *fiber.Ctx) bool {
+	admin, _ := c.Locals(localKeyAdmin).(bool)
+	return admin
+}
+
+// publicView returns identity without fields hidden from public routes
+func publicView(i model.Identity) model.Identity {
+	i.MetadataAdmin = nil
+	return i
+}
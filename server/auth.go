@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/auth"
+	"github.com/trapck/kr.api/model"
+)
+
+// localKeyPrincipal is a request local holding the authenticated API client
+const localKeyPrincipal = "principal"
+
+var errForbidden = errors.New("the caller is not allowed to perform the operation")
+
+// authenticate rejects requests without valid API key or JWT in the Authorization header
+// and keeps the authenticated principal in request locals
+func (a *IdentApp) authenticate(c *fiber.Ctx) {
+	p, err := a.authenticator.Authenticate(c.Get(HeaderKeyAuthorization), a.now())
+	if err != nil {
+		c.Set(HeaderKeyWWWAuthenticate, `Bearer realm="kr.api"`)
+		writeError(c, http.StatusUnauthorized, err)
+		return
+	}
+	c.Locals(localKeyPrincipal, p)
+	c.Next()
+}
+
+// principal returns the API client authenticated by authenticate middleware
+func principal(c *fiber.Ctx) (auth.Principal, bool) {
+	p, ok := c.Locals(localKeyPrincipal).(auth.Principal)
+	return p, ok
+}
+
+// requireScope rejects requests of principals which weren't granted the scope
+func requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) {
+		if p, ok := principal(c); !ok || !p.HasScope(scope) {
+			e := model.NewGenericErrorWrap(http.StatusForbidden, errForbidden)
+			e.Error.Reason = fmt.Sprintf("scope %s is required", scope)
+			c.JSON(e)
+			c.Status(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/auth"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+)
+
+func TestAuthentication(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, ioutil.WriteFile(jwks, []byte(fmt.Sprintf(`{"keys":[{"kty":"oct","kid":"k1","k":%q}]}`, base64.RawURLEncoding.EncodeToString(secret))), 0600))
+	cfg := appconfig.Default()
+	cfg.IdentitySchemas = map[string]string{"other": "../model/schema.json"}
+	cfg.Auth.APIKeys = []appconfig.APIKeyConfig{
+		{Name: "test", Hash: auth.HashAPIKey(testAPIKey), Scopes: []string{auth.ScopeAdmin}},
+		{Name: "analytics", Hash: auth.HashAPIKey("analytics-key"), Scopes: []string{auth.ScopeIdentitiesRead}},
+	}
+	cfg.Auth.JWT.JWKSFile = jwks
+	srv, err := NewApp(&memstore.Store{}, cfg)
+	require.NoError(t, err)
+	now := time.Now()
+	srv.now = func() time.Time { return now }
+	// self-service routes of public router don't require credentials and are covered by their own tests
+	const body = `{"address":"alice@example.com","via":"email"}`
+	jwt := func(exp time.Time) string {
+		enc := base64.RawURLEncoding
+		signed := enc.EncodeToString([]byte(`{"alg":"HS256","kid":"k1"}`)) + "." +
+			enc.EncodeToString([]byte(fmt.Sprintf(`{"sub":"service-a","exp":%d,"scope":"identities:read"}`, exp.Unix())))
+		m := hmac.New(sha256.New, secret)
+		m.Write([]byte(signed))
+		return signed + "." + enc.EncodeToString(m.Sum(nil))
+	}
+
+	t.Run("should reject requests without valid credentials", func(t *testing.T) {
+		for _, path := range []string{"/identities", "/admin/identities"} {
+			for _, authorization := range []string{"", "Bearer wrong-key", "Basic " + testAPIKey, "Bearer " + jwt(now.Add(-time.Hour))} {
+				resp := sendRequest(t, srv.admin, http.MethodGet, path, body, map[string]string{HeaderKeyAuthorization: authorization})
+				assertErrorJSONResponse(t, http.StatusUnauthorized, resp)
+				assert.Contains(t, resp.Header.Get(HeaderKeyWWWAuthenticate), "Bearer")
+			}
+		}
+		assertErrorJSONResponse(t, http.StatusUnauthorized, sendRequest(t, srv.admin, http.MethodDelete, "/identities/"+uuid.NewV4().String(), body, nil))
+	})
+	t.Run("should accept api key", func(t *testing.T) {
+		assertStatus(t, http.StatusOK, sendRequest(t, srv.admin, http.MethodGet, "/identities", body, map[string]string{HeaderKeyAuthorization: "Bearer " + testAPIKey}).StatusCode, "with api key")
+		assertStatus(t, http.StatusOK, sendRequest(t, srv.admin, http.MethodGet, "/admin/identities", body, map[string]string{HeaderKeyAuthorization: "bearer " + testAPIKey}).StatusCode, "with api key")
+	})
+	t.Run("should accept jwt", func(t *testing.T) {
+		assertStatus(t, http.StatusOK, sendRequest(t, srv.admin, http.MethodGet, "/identities", body, map[string]string{HeaderKeyAuthorization: "Bearer " + jwt(now.Add(time.Hour))}).StatusCode, "with jwt")
+	})
+	t.Run("should enforce scopes per route", func(t *testing.T) {
+		for _, c := range []struct{ method, path, scope string }{
+			{http.MethodDelete, "/identities/" + uuid.NewV4().String(), auth.ScopeIdentitiesDelete},
+			{http.MethodPost, "/identities", auth.ScopeIdentitiesWrite},
+			{http.MethodPatch, "/identities/" + uuid.NewV4().String(), auth.ScopeIdentitiesWrite},
+			{http.MethodGet, "/admin/identities", auth.ScopeAdmin},
+		} {
+			for _, authorization := range []string{"Bearer analytics-key", "Bearer " + jwt(now.Add(time.Hour))} {
+				resp := sendRequest(t, srv.admin, c.method, c.path, body, map[string]string{HeaderKeyAuthorization: authorization})
+				assertStatus(t, http.StatusForbidden, resp.StatusCode, c.method+" "+c.path)
+				var e model.GenericErrorWrap
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+				assert.Equal(t, http.StatusForbidden, e.Error.Code)
+				assert.Contains(t, e.Error.Reason, c.scope)
+			}
+		}
+		assertStatus(t, http.StatusOK, sendRequest(t, srv.admin, http.MethodGet, "/identities", body, map[string]string{HeaderKeyAuthorization: "Bearer analytics-key"}).StatusCode, "with read scope")
+		assertStatus(t, http.StatusNotFound, sendRequest(t, srv.admin, http.MethodDelete, "/identities/"+uuid.NewV4().String(), body, map[string]string{HeaderKeyAuthorization: "Bearer " + testAPIKey}).StatusCode, "with admin scope")
+	})
+}
@@ -2,11 +2,33 @@ package server
 
 // Constants for http header keys
 const (
-	HeaderKeyContentType   = "Content-Type"
-	HeaderKeyAuthorization = "Authorization"
+	HeaderKeyContentType     = "Content-Type"
+	HeaderKeyAuthorization   = "Authorization"
+	HeaderKeyNextPageToken   = "X-Next-Page-Token"
+	HeaderKeyETag            = "ETag"
+	HeaderKeyIfMatch         = "If-Match"
+	HeaderKeyIfNoneMatch     = "If-None-Match"
+	HeaderKeyLocation        = "Location"
+	HeaderKeySessionToken    = "X-Session-Token"
+	HeaderKeyUserAgent       = "User-Agent"
+	HeaderKeyWWWAuthenticate = "WWW-Authenticate"
 )
 
 // Constants for http header values
 const (
-	HeaderValueJSONContactType = "application/json"
+	HeaderValueJSONContactType           = "application/json"
+	HeaderValueMergePatchJSONContentType = "application/merge-patch+json"
+	HeaderValueJSONPatchJSONContentType  = "application/json-patch+json"
+)
+
+// Constants for query parameter keys
+const (
+	QueryKeyPageSize   = "page_size"
+	QueryKeyPageToken  = "page_token"
+	QueryKeyAddress    = "address"
+	QueryKeyVia        = "via"
+	QueryKeyVerified   = "verified"
+	QueryKeySchemaID   = "schema_id"
+	QueryKeyIdentityID = "identity_id"
+	QueryKeyStatus     = "status"
 )
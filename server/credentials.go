@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/hasher"
+	"github.com/trapck/kr.api/model"
+)
+
+// maxPasswordLength limits work spent on hashing a single password
+const maxPasswordLength = 1024
+
+var (
+	errInvalidCredentials        = errors.New("invalid identifier or password")
+	errPrivilegedSessionRequired = errors.New("privileged session is required")
+	errNoPasswordIdentifiers     = errors.New("identity has no password identifiers")
+)
+
+// HandlePutPassword sets password credentials of identity. Identifiers are compared case-insensitively
+func (a *IdentApp) HandlePutPassword(c *fiber.Ctx) {
+	id, valid := extractIDParam(c)
+	if !valid {
+		return
+	}
+	var r model.PasswordRequest
+	if err := json.Unmarshal([]byte(c.Body()), &r); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	identifiers := normalizeIdentifiers(r.Identifiers)
+	if len(identifiers) == 0 {
+		writeError(c, http.StatusBadRequest, errors.New("identifiers must not be empty"))
+		return
+	}
+	if err := a.checkPassword(r.Password); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	i, err := a.store.Get(id)
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	if err = a.putPassword(i, identifiers, r.Password); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// HandleResetPassword sets a new password of the identity of a privileged session, e.g. one issued by recovery.
+// Password identifiers are kept and all other sessions of the identity are revoked
+func (a *IdentApp) HandleResetPassword(c *fiber.Ctx) {
+	var r model.PasswordResetRequest
+	if err := json.Unmarshal([]byte(c.Body()), &r); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.checkPassword(r.Password); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	s, i, ok := a.currentSession(c)
+	if !ok {
+		return
+	}
+	if !s.Privileged {
+		writeError(c, http.StatusForbidden, errPrivilegedSessionRequired)
+		return
+	}
+	cred, ok := i.Credentials[model.CredentialsPassword]
+	if !ok || len(cred.Identifiers) == 0 {
+		writeError(c, http.StatusConflict, errNoPasswordIdentifiers)
+		return
+	}
+	if err := a.putPassword(i, cred.Identifiers, r.Password); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	if err := a.store.DeleteOtherSessions(i.ID, s.TokenHash); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// checkPassword returns an error when password length is out of configured bounds
+func (a *IdentApp) checkPassword(password string) error {
+	if n := utf8.RuneCountInString(password); n < a.cfg.Password.MinLength || n > maxPasswordLength {
+		return fmt.Errorf("password length must be from %d to %d", a.cfg.Password.MinLength, maxPasswordLength)
+	}
+	if a.cfg.Password.Algorithm == appconfig.BcryptHash && len(password) > hasher.BcryptMaxPasswordBytes {
+		return fmt.Errorf("password must not be longer than %d bytes", hasher.BcryptMaxPasswordBytes)
+	}
+	return nil
+}
+
+// putPassword hashes password and stores it as password credentials of the identity with the identifiers
+func (a *IdentApp) putPassword(i model.Identity, identifiers []string, password string) error {
+	hash, err := a.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	now := a.now().UTC().Truncate(time.Millisecond)
+	cred := model.Credentials{
+		IdentityID:  i.ID,
+		Type:        model.CredentialsPassword,
+		Identifiers: identifiers,
+		Config:      model.JSONObject{model.PasswordConfigKey: hash},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if previous, ok := i.Credentials[model.CredentialsPassword]; ok {
+		cred.CreatedAt = previous.CreatedAt
+	}
+	return a.store.PutCredentials(cred)
+}
+
+// authenticatePassword returns identity having password credentials with the identifier and password.
+// Hashes made with other algorithm or parameters than configured are replaced by a new hash.
+// Unknown identifiers are rejected after a password comparison too, so response time doesn't reveal them
+func (a *IdentApp) authenticatePassword(identifier, password string) (model.Identity, error) {
+	cred, err := a.store.FindCredentials(model.CredentialsPassword, normalizeIdentifier(identifier))
+	if err != nil && a.store.NoRows(err) {
+		hasher.Compare(password, a.dummyHash)
+		return model.Identity{}, errInvalidCredentials
+	} else if err != nil {
+		return model.Identity{}, err
+	}
+	hash := cred.HashedPassword()
+	if err = hasher.Compare(password, hash); err == hasher.ErrMismatch {
+		return model.Identity{}, errInvalidCredentials
+	} else if err != nil {
+		return model.Identity{}, err
+	}
+	i, err := a.store.Get(cred.IdentityID)
+	if err != nil {
+		return i, err
+	}
+	if a.hasher.NeedsRehash(hash) {
+		if err = a.rehashPassword(cred, password); err != nil {
+			log.Printf("could not upgrade password hash of identity %s: %v", i.ID, err)
+		}
+	}
+	return i, nil
+}
+
+func (a *IdentApp) rehashPassword(cred model.Credentials, password string) error {
+	hash, err := a.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	cred.Config = cred.Config.Copy()
+	cred.Config[model.PasswordConfigKey] = hash
+	cred.UpdatedAt = a.now().UTC().Truncate(time.Millisecond)
+	return a.store.PutCredentials(cred)
+}
+
+// normalizeIdentifiers returns distinct not empty normalized identifiers
+func normalizeIdentifiers(l []string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, v := range l {
+		if v = normalizeIdentifier(v); v != "" && !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func normalizeIdentifier(v string) string {
+	return strings.ToLower(strings.TrimSpace(v))
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/hasher"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+)
+
+func TestPasswordCredentials(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	i, _ := store.Create(model.Identity{ID: uuid.NewV4().String()})
+	other, _ := store.Create(model.Identity{ID: uuid.NewV4().String()})
+	put := func(id, body string) *http.Response {
+		return sendRequest(t, srv.admin, http.MethodPut, "/admin/identities/"+id+"/credentials/password", body, adminHeaders(nil))
+	}
+
+	t.Run("should set hashed password", func(t *testing.T) {
+		assertStatus(t, http.StatusNoContent, put(i.ID, `{"identifiers":[" Alice@Example.com ","alice@example.com"],"password":"correct horse"}`).StatusCode, "")
+		found, err := store.Get(i.ID)
+		require.NoError(t, err)
+		cred := found.Credentials[model.CredentialsPassword]
+		assert.Equal(t, []string{"alice@example.com"}, cred.Identifiers, "expected identifiers to be normalized")
+		assert.NoError(t, hasher.Compare("correct horse", cred.HashedPassword()))
+	})
+	t.Run("should not serialize credentials", func(t *testing.T) {
+		for _, path := range []string{"/identities/" + i.ID, "/admin/identities/" + i.ID, "/admin/identities"} {
+			resp := sendRequest(t, srv.admin, http.MethodGet, path, "", adminHeaders(nil))
+			assertStatus(t, http.StatusOK, resp.StatusCode, path)
+			b, _ := ioutil.ReadAll(resp.Body)
+			assert.NotContains(t, string(b), "credentials", path)
+			assert.NotContains(t, string(b), "argon2id", path)
+		}
+	})
+	t.Run("should keep credentials on identity update", func(t *testing.T) {
+		resp := sendRequest(t, srv.admin, http.MethodPut, "/admin/identities/"+i.ID, fmt.Sprintf(`{"id":%q,"traits":{"email":"alice@example.com"}}`, i.ID), adminHeaders(nil))
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+		found, _ := store.Get(i.ID)
+		assert.Contains(t, found.Credentials, model.CredentialsPassword)
+	})
+	t.Run("should reject identifier of other identity", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusConflict, put(other.ID, `{"identifiers":["alice@example.com"],"password":"correct horse"}`))
+	})
+	t.Run("should reject invalid request", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusBadRequest, put(other.ID, `{"identifiers":["bob"],"password":"short"}`))
+		assertErrorJSONResponse(t, http.StatusBadRequest, put(other.ID, `{"identifiers":[" "],"password":"correct horse"}`))
+		assertErrorJSONResponse(t, http.StatusBadRequest, put(other.ID, `{`))
+		assertErrorJSONResponse(t, http.StatusNotFound, put(uuid.NewV4().String(), `{"identifiers":["bob"],"password":"correct horse"}`))
+	})
+	t.Run("should reject password longer than bcrypt takes into account", func(t *testing.T) {
+		long := strings.Repeat("a", hasher.BcryptMaxPasswordBytes+1)
+		assertStatus(t, http.StatusNoContent, put(other.ID, fmt.Sprintf(`{"identifiers":["bob"],"password":%q}`, long)).StatusCode, "argon2id takes whole password into account")
+		srv.cfg.Password.Algorithm = appconfig.BcryptHash
+		defer func() { srv.cfg.Password.Algorithm = appconfig.Argon2idHash }()
+		assertErrorJSONResponse(t, http.StatusBadRequest, put(other.ID, fmt.Sprintf(`{"identifiers":["bob"],"password":%q}`, long)))
+	})
+	t.Run("should not be served by public API", func(t *testing.T) {
+		resp := sendRequest(t, srv.admin, http.MethodPut, "/identities/"+other.ID+"/credentials/password", `{"identifiers":["bob"],"password":"correct horse"}`, adminHeaders(nil))
+		assertStatus(t, http.StatusNotFound, resp.StatusCode, "")
+	})
+	t.Run("should authenticate password", func(t *testing.T) {
+		found, err := srv.authenticatePassword("ALICE@example.com", "correct horse")
+		require.NoError(t, err)
+		assert.Equal(t, i.ID, found.ID)
+		_, err = srv.authenticatePassword("alice@example.com", "wrong horse")
+		assert.Equal(t, errInvalidCredentials, err)
+		_, err = srv.authenticatePassword("nobody@example.com", "correct horse")
+		assert.Equal(t, errInvalidCredentials, err)
+	})
+	t.Run("should upgrade hash parameters on login", func(t *testing.T) {
+		srv.hasher = hasher.NewBcrypt(4)
+		assertStatus(t, http.StatusNoContent, put(other.ID, `{"identifiers":["bob"],"password":"correct horse"}`).StatusCode, "")
+		cfg := appconfig.Default().Password
+		cfg.Argon2.Memory = 1024
+		srv.hasher, _ = hasher.New(cfg)
+		_, err := srv.authenticatePassword("bob", "correct horse")
+		require.NoError(t, err)
+		found, _ := store.Get(other.ID)
+		hash := found.Credentials[model.CredentialsPassword].HashedPassword()
+		assert.True(t, strings.HasPrefix(hash, "$argon2id$"), "expected bcrypt hash to be replaced, got %s", hash)
+		assert.NoError(t, hasher.Compare("correct horse", hash))
+	})
+}
+
+func TestResetPassword(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	i, _ := store.Create(model.Identity{ID: uuid.NewV4().String()})
+	bare, _ := store.Create(model.Identity{ID: uuid.NewV4().String()})
+	hash, err := srv.hasher.Hash("correct horse")
+	require.NoError(t, err)
+	require.NoError(t, store.PutCredentials(model.Credentials{
+		IdentityID:  i.ID,
+		Type:        model.CredentialsPassword,
+		Identifiers: []string{"alice@example.com"},
+		Config:      model.JSONObject{model.PasswordConfigKey: hash},
+	}))
+	session := func(identityID string, privileged bool) string {
+		token := uuid.NewV4().String()
+		require.NoError(t, store.CreateSession(model.Session{
+			ID:         uuid.NewV4().String(),
+			TokenHash:  hashSecret(sessionSubject, token),
+			IdentityID: identityID,
+			Privileged: privileged,
+			AAL:        model.AAL1,
+			ExpiresAt:  srv.now().Add(time.Hour),
+		}))
+		return token
+	}
+	reset := func(password, token string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/settings/password", fmt.Sprintf(`{"password":%q}`, password), sessionHeaders(token))
+	}
+	login := func(password string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/sessions", fmt.Sprintf(`{"identifier":"alice@example.com","password":%q}`, password), nil)
+	}
+	privileged, other, unprivileged := session(i.ID, true), session(i.ID, false), session(i.ID, false)
+
+	t.Run("should require session", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnauthorized, reset("battery staple", ""))
+	})
+	t.Run("should require privileged session", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusForbidden, reset("battery staple", unprivileged))
+		assertStatus(t, http.StatusCreated, login("correct horse").StatusCode, "expected password to be kept")
+	})
+	t.Run("should reject invalid password", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusBadRequest, reset("short", privileged))
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/settings/password", "{", sessionHeaders(privileged)))
+	})
+	t.Run("should reject identity without password identifiers", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusConflict, reset("battery staple", session(bare.ID, true)))
+	})
+	t.Run("should set password and revoke other sessions", func(t *testing.T) {
+		assertStatus(t, http.StatusNoContent, reset("battery staple", privileged).StatusCode, "")
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login("correct horse"))
+		assertStatus(t, http.StatusCreated, login("battery staple").StatusCode, "expected new password to be accepted")
+		found, err := store.Get(i.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"alice@example.com"}, found.Credentials[model.CredentialsPassword].Identifiers, "expected identifiers to be kept")
+		for _, token := range []string{other, unprivileged} {
+			_, err := store.GetSession(hashSecret(sessionSubject, token))
+			assert.True(t, store.NoRows(err), "expected other sessions to be revoked")
+		}
+		_, err = store.GetSession(hashSecret(sessionSubject, privileged))
+		assert.NoError(t, err, "expected resetting session to be kept")
+	})
+}
@@ -1,27 +1,53 @@
 package server
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
-	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/identityschema"
 	"github.com/trapck/kr.api/model"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/gofiber/fiber"
 	uuid "github.com/satori/go.uuid"
 	"github.com/xeipuuv/gojsonschema"
 )
 
-var identityJSONSchema = gojsonschema.NewReferenceLoader(appconfig.IdentityJSONSchemaPath)
+var errVersionMismatch = fmt.Errorf("identity version doesn't match %s header", HeaderKeyIfMatch)
 
-//HandleList handles list all identities request
+// errResponseWritten stops request handling when error response is already written
+var errResponseWritten = errors.New("response is written")
+
+//HandleList handles list identities page request
 func (a *IdentApp) HandleList(c *fiber.Ctx) {
-	l, err := a.store.List()
+	q, valid := a.extractPageQuery(c)
+	if !valid {
+		return
+	}
+	pageSize := q.Limit
+	q.Limit++
+	l, err := a.store.ListPage(q)
 	if err != nil {
 		writeError(c, a.statusFromDBErr(err), err)
 		return
 	}
+	if len(l) > pageSize {
+		l = l[:pageSize]
+		token := encodePageToken(l[pageSize-1].ID)
+		c.Set(HeaderKeyNextPageToken, token)
+		c.Links(nextPageLink(c, pageSize, token), "next")
+	}
+	if !isAdmin(c) {
+		for n := range l {
+			l[n] = publicView(l[n])
+		}
+	}
 	writeSuccess(c, http.StatusOK, l)
 }
 
@@ -36,7 +62,12 @@ func (a *IdentApp) HandleGet(c *fiber.Ctx) {
 		writeError(c, a.statusFromDBErr(err), err)
 		return
 	}
-	writeSuccess(c, http.StatusOK, i)
+	c.Set(HeaderKeyETag, formatETag(i.Version))
+	if noneMatch(c.Get(HeaderKeyIfNoneMatch), i.Version) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	writeIdentity(c, http.StatusOK, i)
 }
 
 //HandleDelete handles delete identitiy request
@@ -45,7 +76,11 @@ func (a *IdentApp) HandleDelete(c *fiber.Ctx) {
 	if !valid {
 		return
 	}
-	err := a.store.Delete(id)
+	version, valid := extractIfMatch(c)
+	if !valid {
+		return
+	}
+	err := a.store.Delete(id, version)
 	if err != nil {
 		writeError(c, a.statusFromDBErr(err), err)
 		return
@@ -53,36 +88,150 @@ func (a *IdentApp) HandleDelete(c *fiber.Ctx) {
 	c.Status(http.StatusNoContent)
 }
 
-//HandleCreate handles create identitiy request
+//HandleCreate handles create identitiy request. Identity id is generated when not provided
 func (a *IdentApp) HandleCreate(c *fiber.Ctx) {
 	var i model.Identity
-	if !parseIdentity(c, &i) {
+	if !a.parseIdentity(c, &i) {
 		return
 	}
+	if i.ID == "" {
+		i.ID = uuid.NewV4().String()
+	}
+	if !isAdmin(c) {
+		i.MetadataAdmin = nil
+	}
 	i, err := a.store.Create(i)
 	if err != nil {
 		writeError(c, a.statusFromDBErr(err), err)
 		return
 	}
-	writeSuccess(c, http.StatusCreated, i)
+	c.Set(HeaderKeyETag, formatETag(i.Version))
+	c.Set(HeaderKeyLocation, strings.TrimSuffix(c.Path(), "/")+"/"+i.ID)
+	writeIdentity(c, http.StatusCreated, i)
 }
 
-//HandleUpdate handles update identitiy request
+//HandleUpdate handles update identitiy request. Identity keeps its id when it is not provided.
+//Public requests can't change admin metadata, so it is taken from the stored identity
 func (a *IdentApp) HandleUpdate(c *fiber.Ctx) {
 	id, valid := extractIDParam(c)
 	if !valid {
 		return
 	}
+	expected, valid := extractIfMatch(c)
+	if !valid {
+		return
+	}
 	var i model.Identity
-	if !parseIdentity(c, &i) {
+	if !a.parseIdentity(c, &i) {
 		return
 	}
-	i, err := a.store.Update(id, i)
-	if err != nil {
-		writeError(c, a.statusFromDBErr(err), err)
+	if i.ID == "" {
+		i.ID = id
+	}
+	if isAdmin(c) {
+		i.Version = expected
+		i, err := a.store.Update(id, i)
+		if err != nil {
+			writeError(c, a.statusFromDBErr(err), err)
+			return
+		}
+		c.Set(HeaderKeyETag, formatETag(i.Version))
+		writeIdentity(c, http.StatusOK, i)
 		return
 	}
-	writeSuccess(c, http.StatusOK, i)
+	a.updateCurrent(c, id, expected, func(current model.Identity) (model.Identity, bool) {
+		i.MetadataAdmin = current.MetadataAdmin
+		return i, true
+	})
+}
+
+//HandlePatch handles partial update identitiy request in JSON Merge Patch or JSON Patch format.
+//Public requests patch identity without admin metadata
+func (a *IdentApp) HandlePatch(c *fiber.Ctx) {
+	id, valid := extractIDParam(c)
+	if !valid {
+		return
+	}
+	expected, valid := extractIfMatch(c)
+	if !valid {
+		return
+	}
+	apply, valid := extractPatch(c)
+	if !valid {
+		return
+	}
+	admin := isAdmin(c)
+	a.updateCurrent(c, id, expected, func(current model.Identity) (model.Identity, bool) {
+		doc := current
+		if !admin {
+			doc = publicView(current)
+		}
+		src, err := json.Marshal(doc)
+		if err != nil {
+			writeError(c, http.StatusInternalServerError, err)
+			return doc, false
+		}
+		patched, err := apply(src)
+		if err != nil {
+			writeError(c, http.StatusUnprocessableEntity, err)
+			return doc, false
+		}
+		p := model.Identity{}
+		if !a.parseIdentityJSON(c, string(patched), &p) {
+			return p, false
+		}
+		if !admin {
+			p.MetadataAdmin = current.MetadataAdmin
+		}
+		return p, true
+	})
+}
+
+// updateCurrent replaces the stored identity with the one built from it by change and writes it to response.
+// Change returns false when it has already written an error response
+func (a *IdentApp) updateCurrent(c *fiber.Ctx, id string, expected int64, change func(model.Identity) (model.Identity, bool)) {
+	i, err := a.modifyIdentity(id, expected, func(current model.Identity) (model.Identity, error) {
+		i, ok := change(current)
+		if !ok {
+			return i, errResponseWritten
+		}
+		return i, nil
+	})
+	switch {
+	case err == errResponseWritten:
+	case err == errVersionMismatch:
+		writeError(c, http.StatusPreconditionFailed, err)
+	case err != nil:
+		writeError(c, a.statusFromDBErr(err), err)
+	default:
+		c.Set(HeaderKeyETag, formatETag(i.Version))
+		writeIdentity(c, http.StatusOK, i)
+	}
+}
+
+// modifyIdentity replaces the stored identity with the one built from it by change.
+// Non zero expected version must match the stored one. Without expected version
+// the change is reapplied when identity is concurrently changed by other writer
+func (a *IdentApp) modifyIdentity(id string, expected int64, change func(model.Identity) (model.Identity, error)) (model.Identity, error) {
+	for attempt := 1; ; attempt++ {
+		current, err := a.store.Get(id)
+		if err != nil {
+			return current, err
+		}
+		if expected != 0 && expected != current.Version {
+			return current, errVersionMismatch
+		}
+		i, err := change(current)
+		if err != nil {
+			return i, err
+		}
+		i.Version = current.Version
+		i, err = a.store.Update(id, i)
+		if err != nil && a.store.VersionMismatch(err) && expected == 0 && attempt < a.cfg.MaxPatchAttempts {
+			continue
+		}
+		return i, err
+	}
 }
 
 func writeSuccess(c *fiber.Ctx, code int, data interface{}) {
@@ -90,6 +239,14 @@ func writeSuccess(c *fiber.Ctx, code int, data interface{}) {
 	c.Status(code)
 }
 
+// writeIdentity writes identity hiding admin metadata from public requests
+func writeIdentity(c *fiber.Ctx, code int, i model.Identity) {
+	if !isAdmin(c) {
+		i = publicView(i)
+	}
+	writeSuccess(c, code, i)
+}
+
 func writeError(c *fiber.Ctx, code int, e error) {
 	c.JSON(model.NewGenericErrorWrap(code, e))
 	c.Status(code)
@@ -99,11 +256,27 @@ func (a *IdentApp) statusFromDBErr(e error) int {
 	if a.store.NoRows(e) {
 		return http.StatusNotFound
 	}
+	if a.store.Duplicate(e) {
+		return http.StatusConflict
+	}
+	if a.store.VersionMismatch(e) {
+		return http.StatusPreconditionFailed
+	}
 	return http.StatusInternalServerError
 }
 
-func validateIdentityJSON(src string) (*gojsonschema.Result, error) {
-	return gojsonschema.Validate(identityJSONSchema, gojsonschema.NewStringLoader(src))
+// validateIdentityJSON validates identity against the schema referenced by its schema_id
+func (a *IdentApp) validateIdentityJSON(src string) (*gojsonschema.Result, error) {
+	ref := struct {
+		SchemaID string `json:"schema_id"`
+	}{}
+	if err := json.Unmarshal([]byte(src), &ref); err != nil {
+		return nil, err
+	}
+	if err := a.syncStoredSchema(ref.SchemaID); err != nil {
+		return nil, err
+	}
+	return a.schemas.Validate(ref.SchemaID, gojsonschema.NewStringLoader(src))
 }
 
 func combineJSONSchemaErrors(e []gojsonschema.ResultError) error {
@@ -111,25 +284,107 @@ func combineJSONSchemaErrors(e []gojsonschema.ResultError) error {
 	for i, v := range e {
 		s[i] = v.String()
 	}
-	return fmt.Errorf(strings.Join(s, "\n"))
+	return errors.New(strings.Join(s, "\n"))
 }
 
-func parseIdentity(c *fiber.Ctx, i *model.Identity) bool {
-	r, err := validateIdentityJSON(c.Body())
-	if err != nil {
+func (a *IdentApp) parseIdentity(c *fiber.Ctx, i *model.Identity) bool {
+	return a.parseIdentityJSON(c, c.Body(), i)
+}
+
+func (a *IdentApp) parseIdentityJSON(c *fiber.Ctx, src string, i *model.Identity) bool {
+	r, err := a.validateIdentityJSON(src)
+	if errors.Is(err, identityschema.ErrUnknownSchema) {
+		writeError(c, http.StatusUnprocessableEntity, err)
+		return false
+	} else if errors.Is(err, errSchemaUnavailable) {
+		writeError(c, http.StatusInternalServerError, err)
+		return false
+	} else if err != nil {
 		writeError(c, http.StatusBadRequest, err)
 		return false
 	} else if !r.Valid() {
 		writeError(c, http.StatusUnprocessableEntity, combineJSONSchemaErrors(r.Errors()))
 		return false
 	}
-	if err != c.BodyParser(&i) {
+	if err = json.Unmarshal([]byte(src), i); err != nil {
 		writeError(c, http.StatusBadRequest, err)
 		return false
 	}
 	return true
 }
 
+// extractPatch returns function applying request body patch to a json document according to request content type
+func extractPatch(c *fiber.Ctx) (func([]byte) ([]byte, error), bool) {
+	body := []byte(c.Body())
+	if !json.Valid(body) {
+		writeError(c, http.StatusBadRequest, fmt.Errorf("patch must be a valid json document"))
+		return nil, false
+	}
+	switch contentType := strings.TrimSpace(strings.Split(c.Get(HeaderKeyContentType), ";")[0]); contentType {
+	case HeaderValueMergePatchJSONContentType:
+		return func(doc []byte) ([]byte, error) { return jsonpatch.MergePatch(doc, body) }, true
+	case HeaderValueJSONPatchJSONContentType:
+		p, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, err)
+			return nil, false
+		}
+		return p.Apply, true
+	default:
+		writeError(c, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported patch content type %q. Expected %q or %q",
+			contentType, HeaderValueMergePatchJSONContentType, HeaderValueJSONPatchJSONContentType))
+		return nil, false
+	}
+}
+
+// extractIfMatch returns identity version required by If-Match header. Zero version matches any identity.
+// If-Match uses strong comparison, so weak tags never match
+func extractIfMatch(c *fiber.Ctx) (int64, bool) {
+	h := strings.TrimSpace(c.Get(HeaderKeyIfMatch))
+	if h == "" || h == "*" {
+		return 0, true
+	}
+	if strings.HasPrefix(h, "W/") {
+		writeError(c, http.StatusPreconditionFailed, fmt.Errorf("weak entity tag %s doesn't match", h))
+		return 0, false
+	}
+	v, err := parseETag(h)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return 0, false
+	}
+	return v, true
+}
+
+// noneMatch returns whether If-None-Match header value matches the version. If-None-Match uses weak comparison
+func noneMatch(header string, version int64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if v, err := parseETag(strings.TrimPrefix(tag, "W/")); err == nil && v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func formatETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+func parseETag(tag string) (int64, error) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, fmt.Errorf("invalid entity tag %s", tag)
+	}
+	v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid entity tag %s", tag)
+	}
+	return v, nil
+}
+
 func extractIDParam(c *fiber.Ctx) (string, bool) {
 	id := c.Params("id")
 	_, err := uuid.FromString(id)
@@ -139,3 +394,63 @@ func extractIDParam(c *fiber.Ctx) (string, bool) {
 	}
 	return id, true
 }
+
+func (a *IdentApp) extractPageQuery(c *fiber.Ctx) (model.IdentityQuery, bool) {
+	q := model.IdentityQuery{Limit: a.cfg.DefaultPageSize}
+	if v := c.Query(QueryKeyPageSize); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 || size > a.cfg.MaxPageSize {
+			writeError(c, http.StatusBadRequest, fmt.Errorf("%s must be a number from 1 to %d", QueryKeyPageSize, a.cfg.MaxPageSize))
+			return q, false
+		}
+		q.Limit = size
+	}
+	q.Address = c.Query(QueryKeyAddress)
+	q.Via = c.Query(QueryKeyVia)
+	q.SchemaID = c.Query(QueryKeySchemaID)
+	if v := c.Query(QueryKeyVerified); v != "" {
+		verified, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, fmt.Errorf("%s must be a boolean", QueryKeyVerified))
+			return q, false
+		}
+		q.Verified = &verified
+	}
+	if v := c.Query(QueryKeyPageToken); v != "" {
+		after, err := decodePageToken(v)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, fmt.Errorf("invalid %s", QueryKeyPageToken))
+			return q, false
+		}
+		q.After = after
+	}
+	return q, true
+}
+
+func nextPageLink(c *fiber.Ctx, pageSize int, token string) string {
+	v := url.Values{}
+	for _, k := range []string{QueryKeyAddress, QueryKeyVia, QueryKeyVerified, QueryKeySchemaID} {
+		if q := c.Query(k); q != "" {
+			v.Set(k, q)
+		}
+	}
+	v.Set(QueryKeyPageSize, strconv.Itoa(pageSize))
+	v.Set(QueryKeyPageToken, token)
+	return c.Path() + "?" + v.Encode()
+}
+
+func encodePageToken(lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastID))
+}
+
+func decodePageToken(token string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	id, err := uuid.FromString(string(b))
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
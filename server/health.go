@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+)
+
+// healthCheckTimeout limits time spent on checking the store on readiness probes
+const healthCheckTimeout = 5 * time.Second
+
+// HandleAlive reports that the process serves requests. It doesn't check dependencies,
+// so a store outage doesn't get healthy instances restarted
+func (a *IdentApp) HandleAlive(c *fiber.Ctx) {
+	writeSuccess(c, http.StatusOK, model.HealthStatus{Status: model.HealthOK})
+}
+
+// HandleReady reports whether the instance can serve traffic: it must not be shutting down, the store must be
+// reachable and its schema must have no pending migrations. Reasons of unavailability are reported in detail
+func (a *IdentApp) HandleReady(c *fiber.Ctx) {
+	writeHealth(c, a.readiness())
+}
+
+// HandlePublicReady reports readiness like HandleReady, but reports status only,
+// so store and migration errors are not exposed outside. They are logged instead
+func (a *IdentApp) HandlePublicReady(c *fiber.Ctx) {
+	res := a.readiness()
+	if res.Status != model.HealthOK {
+		log.Printf("instance is not ready: %s", res.Error)
+	}
+	writeHealth(c, model.HealthStatus{Status: res.Status})
+}
+
+func writeHealth(c *fiber.Ctx, res model.HealthStatus) {
+	code := http.StatusOK
+	if res.Status != model.HealthOK {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(res)
+	c.Status(code)
+}
+
+func (a *IdentApp) readiness() model.HealthStatus {
+	if atomic.LoadInt32(&a.draining) == 1 {
+		return model.HealthStatus{Status: model.HealthUnavailable, Error: "shutting down"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	if err := a.store.Ping(ctx); err != nil {
+		return model.HealthStatus{Status: model.HealthUnavailable, Error: fmt.Sprintf("store is unreachable: %v", err)}
+	}
+	r, ok := a.store.(MigrationReporter)
+	if !ok {
+		return model.HealthStatus{Status: model.HealthOK}
+	}
+	st, err := r.SchemaStatus(ctx)
+	if err != nil {
+		return model.HealthStatus{Status: model.HealthUnavailable, Error: fmt.Sprintf("could not read migration status: %v", err)}
+	}
+	if len(st.Pending) > 0 {
+		return model.HealthStatus{Status: model.HealthUnavailable, Error: fmt.Sprintf("%d migrations are pending", len(st.Pending)), Migrations: &st}
+	}
+	return model.HealthStatus{Status: model.HealthOK, Migrations: &st}
+}
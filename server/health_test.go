@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+)
+
+// migratedStore is a memory store reporting a fixed migration status
+type migratedStore struct {
+	*memstore.Store
+	status model.MigrationStatus
+}
+
+func (s migratedStore) SchemaStatus(ctx context.Context) (model.MigrationStatus, error) {
+	return s.status, nil
+}
+
+func TestHealth(t *testing.T) {
+	check := func(app *fiber.App, path string) (int, model.HealthStatus) {
+		resp := sendRequest(t, app, http.MethodGet, path, "", nil)
+		var res model.HealthStatus
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	t.Run("should report alive and ready on both routers without credentials", func(t *testing.T) {
+		srv := newTestApp(t, &memstore.Store{})
+		for _, app := range []*fiber.App{srv.public, srv.admin} {
+			for _, path := range []string{"/health/alive", "/health/ready"} {
+				code, res := check(app, path)
+				assert.Equal(t, http.StatusOK, code, path)
+				assert.Equal(t, model.HealthOK, res.Status, path)
+				assert.Nil(t, res.Migrations, "expected no migrations of memory store")
+			}
+		}
+	})
+	t.Run("should report not ready when store is unreachable", func(t *testing.T) {
+		store := &stubStore{pingErr: errors.New("connection refused")}
+		srv := newTestApp(t, store)
+		code, res := check(srv.admin, "/health/ready")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, model.HealthUnavailable, res.Status)
+		assert.Contains(t, res.Error, "connection refused")
+		code, res = check(srv.public, "/health/ready")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, model.HealthStatus{Status: model.HealthUnavailable}, res, "expected public router not to expose store errors")
+		code, _ = check(srv.public, "/health/alive")
+		assert.Equal(t, http.StatusOK, code, "expected store outage not to affect liveness")
+	})
+	t.Run("should report not ready while shutting down", func(t *testing.T) {
+		srv := newTestApp(t, &memstore.Store{})
+		srv.Shutdown(context.Background())
+		for _, app := range []*fiber.App{srv.public, srv.admin} {
+			code, res := check(app, "/health/ready")
+			assert.Equal(t, http.StatusServiceUnavailable, code)
+			assert.Equal(t, model.HealthUnavailable, res.Status)
+			code, _ = check(app, "/health/alive")
+			assert.Equal(t, http.StatusOK, code, "expected draining instance to stay alive")
+		}
+	})
+	t.Run("should report migration status", func(t *testing.T) {
+		store := migratedStore{Store: &memstore.Store{}, status: model.MigrationStatus{Current: 13, Latest: 13, Pending: []int64{}}}
+		srv := newTestApp(t, store)
+		code, res := check(srv.admin, "/health/ready")
+		assert.Equal(t, http.StatusOK, code)
+		require.NotNil(t, res.Migrations)
+		assert.Equal(t, int64(13), res.Migrations.Current)
+
+		store.status = model.MigrationStatus{Current: 12, Latest: 13, Pending: []int64{13}}
+		srv = newTestApp(t, store)
+		code, res = check(srv.admin, "/health/ready")
+		assert.Equal(t, http.StatusServiceUnavailable, code, "expected pending migrations to make instance not ready")
+		require.NotNil(t, res.Migrations)
+		assert.Equal(t, []int64{13}, res.Migrations.Pending)
+		code, res = check(srv.public, "/health/ready")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Nil(t, res.Migrations, "expected public router not to expose migration status")
+	})
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+)
+
+// HandleListMessages handles list of the newest queued messages filtered by address, identity and delivery status request
+func (a *IdentApp) HandleListMessages(c *fiber.Ctx) {
+	q := model.MessageQuery{
+		Limit:      a.cfg.DefaultPageSize,
+		Recipient:  c.Query(QueryKeyAddress),
+		Via:        c.Query(QueryKeyVia),
+		IdentityID: c.Query(QueryKeyIdentityID),
+		Status:     c.Query(QueryKeyStatus),
+	}
+	if v := c.Query(QueryKeyPageSize); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 || size > a.cfg.MaxPageSize {
+			writeError(c, http.StatusBadRequest, fmt.Errorf("%s must be a number from 1 to %d", QueryKeyPageSize, a.cfg.MaxPageSize))
+			return
+		}
+		q.Limit = size
+	}
+	switch q.Status {
+	case "", model.MessageQueued, model.MessageSending, model.MessageSent, model.MessageFailed:
+	default:
+		writeError(c, http.StatusBadRequest, fmt.Errorf("unknown %s %q", QueryKeyStatus, q.Status))
+		return
+	}
+	l, err := a.store.ListMessages(q)
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	writeSuccess(c, http.StatusOK, l)
+}
+
+// HandleGetMessage handles get delivery status of a queued message request
+func (a *IdentApp) HandleGetMessage(c *fiber.Ctx) {
+	id, valid := extractIDParam(c)
+	if !valid {
+		return
+	}
+	m, err := a.store.GetMessage(id)
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	writeSuccess(c, http.StatusOK, m)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/trapck/kr.api/model"
+)
+
+func TestGetMessage(t *testing.T) {
+	m := model.Message{ID: uuid.NewV4().String(), Via: "email", Recipient: "a@example.com", Body: "secret code", Status: model.MessageQueued}
+	store := stubStore{messages: map[string]model.Message{m.ID: m}}
+	srv := newTestApp(t, &store)
+	get := func(path string) *http.Response {
+		return sendRequest(t, srv.admin, http.MethodGet, path, "", adminHeaders(nil))
+	}
+
+	t.Run("should return delivery status without body", func(t *testing.T) {
+		resp := get("/admin/messages/" + m.ID)
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(b), `"status":"queued"`)
+		assert.NotContains(t, string(b), m.Body, "expected message body not to be exposed")
+	})
+	t.Run("should return not found for unknown message", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusNotFound, get("/admin/messages/"+uuid.NewV4().String()))
+	})
+	t.Run("should return bad request for invalid id", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusBadRequest, get("/admin/messages/nope"))
+	})
+	t.Run("should not be served by public API", func(t *testing.T) {
+		assertStatus(t, http.StatusNotFound, get("/messages/"+m.ID).StatusCode, "")
+		assertStatus(t, http.StatusNotFound, get("/messages?address=a@example.com").StatusCode, "")
+	})
+	t.Run("should list messages of address without body", func(t *testing.T) {
+		resp := get("/admin/messages?address=a@example.com&status=queued")
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(b), m.ID)
+		assert.NotContains(t, string(b), m.Body, "expected message body not to be exposed")
+		body := []model.Message{}
+		assertSussessJSONResponse(t, http.StatusOK, get("/admin/messages?address=b@example.com"), &body)
+		assert.Empty(t, body, "expected messages of other addresses to be filtered out")
+	})
+	t.Run("should reject invalid list filters", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusBadRequest, get("/admin/messages?status=lost"))
+		assertErrorJSONResponse(t, http.StatusBadRequest, get("/admin/messages?page_size=0"))
+	})
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"log"
+
+	"github.com/trapck/kr.api/model"
+)
+
+// Notifier delivers one-time codes and tokens to identity addresses
+type Notifier interface {
+	SendVerificationCode(i model.Identity, a model.VerifiableAddress, code string) error
+	SendRecoveryToken(i model.Identity, a model.RecoveryAddress, token string) error
+}
+
+// LogNotifier writes messages to the standard logger. It is meant for development only
+type LogNotifier struct{}
+
+// SendVerificationCode logs verification code of the address
+func (LogNotifier) SendVerificationCode(i model.Identity, a model.VerifiableAddress, code string) error {
+	log.Printf("verification code for %s %s of identity %s: %s", a.Via, a.Value, i.ID, code)
+	return nil
+}
+
+// SendRecoveryToken logs recovery token of the address
+func (LogNotifier) SendRecoveryToken(i model.Identity, a model.RecoveryAddress, token string) error {
+	log.Printf("recovery token for %s %s of identity %s: %s", a.Via, a.Value, i.ID, token)
+	return nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+)
+
+// recoveryTokenSize is a number of random bytes in recovery tokens
+const recoveryTokenSize = 32
+
+// recoverySubject binds hashes of recovery tokens, so they differ from hashes of other secrets
+const recoverySubject = "recovery"
+
+var (
+	errInvalidToken            = errors.New("invalid or expired recovery token")
+	errRecoveryAddressNotFound = errors.New("recovery address not found")
+)
+
+// HandleStartRecovery issues a recovery token for the identity owning the recovery address and sends it to the address.
+// A new token replaces earlier tokens of the identity and is issued not earlier than resend interval after the previous one.
+// The response doesn't tell whether the address exists
+func (a *IdentApp) HandleStartRecovery(c *fiber.Ctx) {
+	var r model.RecoveryRequest
+	if err := json.Unmarshal([]byte(c.Body()), &r); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	r.Address, r.Via = strings.TrimSpace(r.Address), strings.TrimSpace(r.Via)
+	if r.Address == "" || r.Via == "" {
+		writeError(c, http.StatusBadRequest, errors.New("address and via must not be empty"))
+		return
+	}
+	i, address, err := a.findRecoveryAddress(r)
+	if err == errRecoveryAddressNotFound {
+		c.Status(http.StatusAccepted)
+		return
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	now := a.now()
+	previous, err := a.store.GetLatestRecoveryToken(i.ID)
+	if err != nil && !a.store.NoRows(err) {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	} else if err == nil && !previous.Expired(now) && now.Before(previous.CreatedAt.Add(a.cfg.Recovery.ResendInterval.Duration)) {
+		c.Status(http.StatusAccepted)
+		return
+	}
+	token, err := newToken(recoveryTokenSize)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	t := model.RecoveryToken{
+		TokenHash:  hashSecret(recoverySubject, token),
+		IdentityID: i.ID,
+		AddressID:  address.ID,
+		ExpiresAt:  now.Add(a.cfg.Recovery.TokenTTL.Duration),
+		CreatedAt:  now,
+	}
+	if err = a.store.DeleteRecoveryTokens(i.ID); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	if err = a.store.SaveRecoveryToken(t); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	// failed delivery is answered as a sent token, so it doesn't tell the address exists
+	if err = a.notifier.SendRecoveryToken(i, address, token); err != nil {
+		log.Printf("could not send recovery token to address %s: %v", address.ID, err)
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// HandleCompleteRecovery redeems a recovery token for a short-lived privileged session of its identity.
+// The token is revoked on the first use together with all other recovery tokens of the identity
+func (a *IdentApp) HandleCompleteRecovery(c *fiber.Ctx) {
+	var r model.RecoveryCompleteRequest
+	if err := json.Unmarshal([]byte(c.Body()), &r); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	if r.Token = strings.TrimSpace(r.Token); r.Token == "" {
+		writeError(c, http.StatusBadRequest, errors.New("token must not be empty"))
+		return
+	}
+	t, err := a.store.UseRecoveryToken(hashSecret(recoverySubject, r.Token))
+	if err != nil && a.store.NoRows(err) {
+		writeError(c, http.StatusUnprocessableEntity, errInvalidToken)
+		return
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	if t.Expired(a.now()) {
+		writeError(c, http.StatusUnprocessableEntity, errInvalidToken)
+		return
+	}
+	i, err := a.store.Get(t.IdentityID)
+	if err != nil && a.store.NoRows(err) {
+		writeError(c, http.StatusUnprocessableEntity, errInvalidToken)
+		return
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	if err = a.store.DeleteRecoveryTokens(i.ID); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	s, err := a.issueSession(c, i.ID, model.AAL1, true, a.cfg.Recovery.SessionTTL.Duration)
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	writeSuccess(c, http.StatusOK, s)
+}
+
+// findRecoveryAddress returns identity owning recovery address with the requested value and channel
+func (a *IdentApp) findRecoveryAddress(r model.RecoveryRequest) (model.Identity, model.RecoveryAddress, error) {
+	// the same value may also be a verifiable address of another identity
+	l, err := a.store.ListPage(model.IdentityQuery{Address: r.Address, Via: r.Via, Limit: 2})
+	if err != nil {
+		return model.Identity{}, model.RecoveryAddress{}, err
+	}
+	for _, i := range l {
+		for _, ra := range i.RecoveryAddresses {
+			if ra.Value == r.Address && ra.Via == r.Via {
+				return i, ra, nil
+			}
+		}
+	}
+	return model.Identity{}, model.RecoveryAddress{}, errRecoveryAddressNotFound
+}
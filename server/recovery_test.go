@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/testutil"
+)
+
+func TestRecovery(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	notifier := &stubNotifier{codes: map[string]string{}, tokens: map[string]string{}}
+	srv.SetNotifier(notifier)
+	now := time.Now()
+	srv.now = func() time.Time { return now }
+	address := func() model.RecoveryAddress {
+		return model.RecoveryAddress{Address: model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String() + "@example.com", Via: "email"}}
+	}
+	i, _ := store.Create(model.Identity{ID: uuid.NewV4().String(), RecoveryAddresses: []model.RecoveryAddress{address(), address()}})
+	value, other := i.RecoveryAddresses[0].Value, i.RecoveryAddresses[1].Value
+	start := func(value string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/recovery", fmt.Sprintf(`{"address":%q,"via":"email"}`, value), nil)
+	}
+	complete := func(token string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/recovery/complete", fmt.Sprintf(`{"token":%q}`, token), nil)
+	}
+
+	t.Run("should issue hashed token", func(t *testing.T) {
+		assertStatus(t, http.StatusAccepted, start(value).StatusCode, "")
+		token := notifier.tokens[value]
+		assert.NotEmpty(t, token, "expected token to be sent")
+		_, err := store.UseRecoveryToken(token)
+		assert.True(t, store.NoRows(err), "expected token not to be stored in plain text")
+	})
+	t.Run("should not reveal unknown address", func(t *testing.T) {
+		assertStatus(t, http.StatusAccepted, start("unknown@example.com").StatusCode, "")
+		assert.NotContains(t, notifier.tokens, "unknown@example.com")
+	})
+	t.Run("should not reissue token within resend interval", func(t *testing.T) {
+		assertStatus(t, http.StatusAccepted, start(other).StatusCode, "")
+		assert.NotContains(t, notifier.tokens, other, "expected token not to be sent again")
+	})
+	t.Run("should not reveal failed delivery", func(t *testing.T) {
+		now = now.Add(srv.cfg.Recovery.ResendInterval.Duration)
+		notifier.err = fmt.Errorf("smtp is down")
+		defer func() { notifier.err = nil }()
+		assertStatus(t, http.StatusAccepted, start(other).StatusCode, "")
+	})
+	t.Run("should replace earlier tokens of identity", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(notifier.tokens[value]))
+	})
+	t.Run("should reject unknown token", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete("wrong"))
+	})
+	t.Run("should redeem token for privileged session", func(t *testing.T) {
+		now = now.Add(srv.cfg.Recovery.ResendInterval.Duration)
+		assertStatus(t, http.StatusAccepted, start(value).StatusCode, "")
+		// a token issued concurrently by another instance
+		testutil.FailOnNotEqual(t, store.SaveRecoveryToken(model.RecoveryToken{TokenHash: "concurrent", IdentityID: i.ID, ExpiresAt: now.Add(time.Hour), CreatedAt: now}), nil, "")
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusOK, complete(notifier.tokens[value]), &body)
+		assert.NotEmpty(t, body.Token, "expected session token to be returned")
+		assert.Equal(t, i.ID, body.Session.IdentityID)
+		assert.True(t, body.Session.Privileged, "expected session to be privileged")
+		assert.True(t, body.Session.ExpiresAt.Equal(now.Add(srv.cfg.Recovery.SessionTTL.Duration).Truncate(time.Millisecond)), "expected session to be short-lived")
+		s, err := store.GetSession(hashSecret(sessionSubject, body.Token))
+		testutil.FailOnNotEqual(t, err, nil, "expected session to be stored by token hash")
+		assert.Equal(t, body.Session.ID, s.ID)
+	})
+	t.Run("should not reuse token", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(notifier.tokens[value]))
+	})
+	t.Run("should revoke other tokens of identity on use", func(t *testing.T) {
+		_, err := store.UseRecoveryToken("concurrent")
+		assert.True(t, store.NoRows(err), "expected other tokens to be revoked")
+	})
+	t.Run("should reject expired token", func(t *testing.T) {
+		now = now.Add(srv.cfg.Recovery.ResendInterval.Duration)
+		assertStatus(t, http.StatusAccepted, start(value).StatusCode, "")
+		now = now.Add(srv.cfg.Recovery.TokenTTL.Duration)
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(notifier.tokens[value]))
+	})
+	t.Run("should return bad request for invalid body", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/recovery", "{", nil))
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/recovery", `{"address":"a@example.com"}`, nil))
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/recovery/complete", `{}`, nil))
+	})
+}
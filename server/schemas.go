@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+var schemaIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// schemaSyncInterval is how long a loaded schema is trusted before its stored version is read again
+const schemaSyncInterval = 30 * time.Second
+
+// errSchemaUnavailable is returned when the stored version of a schema can't be read
+var errSchemaUnavailable = errors.New("could not load stored identity schema")
+
+// HandleListSchemas handles list of registered identity schemas request
+func (a *IdentApp) HandleListSchemas(c *fiber.Ctx) {
+	stored, err := a.store.ListSchemas()
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	now := a.now()
+	for _, v := range stored {
+		if v.ID == model.DefaultSchemaID {
+			continue
+		}
+		if _, err := a.schemas.Sync(v.ID, v.Schema); err != nil {
+			log.Printf("could not load stored identity schema %q: %v", v.ID, err)
+			continue
+		}
+		a.markSchemaSynced(v.ID, now)
+	}
+	ids := a.schemas.IDs()
+	l := make([]model.IdentitySchemaRef, len(ids))
+	for i, id := range ids {
+		l[i] = model.IdentitySchemaRef{ID: id, URL: schemaURL(id)}
+	}
+	writeSuccess(c, http.StatusOK, l)
+}
+
+// HandleGetSchema handles get identity JSON schema request
+func (a *IdentApp) HandleGetSchema(c *fiber.Ctx) {
+	id := c.Params("id")
+	if !schemaIDPattern.MatchString(id) {
+		writeError(c, http.StatusNotFound, fmt.Errorf("identity schema %q not found", id))
+		return
+	}
+	if err := a.syncStoredSchema(id); err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	raw, ok := a.schemas.Get(id)
+	if !ok {
+		writeError(c, http.StatusNotFound, fmt.Errorf("identity schema %q not found", id))
+		return
+	}
+	writeSuccess(c, http.StatusOK, raw)
+}
+
+// HandlePutSchema handles create or replace identity schema request.
+// The built-in default schema can be overridden by configuration only, so all instances agree on it
+func (a *IdentApp) HandlePutSchema(c *fiber.Ctx) {
+	id := c.Params("id")
+	if !schemaIDPattern.MatchString(id) {
+		writeError(c, http.StatusBadRequest, fmt.Errorf("schema id must match %s", schemaIDPattern))
+		return
+	}
+	if id == model.DefaultSchemaID {
+		writeError(c, http.StatusConflict, fmt.Errorf("built-in identity schema %q can't be replaced", id))
+		return
+	}
+	body := []byte(c.Body())
+	if !json.Valid(body) {
+		writeError(c, http.StatusBadRequest, fmt.Errorf("schema must be a valid json document"))
+		return
+	}
+	if _, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(body)); err != nil {
+		writeError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+	_, exists := a.schemas.Get(id)
+	if err := a.store.PutSchema(model.IdentitySchema{ID: id, Schema: body}); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	if _, err := a.schemas.Sync(id, body); err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	a.markSchemaSynced(id, a.now())
+	code := http.StatusCreated
+	if exists {
+		code = http.StatusOK
+	}
+	writeSuccess(c, code, model.IdentitySchemaRef{ID: id, URL: schemaURL(id)})
+}
+
+// syncStoredSchema registers the stored version of the schema, so schemas put by other instances replace
+// previously loaded ones. The store is read at most once per schemaSyncInterval for each stored schema.
+// Missing schemas are not remembered, so ids sent by clients can't grow the sync times.
+// Errors are returned rather than falling back to the loaded version, which may be stale
+func (a *IdentApp) syncStoredSchema(id string) error {
+	if id == model.DefaultSchemaID || !schemaIDPattern.MatchString(id) {
+		return nil
+	}
+	now := a.now()
+	a.schemaSyncedMu.Lock()
+	synced, ok := a.schemaSynced[id]
+	a.schemaSyncedMu.Unlock()
+	if ok && now.Sub(synced) < schemaSyncInterval {
+		return nil
+	}
+	s, err := a.store.GetSchema(id)
+	if err != nil && a.store.NoRows(err) {
+		return nil
+	}
+	if err == nil {
+		_, err = a.schemas.Sync(id, s.Schema)
+	}
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", errSchemaUnavailable, id, err)
+	}
+	a.markSchemaSynced(id, now)
+	return nil
+}
+
+func (a *IdentApp) markSchemaSynced(id string, at time.Time) {
+	a.schemaSyncedMu.Lock()
+	defer a.schemaSyncedMu.Unlock()
+	a.schemaSynced[id] = at
+}
+
+func schemaURL(id string) string {
+	return "/schemas/" + id
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+)
+
+// newCode returns a random numeric code of the given length
+func newCode(digits int) (string, error) {
+	b := make([]byte, digits)
+	for n := range b {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b[n] = byte('0' + d.Int64())
+	}
+	return string(b), nil
+}
+
+// newToken returns a random url safe token of the given number of bytes
+func newToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret returns a hex encoded sha256 hash of the secret bound to the given subject,
+// so the same secret issued for different subjects has different hashes
+func hashSecret(subject, secret string) string {
+	h := sha256.Sum256([]byte(subject + ":" + secret))
+	return hex.EncodeToString(h[:])
+}
+
+// secretMatches compares the secret with the stored hash in constant time
+func secretMatches(subject, secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(subject, secret)), []byte(hash)) == 1
+}
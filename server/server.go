@@ -1,38 +1,295 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/auth"
+	"github.com/trapck/kr.api/courier"
+	"github.com/trapck/kr.api/hasher"
+	"github.com/trapck/kr.api/identityschema"
 	"github.com/trapck/kr.api/model"
+	"github.com/xeipuuv/gojsonschema"
 )
 
+// SchemaStore persists identity schemas registered through admin API
+type SchemaStore interface {
+	ListSchemas() ([]model.IdentitySchema, error)
+	GetSchema(id string) (model.IdentitySchema, error)
+	// PutSchema inserts or replaces identity schema
+	PutSchema(s model.IdentitySchema) error
+}
+
+// VerificationStore persists pending address verification codes, at most one per address
+type VerificationStore interface {
+	// SaveVerificationCode inserts or replaces verification code of the address
+	SaveVerificationCode(v model.VerificationCode) error
+	GetVerificationCode(addressID string) (model.VerificationCode, error)
+	// IncrementVerificationAttempts atomically counts an attempt to use verification code of the address and returns the code
+	IncrementVerificationAttempts(addressID string) (model.VerificationCode, error)
+	// DeleteVerificationCode deletes verification code of the address if any
+	DeleteVerificationCode(addressID string) error
+}
+
+// RecoveryStore persists single-use account recovery tokens
+type RecoveryStore interface {
+	SaveRecoveryToken(t model.RecoveryToken) error
+	// GetLatestRecoveryToken returns the most recently created recovery token of the identity
+	GetLatestRecoveryToken(identityID string) (model.RecoveryToken, error)
+	// UseRecoveryToken deletes recovery token and returns it, so every token can be used once
+	UseRecoveryToken(tokenHash string) (model.RecoveryToken, error)
+	// DeleteRecoveryTokens deletes all recovery tokens of the identity
+	DeleteRecoveryTokens(identityID string) error
+}
+
+// SessionStore persists identity sessions by hashes of their tokens
+type SessionStore interface {
+	CreateSession(s model.Session) error
+	GetSession(tokenHash string) (model.Session, error)
+	// DeleteSession deletes session by hash of its token if any
+	DeleteSession(tokenHash string) error
+	// DeleteOtherSessions deletes all sessions of the identity except the one with the token hash
+	DeleteOtherSessions(identityID, exceptTokenHash string) error
+}
+
+// CredentialsStore persists identity credentials apart from identities, so Update doesn't change them.
+// Get returns identity with its credentials
+type CredentialsStore interface {
+	// PutCredentials inserts or replaces identity credentials of c.Type. Identifiers must be unique per type across identities
+	PutCredentials(c model.Credentials) error
+	// FindCredentials returns credentials of the type having the identifier
+	FindCredentials(credType, identifier string) (model.Credentials, error)
+	// MergeCredentialsConfig sets and deletes keys of identity credentials config of the type keeping its other keys
+	MergeCredentialsConfig(identityID, credType string, set model.JSONObject, unset []string, updatedAt time.Time) error
+	// IncrementTOTPAttempts atomically counts a second factor attempt and returns totp credentials of the identity.
+	// The count restarts at now when its window started at or before windowStart
+	IncrementTOTPAttempts(identityID string, now, windowStart time.Time) (model.Credentials, error)
+	// ConsumeTOTPStep atomically sets the last accepted totp step of the identity and resets counted attempts.
+	// It fails with no rows error unless the stored step is before step, so every totp code is accepted once
+	ConsumeTOTPStep(identityID string, step int64, updatedAt time.Time) error
+	// UseTOTPRecoveryCode atomically removes the recovery code hash from totp credentials of the identity and resets
+	// counted attempts. It fails with no rows error when the hash is not stored, so every recovery code is accepted once
+	UseTOTPRecoveryCode(identityID, hash string, updatedAt time.Time) error
+}
+
+// MessageStore lists messages queued by courier, so their delivery status can be looked up by address or identity
+type MessageStore interface {
+	ListMessages(q model.MessageQuery) ([]model.Message, error)
+}
+
 //Store serves as an interface for identity db operations
 type Store interface {
+	SchemaStore
+	VerificationStore
+	RecoveryStore
+	SessionStore
+	CredentialsStore
+	courier.Queue
+	MessageStore
 	List() ([]model.Identity, error)
+	ListPage(q model.IdentityQuery) ([]model.Identity, error)
 	Create(model.Identity) (model.Identity, error)
 	Get(id string) (model.Identity, error)
+	// Update replaces identity and increments its version.
+	// Non zero i.Version is compared with the stored one and update is rejected on mismatch
 	Update(id string, i model.Identity) (model.Identity, error)
-	Delete(id string) error
+	// Delete deletes identity. Non zero version is compared with the stored one and delete is rejected on mismatch
+	Delete(id string, version int64) error
 	NoRows(e error) bool
+	Duplicate(e error) bool
+	VersionMismatch(e error) bool
+	// Ping checks that the store backend is reachable
+	Ping(ctx context.Context) error
 }
 
-//IdentApp is an application to serve identities
+// MigrationReporter is implemented by stores with versioned schema
+type MigrationReporter interface {
+	SchemaStatus(ctx context.Context) (model.MigrationStatus, error)
+}
+
+//IdentApp is an application to serve identities. Self-service routes are served by public router,
+//identity management routes are served by admin router which is meant to be reachable from internal network only
 type IdentApp struct {
-	server *fiber.App
-	store  Store
+	public        *fiber.App
+	admin         *fiber.App
+	store         Store
+	cfg           appconfig.Config
+	schemas       *identityschema.Registry
+	notifier      Notifier
+	hasher        hasher.Hasher
+	dummyHash     string
+	authenticator *auth.Authenticator
+	now           func() time.Time
+	// schemaSynced holds when stored version of each schema was last read, see syncStoredSchema
+	schemaSynced   map[string]time.Time
+	schemaSyncedMu sync.Mutex
+	// draining is set once Shutdown starts, so readiness probes take the instance out of rotation
+	draining int32
+}
+
+//Start binds public and admin ports and serves them until Shutdown or a failure of either listener
+func (a *IdentApp) Start(publicPort, adminPort int) error {
+	public, err := net.Listen("tcp", fmt.Sprintf(":%d", publicPort))
+	if err != nil {
+		return err
+	}
+	admin, err := net.Listen("tcp", fmt.Sprintf(":%d", adminPort))
+	if err != nil {
+		public.Close()
+		return err
+	}
+	return a.Serve(public, admin)
 }
 
-//Start starts an application
-func (a *IdentApp) Start(port int) error {
-	return a.server.Listen(port)
+// Serve serves public and admin routers on the listeners. It returns when both are shut down
+// or when either fails, in which case the other one is shut down too
+func (a *IdentApp) Serve(public, admin net.Listener) error {
+	errs := make(chan error, 2)
+	go func() { errs <- a.public.Listener(public) }()
+	go func() { errs <- a.admin.Listener(admin) }()
+	if err := <-errs; err != nil {
+		atomic.StoreInt32(&a.draining, 1)
+		a.shutdownRouters(context.Background())
+		return err
+	}
+	return <-errs
+}
+
+// Shutdown makes readiness probes report the instance unavailable for the configured shutdown delay while
+// requests are still served, so load balancers stop routing to it. Then it stops accepting connections
+// and waits for in-flight requests of both routers until ctx is done
+func (a *IdentApp) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&a.draining, 1)
+	t := time.NewTimer(a.cfg.ShutdownDelay.Duration)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return a.shutdownRouters(ctx)
+}
+
+func (a *IdentApp) shutdownRouters(ctx context.Context) error {
+	done := make(chan error, 2)
+	go func() { done <- a.public.Shutdown() }()
+	go func() { done <- a.admin.Shutdown() }()
+	var err error
+	for n := 0; n < 2; n++ {
+		select {
+		case e := <-done:
+			if err == nil {
+				err = e
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// SetNotifier replaces the notifier delivering codes to identity addresses
+func (a *IdentApp) SetNotifier(n Notifier) {
+	a.notifier = n
+}
+
+// idleTimeout closes idle keep-alive connections, so they don't hold Shutdown until its deadline
+const idleTimeout = 5 * time.Second
+
+func newRouter() *fiber.App {
+	return fiber.New(&fiber.Settings{
+		// values read from requests are kept by stores, so they must not share request buffers
+		Immutable:   true,
+		IdleTimeout: idleTimeout,
+	})
 }
 
 //NewApp initializes the new ident app instance
-func NewApp(s Store) *IdentApp {
-	app := &IdentApp{server: fiber.New(), store: s}
-	app.server.Get("/identities", app.HandleList)
-	app.server.Post("/identities", app.HandleCreate)
-	app.server.Get("/identities/:id", app.HandleGet)
-	app.server.Put("/identities/:id", app.HandleUpdate)
-	app.server.Delete("/identities/:id", app.HandleDelete)
-	return app
+func NewApp(s Store, cfg appconfig.Config) (*IdentApp, error) {
+	schemas, err := identityschema.Load(cfg.IdentitySchemas)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.ListSchemas()
+	if err != nil {
+		return nil, fmt.Errorf("could not load stored identity schemas: %v", err)
+	}
+	synced, loadedAt := map[string]time.Time{}, time.Now()
+	for _, v := range stored {
+		// the built-in default schema can be overridden by configuration only, as HandlePutSchema enforces
+		if v.ID == model.DefaultSchemaID {
+			continue
+		}
+		if err = schemas.Register(v.ID, gojsonschema.NewBytesLoader(v.Schema)); err != nil {
+			return nil, err
+		}
+		synced[v.ID] = loadedAt
+	}
+	h, err := hasher.New(cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	// passwords of unknown identifiers are compared with the dummy hash, so they take as long as known ones
+	dummyHash, err := h.Hash("dummy password")
+	if err != nil {
+		return nil, err
+	}
+	authenticator, err := auth.New(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	app := &IdentApp{
+		public:        newRouter(),
+		admin:         newRouter(),
+		store:         s,
+		cfg:           cfg,
+		schemas:       schemas,
+		notifier:      LogNotifier{},
+		hasher:        h,
+		dummyHash:     dummyHash,
+		authenticator: authenticator,
+		now:           time.Now,
+		schemaSynced:  synced,
+	}
+	// both listeners report health, so each can be probed on its own network
+	app.public.Get("/health/alive", app.HandleAlive)
+	app.public.Get("/health/ready", app.HandlePublicReady)
+	app.admin.Get("/health/alive", app.HandleAlive)
+	app.admin.Get("/health/ready", app.HandleReady)
+	app.public.Post("/verification", app.HandleStartVerification)
+	app.public.Post("/verification/complete", app.HandleCompleteVerification)
+	app.public.Post("/sessions", app.HandleLogin)
+	app.public.Get("/sessions/whoami", app.HandleWhoami)
+	app.public.Delete("/sessions", app.HandleLogout)
+	app.public.Post("/settings/password", app.HandleResetPassword)
+	app.public.Post("/settings/totp", app.HandleStartTOTP)
+	app.public.Post("/settings/totp/confirm", app.HandleConfirmTOTP)
+	app.public.Post("/recovery", app.HandleStartRecovery)
+	app.public.Post("/recovery/complete", app.HandleCompleteRecovery)
+	// identity schemas are public documents, so clients can validate traits before submitting them
+	app.public.Get("/schemas", app.HandleListSchemas)
+	app.public.Get("/schemas/:id", app.HandleGetSchema)
+	app.admin.Get("/identities", app.authenticate, requireScope(auth.ScopeIdentitiesRead), app.HandleList)
+	app.admin.Post("/identities", app.authenticate, requireScope(auth.ScopeIdentitiesWrite), app.HandleCreate)
+	app.admin.Get("/identities/:id", app.authenticate, requireScope(auth.ScopeIdentitiesRead), app.HandleGet)
+	app.admin.Put("/identities/:id", app.authenticate, requireScope(auth.ScopeIdentitiesWrite), app.HandleUpdate)
+	app.admin.Patch("/identities/:id", app.authenticate, requireScope(auth.ScopeIdentitiesWrite), app.HandlePatch)
+	app.admin.Delete("/identities/:id", app.authenticate, requireScope(auth.ScopeIdentitiesDelete), app.HandleDelete)
+	admin := app.admin.Group("/admin", app.authenticate, requireScope(auth.ScopeAdmin), markAdmin)
+	admin.Get("/identities", app.HandleList)
+	admin.Post("/identities", app.HandleCreate)
+	admin.Get("/identities/:id", app.HandleGet)
+	admin.Put("/identities/:id", app.HandleUpdate)
+	admin.Patch("/identities/:id", app.HandlePatch)
+	admin.Delete("/identities/:id", app.HandleDelete)
+	admin.Put("/identities/:id/credentials/password", app.HandlePutPassword)
+	admin.Put("/schemas/:id", app.HandlePutSchema)
+	admin.Get("/messages", app.HandleListMessages)
+	admin.Get("/messages/:id", app.HandleGetMessage)
+	return app, nil
 }
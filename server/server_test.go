@@ -2,15 +2,24 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gofiber/fiber"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/appconfig"
+	"github.com/trapck/kr.api/auth"
+	"github.com/trapck/kr.api/memstore"
 	"github.com/trapck/kr.api/model"
 	"github.com/trapck/kr.api/testutil"
 )
@@ -19,12 +28,226 @@ const notFound = "not found"
 
 type stubStore struct {
 	identities []model.Identity
+	lastQuery  model.IdentityQuery
+	schemas    []model.IdentitySchema
+	codes      map[string]model.VerificationCode
+	tokens     map[string]model.RecoveryToken
+	sessions   map[string]model.Session
+	messages   map[string]model.Message
+	pingErr    error
+	schemaErr  error
+}
+
+func (s *stubStore) Ping(ctx context.Context) error {
+	return s.pingErr
+}
+
+func (s *stubStore) PutCredentials(c model.Credentials) error {
+	return fmt.Errorf("credentials are not supported by stub store")
+}
+
+func (s *stubStore) FindCredentials(credType, identifier string) (model.Credentials, error) {
+	return model.Credentials{}, fmt.Errorf(notFound)
+}
+
+func (s *stubStore) MergeCredentialsConfig(identityID, credType string, set model.JSONObject, unset []string, updatedAt time.Time) error {
+	return fmt.Errorf(notFound)
+}
+
+func (s *stubStore) IncrementTOTPAttempts(identityID string, now, windowStart time.Time) (model.Credentials, error) {
+	return model.Credentials{}, fmt.Errorf(notFound)
+}
+
+func (s *stubStore) ConsumeTOTPStep(identityID string, step int64, updatedAt time.Time) error {
+	return fmt.Errorf(notFound)
+}
+
+func (s *stubStore) UseTOTPRecoveryCode(identityID, hash string, updatedAt time.Time) error {
+	return fmt.Errorf(notFound)
+}
+
+func (s *stubStore) EnqueueMessage(m model.Message) error {
+	if s.messages == nil {
+		s.messages = map[string]model.Message{}
+	}
+	s.messages[m.ID] = m
+	return nil
+}
+
+func (s *stubStore) ClaimMessages(now, reclaimBefore time.Time, limit int) ([]model.Message, error) {
+	return nil, nil
+}
+
+func (s *stubStore) UpdateMessage(m model.Message) error {
+	s.messages[m.ID] = m
+	return nil
+}
+
+func (s *stubStore) ListMessages(q model.MessageQuery) ([]model.Message, error) {
+	l := []model.Message{}
+	for _, m := range s.messages {
+		if q.MatchMessage(m) && len(l) < q.Limit {
+			l = append(l, m)
+		}
+	}
+	return l, nil
+}
+
+func (s *stubStore) GetMessage(id string) (model.Message, error) {
+	m, ok := s.messages[id]
+	if !ok {
+		return m, fmt.Errorf(notFound)
+	}
+	return m, nil
+}
+
+func (s *stubStore) SaveRecoveryToken(t model.RecoveryToken) error {
+	if s.tokens == nil {
+		s.tokens = map[string]model.RecoveryToken{}
+	}
+	s.tokens[t.TokenHash] = t
+	return nil
+}
+
+func (s *stubStore) GetLatestRecoveryToken(identityID string) (model.RecoveryToken, error) {
+	var latest model.RecoveryToken
+	found := false
+	for _, v := range s.tokens {
+		if v.IdentityID == identityID && (!found || v.CreatedAt.After(latest.CreatedAt)) {
+			latest, found = v, true
+		}
+	}
+	if !found {
+		return latest, fmt.Errorf(notFound)
+	}
+	return latest, nil
+}
+
+func (s *stubStore) UseRecoveryToken(tokenHash string) (model.RecoveryToken, error) {
+	t, ok := s.tokens[tokenHash]
+	if !ok {
+		return t, fmt.Errorf(notFound)
+	}
+	delete(s.tokens, tokenHash)
+	return t, nil
+}
+
+func (s *stubStore) DeleteRecoveryTokens(identityID string) error {
+	for k, v := range s.tokens {
+		if v.IdentityID == identityID {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
+
+func (s *stubStore) CreateSession(v model.Session) error {
+	if s.sessions == nil {
+		s.sessions = map[string]model.Session{}
+	}
+	s.sessions[v.TokenHash] = v
+	return nil
+}
+
+func (s *stubStore) GetSession(tokenHash string) (model.Session, error) {
+	v, ok := s.sessions[tokenHash]
+	if !ok {
+		return v, fmt.Errorf(notFound)
+	}
+	return v, nil
+}
+
+func (s *stubStore) DeleteSession(tokenHash string) error {
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+func (s *stubStore) DeleteOtherSessions(identityID, exceptTokenHash string) error {
+	for k, v := range s.sessions {
+		if v.IdentityID == identityID && k != exceptTokenHash {
+			delete(s.sessions, k)
+		}
+	}
+	return nil
+}
+
+func (s *stubStore) SaveVerificationCode(v model.VerificationCode) error {
+	if s.codes == nil {
+		s.codes = map[string]model.VerificationCode{}
+	}
+	s.codes[v.AddressID] = v
+	return nil
+}
+
+func (s *stubStore) GetVerificationCode(addressID string) (model.VerificationCode, error) {
+	v, ok := s.codes[addressID]
+	if !ok {
+		return v, fmt.Errorf(notFound)
+	}
+	return v, nil
+}
+
+func (s *stubStore) IncrementVerificationAttempts(addressID string) (model.VerificationCode, error) {
+	v, ok := s.codes[addressID]
+	if !ok {
+		return v, fmt.Errorf(notFound)
+	}
+	v.Attempts++
+	s.codes[addressID] = v
+	return v, nil
+}
+
+func (s *stubStore) DeleteVerificationCode(addressID string) error {
+	delete(s.codes, addressID)
+	return nil
+}
+
+func (s *stubStore) ListSchemas() ([]model.IdentitySchema, error) {
+	return s.schemas, nil
+}
+
+func (s *stubStore) GetSchema(id string) (model.IdentitySchema, error) {
+	if s.schemaErr != nil {
+		return model.IdentitySchema{}, s.schemaErr
+	}
+	for _, v := range s.schemas {
+		if v.ID == id {
+			return v, nil
+		}
+	}
+	return model.IdentitySchema{}, fmt.Errorf(notFound)
+}
+
+func (s *stubStore) PutSchema(schema model.IdentitySchema) error {
+	for i, v := range s.schemas {
+		if v.ID == schema.ID {
+			s.schemas[i] = schema
+			return nil
+		}
+	}
+	s.schemas = append(s.schemas, schema)
+	return nil
 }
 
 func (s *stubStore) List() ([]model.Identity, error) {
 	return s.identities, nil
 }
 
+func (s *stubStore) ListPage(q model.IdentityQuery) ([]model.Identity, error) {
+	s.lastQuery = q
+	l := []model.Identity{}
+	for _, v := range s.identities {
+		if v.ID > q.After && q.MatchIdentity(v) {
+			l = append(l, v)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	if q.Limit < len(l) {
+		l = l[:q.Limit]
+	}
+	return l, nil
+}
+
 func (s *stubStore) Get(id string) (model.Identity, error) {
 	var r model.Identity
 	e := fmt.Errorf(notFound)
@@ -44,14 +267,14 @@ func (s *stubStore) Create(i model.Identity) (model.Identity, error) {
 }
 
 func (s *stubStore) Update(id string, i model.Identity) (model.Identity, error) {
-	e := s.Delete(id)
+	e := s.Delete(id, 0)
 	if e != nil {
 		return model.Identity{}, e
 	}
 	return s.Create(i)
 }
 
-func (s *stubStore) Delete(id string) error {
+func (s *stubStore) Delete(id string, version int64) error {
 	var pos int
 	e := fmt.Errorf(notFound)
 	for i, v := range s.identities {
@@ -72,24 +295,122 @@ func (s *stubStore) NoRows(e error) bool {
 	return e.Error() == notFound
 }
 
+func (s *stubStore) Duplicate(e error) bool {
+	return false
+}
+
+func (s *stubStore) VersionMismatch(e error) bool {
+	return false
+}
+
 func TestList(t *testing.T) {
 	store := stubStore{identities: []model.Identity{model.Identity{ID: uuid.NewV4().String()}, model.Identity{ID: uuid.NewV4().String()}}}
-	srv := NewApp(&store)
+	srv := newTestApp(t, &store)
 	req, _ := http.NewRequest(http.MethodGet, "/identities", nil)
-	resp, err := srv.server.Test(req)
+	resp, err := srv.admin.Test(authorize(req))
 	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
 	body := []model.Identity{}
 	assertSussessJSONResponse(t, http.StatusOK, resp, &body)
-	assert.Equal(t, store.identities, body, "response list doesnt match store list")
+	assert.ElementsMatch(t, store.identities, body, "response list doesnt match store list")
+	assert.Empty(t, resp.Header.Get(HeaderKeyNextPageToken), "expected no next page")
+}
+
+func TestListPagination(t *testing.T) {
+	store := stubStore{identities: []model.Identity{
+		model.Identity{ID: uuid.NewV4().String()},
+		model.Identity{ID: uuid.NewV4().String()},
+		model.Identity{ID: uuid.NewV4().String()},
+	}}
+	srv := newTestApp(t, &store)
+	t.Run("should walk through all pages", func(t *testing.T) {
+		got := []model.Identity{}
+		path := "/identities?page_size=2"
+		for pages := 0; path != ""; pages++ {
+			testutil.FailOnEqual(t, pages, len(store.identities), "expected pagination to be finished")
+			req, _ := http.NewRequest(http.MethodGet, path, nil)
+			resp, err := srv.admin.Test(authorize(req))
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
+			body := []model.Identity{}
+			assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+			got = append(got, body...)
+			path = ""
+			if token := resp.Header.Get(HeaderKeyNextPageToken); token != "" {
+				path = "/identities?page_size=2&page_token=" + token
+				assert.Contains(t, resp.Header.Get("Link"), path, "expected link to the next page")
+			}
+		}
+		assert.ElementsMatch(t, store.identities, got, "paginated list doesnt match store list")
+		sorted := sort.SliceIsSorted(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+		assert.True(t, sorted, "expected identities to be ordered by id")
+	})
+	t.Run("should return bad request for invalid page size", func(t *testing.T) {
+		for _, v := range []string{"0", "-1", "a", "100000"} {
+			req, _ := http.NewRequest(http.MethodGet, "/identities?page_size="+v, nil)
+			resp, _ := srv.admin.Test(authorize(req))
+			assertErrorJSONResponse(t, http.StatusBadRequest, resp)
+		}
+	})
+	t.Run("should return bad request for invalid page token", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "/identities?page_token=not-a-token", nil)
+		resp, _ := srv.admin.Test(authorize(req))
+		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
+	})
+}
+
+func TestListFilters(t *testing.T) {
+	owner := model.Identity{
+		ID:                  uuid.NewV4().String(),
+		VerifiableAddresses: []model.VerifiableAddress{{Address: model.Address{Value: "alice@example.com", Via: "email"}, Verified: true}},
+	}
+	store := stubStore{identities: []model.Identity{owner, model.Identity{ID: uuid.NewV4().String()}}}
+	srv := newTestApp(t, &store)
+	t.Run("should pass filters to store", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "/identities?address=alice@example.com&via=email&verified=true&schema_id=default", nil)
+		resp, err := srv.admin.Test(authorize(req))
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
+		body := []model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		verified := true
+		assert.Equal(t, model.IdentityQuery{
+			Limit:    appconfig.Default().DefaultPageSize + 1,
+			Address:  "alice@example.com",
+			Via:      "email",
+			Verified: &verified,
+			SchemaID: "default",
+		}, store.lastQuery, "query filters don't match request")
+	})
+	t.Run("should find identity by address", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "/identities?address=alice@example.com", nil)
+		resp, _ := srv.admin.Test(authorize(req))
+		body := []model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		assert.Equal(t, []model.Identity{owner}, body, "expected to find only address owner")
+	})
+	t.Run("should keep filters in next page link", func(t *testing.T) {
+		store.identities = append(store.identities, model.Identity{
+			ID:                uuid.NewV4().String(),
+			RecoveryAddresses: []model.RecoveryAddress{{Address: model.Address{Value: "bob@example.com", Via: "email"}}},
+		})
+		req, _ := http.NewRequest(http.MethodGet, "/identities?via=email&page_size=1", nil)
+		resp, _ := srv.admin.Test(authorize(req))
+		body := []model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		assert.Contains(t, resp.Header.Get("Link"), "via=email", "expected filter to be kept in next page link")
+	})
+	t.Run("should return bad request for invalid verified filter", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "/identities?verified=maybe", nil)
+		resp, _ := srv.admin.Test(authorize(req))
+		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
+	})
 }
 
 func TestGet(t *testing.T) {
 	id := uuid.NewV4().String()
 	store := stubStore{identities: []model.Identity{model.Identity{ID: id}}}
-	srv := NewApp(&store)
+	srv := newTestApp(t, &store)
 	t.Run("should return existing identity", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodGet, "/identities/"+id, nil)
-		resp, err := srv.server.Test(req)
+		resp, err := srv.admin.Test(authorize(req))
 		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
 		body := model.Identity{}
 		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
@@ -97,12 +418,12 @@ func TestGet(t *testing.T) {
 	})
 	t.Run("should return bad request for invalid id format", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodGet, "/identities/1", nil)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
 	})
 	t.Run("should return not found for not existing id", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodGet, "/identities/"+uuid.NewV4().String(), nil)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusNotFound, resp)
 	})
 }
@@ -111,13 +432,13 @@ func TestCreate(t *testing.T) {
 	id := uuid.NewV4().String()
 	toCreate := model.Identity{ID: id}
 	store := stubStore{}
-	srv := NewApp(&store)
+	srv := newTestApp(t, &store)
 
 	t.Run("should create identity", func(t *testing.T) {
 		serializedIdentity, _ := json.Marshal(toCreate)
 		req, _ := http.NewRequest(http.MethodPost, "/identities", bytes.NewBuffer(serializedIdentity))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, err := srv.server.Test(req)
+		resp, err := srv.admin.Test(authorize(req))
 		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
 		body := model.Identity{}
 		assertSussessJSONResponse(t, http.StatusCreated, resp, &body)
@@ -127,15 +448,37 @@ func TestCreate(t *testing.T) {
 	t.Run("should return bad request for invalid json", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodPost, "/identities", bytes.NewBuffer([]byte("{")))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
 	})
 	t.Run("should return 422 for json schema mismatch", func(t *testing.T) {
-		req, _ := http.NewRequest(http.MethodPost, "/identities", bytes.NewBuffer([]byte("{}")))
+		req, _ := http.NewRequest(http.MethodPost, "/identities", bytes.NewBuffer([]byte(`{"id":"not-a-uuid"}`)))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, resp)
 	})
+	t.Run("should generate id when not provided", func(t *testing.T) {
+		for _, path := range []string{"/identities", "/admin/identities"} {
+			req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBuffer([]byte(`{"schema_id":"default"}`)))
+			req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
+			resp, err := srv.admin.Test(authorize(req))
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
+			body := model.Identity{}
+			assertSussessJSONResponse(t, http.StatusCreated, resp, &body)
+			_, err = uuid.FromString(body.ID)
+			assert.NoError(t, err, "expected generated id to be uuid")
+			assert.Equal(t, path+"/"+body.ID, resp.Header.Get(HeaderKeyLocation), "expected location of created identity")
+		}
+	})
+	t.Run("should validate against schema referenced by schema_id", func(t *testing.T) {
+		for schemaID, code := range map[string]int{"default": http.StatusCreated, "other": http.StatusCreated, "unknown": http.StatusUnprocessableEntity} {
+			serializedIdentity, _ := json.Marshal(model.Identity{ID: uuid.NewV4().String(), SchemaID: schemaID})
+			req, _ := http.NewRequest(http.MethodPost, "/identities", bytes.NewBuffer(serializedIdentity))
+			req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
+			resp, _ := srv.admin.Test(authorize(req))
+			assertStatus(t, code, resp.StatusCode, "for schema id "+schemaID)
+		}
+	})
 }
 
 func TestUpdate(t *testing.T) {
@@ -144,13 +487,13 @@ func TestUpdate(t *testing.T) {
 	toUpdate := model.Identity{ID: existingID}
 	newData := model.Identity{ID: newID}
 	store := stubStore{identities: []model.Identity{toUpdate}}
-	srv := NewApp(&store)
+	srv := newTestApp(t, &store)
 	serializedIdentity, _ := json.Marshal(newData)
 
 	t.Run("should uodate existing identity", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodPut, "/identities/"+existingID, bytes.NewBuffer(serializedIdentity))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, err := srv.server.Test(req)
+		resp, err := srv.admin.Test(authorize(req))
 		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
 		body := model.Identity{}
 		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
@@ -160,53 +503,518 @@ func TestUpdate(t *testing.T) {
 	t.Run("should return bad request for invalid id format", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodPut, "/identities/1", bytes.NewBuffer(serializedIdentity))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
 	})
 	t.Run("should return bad request for invalid json", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodPut, "/identities/"+existingID, bytes.NewBuffer([]byte("{")))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
 	})
 	t.Run("should return 422 for json schema mismatch", func(t *testing.T) {
-		req, _ := http.NewRequest(http.MethodPut, "/identities/"+existingID, bytes.NewBuffer([]byte("{}")))
+		req, _ := http.NewRequest(http.MethodPut, "/identities/"+existingID, bytes.NewBuffer([]byte(`{"id":"not-a-uuid"}`)))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, resp)
 	})
 	t.Run("should return not found for not existing id", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodPut, "/identities/"+uuid.NewV4().String(), bytes.NewBuffer(serializedIdentity))
 		req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
+		assertErrorJSONResponse(t, http.StatusNotFound, resp)
+	})
+}
+
+func TestPatch(t *testing.T) {
+	id := uuid.NewV4().String()
+	existing := model.Identity{
+		ID:       id,
+		SchemaID: "default",
+		VerifiableAddresses: []model.VerifiableAddress{
+			{Address: model.Address{ID: uuid.NewV4().String(), Value: "alice@example.com", Via: "email"}},
+		},
+	}
+	store := stubStore{identities: []model.Identity{existing}}
+	srv := newTestApp(t, &store)
+	patch := func(contentType, body string) *http.Response {
+		return sendRequest(t, srv.admin, http.MethodPatch, "/identities/"+id, body, adminHeaders(map[string]string{HeaderKeyContentType: contentType}))
+	}
+
+	t.Run("should apply json patch", func(t *testing.T) {
+		resp := patch(HeaderValueJSONPatchJSONContentType, `[{"op":"replace","path":"/verifiable_addresses/0/verified","value":true}]`)
+		body := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		expected := existing
+		expected.VerifiableAddresses = []model.VerifiableAddress{existing.VerifiableAddresses[0]}
+		expected.VerifiableAddresses[0].Verified = true
+		assert.Equal(t, expected, body, "response identity doesnt match patched identity")
+		assert.Equal(t, expected, store.identities[0], "store identity doesnt match patched identity")
+	})
+	t.Run("should apply merge patch", func(t *testing.T) {
+		resp := patch(HeaderValueMergePatchJSONContentType+"; charset=utf-8", `{"schema_id":"other"}`)
+		body := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		assert.Equal(t, "other", body.SchemaID, "expected schema id to be patched")
+		assert.True(t, body.VerifiableAddresses[0].Verified, "expected not patched fields to be kept")
+	})
+	t.Run("should return 415 for unsupported content type", func(t *testing.T) {
+		resp := patch(HeaderValueJSONContactType, `{"schema_id":"other"}`)
+		assertErrorJSONResponse(t, http.StatusUnsupportedMediaType, resp)
+	})
+	t.Run("should return bad request for invalid patch", func(t *testing.T) {
+		resp := patch(HeaderValueJSONPatchJSONContentType, `{`)
+		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
+		resp = patch(HeaderValueJSONPatchJSONContentType, `{"op":"replace"}`)
+		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
+	})
+	t.Run("should return 422 for failed patch operation", func(t *testing.T) {
+		resp := patch(HeaderValueJSONPatchJSONContentType, `[{"op":"test","path":"/schema_id","value":"unexpected"}]`)
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, resp)
+	})
+	t.Run("should return 422 for json schema mismatch", func(t *testing.T) {
+		resp := patch(HeaderValueMergePatchJSONContentType, `{"id":"not-uuid"}`)
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, resp)
+	})
+	t.Run("should return not found for not existing id", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPatch, "/identities/"+uuid.NewV4().String(), bytes.NewBuffer([]byte(`{}`)))
+		req.Header.Set(HeaderKeyContentType, HeaderValueMergePatchJSONContentType)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusNotFound, resp)
 	})
 }
 
+func TestSchemas(t *testing.T) {
+	store := stubStore{schemas: []model.IdentitySchema{
+		{ID: "stored", Schema: json.RawMessage(`{"type":"object","required":["id","traits"]}`)},
+	}}
+	srv := newTestApp(t, &store)
+	send := func(method, path, body string) *http.Response {
+		return sendRequest(t, srv.admin, method, path, body, adminHeaders(nil))
+	}
+
+	t.Run("should list configured and stored schemas", func(t *testing.T) {
+		body := []model.IdentitySchemaRef{}
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodGet, "/schemas", "", nil), &body)
+		assert.Equal(t, []model.IdentitySchemaRef{
+			{ID: "default", URL: "/schemas/default"},
+			{ID: "other", URL: "/schemas/other"},
+			{ID: "stored", URL: "/schemas/stored"},
+		}, body)
+	})
+	t.Run("should return schema document", func(t *testing.T) {
+		body := map[string]interface{}{}
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodGet, "/schemas/default", "", nil), &body)
+		assert.Equal(t, "object", body["type"])
+		assertErrorJSONResponse(t, http.StatusNotFound, sendRequest(t, srv.public, http.MethodGet, "/schemas/unknown", "", nil))
+	})
+	t.Run("should put schema and validate identities against it", func(t *testing.T) {
+		identity := fmt.Sprintf(`{"id":"%s","schema_id":"customer"}`, uuid.NewV4().String())
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, send(http.MethodPost, "/identities", identity))
+		body := model.IdentitySchemaRef{}
+		resp := send(http.MethodPut, "/admin/schemas/customer", `{"type":"object","required":["id","verifiable_addresses"]}`)
+		assertSussessJSONResponse(t, http.StatusCreated, resp, &body)
+		assert.Equal(t, model.IdentitySchemaRef{ID: "customer", URL: "/schemas/customer"}, body)
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, send(http.MethodPost, "/identities", identity))
+		resp = send(http.MethodPut, "/admin/schemas/customer", `{"type":"object"}`)
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		resp = send(http.MethodPost, "/identities", identity)
+		assertStatus(t, http.StatusCreated, resp.StatusCode, "identity must match replaced schema")
+		assert.Len(t, store.schemas, 2, "expected schema to be persisted")
+	})
+	t.Run("should load schema stored by other instance", func(t *testing.T) {
+		store.PutSchema(model.IdentitySchema{ID: "late", Schema: json.RawMessage(`{"type":"object"}`)})
+		identity := fmt.Sprintf(`{"id":"%s","schema_id":"late"}`, uuid.NewV4().String())
+		assertStatus(t, http.StatusCreated, send(http.MethodPost, "/identities", identity).StatusCode, "")
+	})
+	t.Run("should reload schema replaced by other instance", func(t *testing.T) {
+		store.PutSchema(model.IdentitySchema{ID: "late", Schema: json.RawMessage(`{"type":"object","required":["traits"]}`)})
+		identity := fmt.Sprintf(`{"id":"%s","schema_id":"late"}`, uuid.NewV4().String())
+		assertStatus(t, http.StatusCreated, send(http.MethodPost, "/identities", identity).StatusCode, "loaded schema must be trusted until sync interval passes")
+		now := time.Now().Add(schemaSyncInterval)
+		srv.now = func() time.Time { return now }
+		identity = fmt.Sprintf(`{"id":"%s","schema_id":"late"}`, uuid.NewV4().String())
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, send(http.MethodPost, "/identities", identity))
+		body := map[string]interface{}{}
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodGet, "/schemas/late", "", nil), &body)
+		assert.Equal(t, []interface{}{"traits"}, body["required"], "expected replaced schema to be served")
+	})
+	t.Run("should reject replacing default schema", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusConflict, send(http.MethodPut, "/admin/schemas/default", `{"type":"object"}`))
+		body := map[string]interface{}{}
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodGet, "/schemas/default", "", nil), &body)
+		assert.NotEqual(t, map[string]interface{}{"type": "object"}, body, "expected built-in schema to be kept")
+	})
+	t.Run("should fail validation when stored schema can't be read", func(t *testing.T) {
+		now := time.Now().Add(2 * schemaSyncInterval)
+		srv.now = func() time.Time { return now }
+		store.schemaErr = fmt.Errorf("connection refused")
+		defer func() { store.schemaErr = nil }()
+		identity := fmt.Sprintf(`{"id":"%s","schema_id":"late"}`, uuid.NewV4().String())
+		assertErrorJSONResponse(t, http.StatusInternalServerError, send(http.MethodPost, "/identities", identity))
+		assertErrorJSONResponse(t, http.StatusInternalServerError, sendRequest(t, srv.public, http.MethodGet, "/schemas/late", "", nil))
+	})
+	t.Run("should not read store or remember sync of unknown schema ids", func(t *testing.T) {
+		store.schemaErr = fmt.Errorf("connection refused")
+		assertErrorJSONResponse(t, http.StatusNotFound, sendRequest(t, srv.public, http.MethodGet, "/schemas/in%20valid", "", nil))
+		assertErrorJSONResponse(t, http.StatusNotFound, sendRequest(t, srv.public, http.MethodGet, "/schemas/"+strings.Repeat("x", 65), "", nil))
+		store.schemaErr = nil
+		assertErrorJSONResponse(t, http.StatusNotFound, sendRequest(t, srv.public, http.MethodGet, "/schemas/missing", "", nil))
+		srv.schemaSyncedMu.Lock()
+		_, synced := srv.schemaSynced["missing"]
+		srv.schemaSyncedMu.Unlock()
+		assert.False(t, synced, "expected missing schema not to be remembered")
+	})
+	t.Run("should keep default schema over stored one", func(t *testing.T) {
+		stored := stubStore{schemas: []model.IdentitySchema{{ID: "default", Schema: json.RawMessage(`{"type":"object"}`)}}}
+		app := newTestApp(t, &stored)
+		body := map[string]interface{}{}
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, app.public, http.MethodGet, "/schemas/default", "", nil), &body)
+		assert.NotEqual(t, map[string]interface{}{"type": "object"}, body, "expected built-in schema to be kept")
+	})
+	t.Run("should reject invalid schema", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusBadRequest, send(http.MethodPut, "/admin/schemas/invalid", "{"))
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, send(http.MethodPut, "/admin/schemas/invalid", `{"type":1}`))
+		assertErrorJSONResponse(t, http.StatusBadRequest, send(http.MethodPut, "/admin/schemas/in%20valid", `{}`))
+	})
+}
+
+func TestTraits(t *testing.T) {
+	store := stubStore{schemas: []model.IdentitySchema{{ID: "customer", Schema: json.RawMessage(`{
+		"type": "object",
+		"properties": {"traits": {"type": "object", "required": ["email"], "properties": {"email": {"type": "string", "format": "email"}}}}
+	}`)}}}
+	srv := newTestApp(t, &store)
+	create := func(traits string) *http.Response {
+		body := fmt.Sprintf(`{"id":"%s","schema_id":"customer","traits":%s}`, uuid.NewV4().String(), traits)
+		return sendRequest(t, srv.admin, http.MethodPost, "/identities", body, adminHeaders(nil))
+	}
+
+	t.Run("should store traits", func(t *testing.T) {
+		body := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusCreated, create(`{"email":"alice@example.com","name":{"first":"Alice"}}`), &body)
+		expected := model.JSONObject{"email": "alice@example.com", "name": map[string]interface{}{"first": "Alice"}}
+		assert.Equal(t, expected, body.Traits, "response traits doesnt match request traits")
+		assert.Equal(t, expected, store.identities[0].Traits, "stored traits doesnt match request traits")
+	})
+	t.Run("should return 422 for traits not matching schema", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, create(`{"name":"Alice"}`))
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, create(`{"email":"not an email"}`))
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, create(`"alice@example.com"`))
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	id := uuid.NewV4().String()
+	send := func(method, path, contentType, body string) *http.Response {
+		return sendRequest(t, srv.admin, method, path, body, adminHeaders(map[string]string{HeaderKeyContentType: contentType}))
+	}
+	adminMetadata := model.JSONObject{"fraud_score": float64(1)}
+	assertAdminMetadata := func(t *testing.T, msg string) {
+		stored, err := store.Get(id)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		assert.Equal(t, adminMetadata, stored.MetadataAdmin, msg)
+	}
+
+	t.Run("should discard admin metadata on public create", func(t *testing.T) {
+		other := uuid.NewV4().String()
+		body := fmt.Sprintf(`{"id":"%s","metadata_admin":{"fraud_score":1}}`, other)
+		resp := send(http.MethodPost, "/identities", HeaderValueJSONContactType, body)
+		assertStatus(t, http.StatusCreated, resp.StatusCode, "")
+		stored, _ := store.Get(other)
+		assert.Nil(t, stored.MetadataAdmin, "expected admin metadata to be discarded")
+	})
+	t.Run("should create identity with admin metadata on admin route", func(t *testing.T) {
+		body := fmt.Sprintf(`{"id":"%s","metadata_public":{"plan":"free"},"metadata_admin":{"fraud_score":1}}`, id)
+		created := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusCreated, send(http.MethodPost, "/admin/identities", HeaderValueJSONContactType, body), &created)
+		assert.Equal(t, adminMetadata, created.MetadataAdmin)
+		assert.Equal(t, model.JSONObject{"plan": "free"}, created.MetadataPublic)
+	})
+	t.Run("should hide admin metadata on public routes", func(t *testing.T) {
+		resp := send(http.MethodGet, "/identities/"+id, "", "")
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.NotContains(t, string(b), "metadata_admin")
+		assert.Contains(t, string(b), `"metadata_public":{"plan":"free"}`)
+		resp = send(http.MethodGet, "/identities", "", "")
+		b, _ = ioutil.ReadAll(resp.Body)
+		assert.NotContains(t, string(b), "metadata_admin")
+		found := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, send(http.MethodGet, "/admin/identities/"+id, "", ""), &found)
+		assert.Equal(t, adminMetadata, found.MetadataAdmin, "expected admin metadata on admin route")
+		l := []model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, send(http.MethodGet, "/admin/identities", "", ""), &l)
+		assert.Equal(t, 2, len(l))
+	})
+	t.Run("should keep admin metadata on public update", func(t *testing.T) {
+		body := fmt.Sprintf(`{"id":"%s","metadata_public":{"plan":"pro"},"metadata_admin":{"fraud_score":0}}`, id)
+		updated := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, send(http.MethodPut, "/identities/"+id, HeaderValueJSONContactType, body), &updated)
+		assert.Nil(t, updated.MetadataAdmin, "expected admin metadata to be hidden")
+		assert.Equal(t, model.JSONObject{"plan": "pro"}, updated.MetadataPublic)
+		assertAdminMetadata(t, "expected admin metadata to be kept")
+	})
+	t.Run("should keep admin metadata on public patch", func(t *testing.T) {
+		resp := send(http.MethodPatch, "/identities/"+id, HeaderValueMergePatchJSONContentType, `{"metadata_admin":{"fraud_score":0}}`)
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+		assertAdminMetadata(t, "expected admin metadata to be kept")
+		resp = send(http.MethodPatch, "/identities/"+id, HeaderValueJSONPatchJSONContentType, `[{"op":"remove","path":"/metadata_admin"}]`)
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, resp)
+	})
+	t.Run("should change admin metadata on admin routes", func(t *testing.T) {
+		resp := send(http.MethodPatch, "/admin/identities/"+id, HeaderValueMergePatchJSONContentType, `{"metadata_admin":{"fraud_score":2}}`)
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+		adminMetadata = model.JSONObject{"fraud_score": float64(2)}
+		assertAdminMetadata(t, "expected admin metadata to be patched")
+		body := fmt.Sprintf(`{"id":"%s","metadata_admin":{"fraud_score":3}}`, id)
+		resp = send(http.MethodPut, "/admin/identities/"+id, HeaderValueJSONContactType, body)
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+		adminMetadata = model.JSONObject{"fraud_score": float64(3)}
+		assertAdminMetadata(t, "expected admin metadata to be replaced")
+	})
+}
+
 func TestDelete(t *testing.T) {
 	id := uuid.NewV4().String()
 	store := stubStore{identities: []model.Identity{model.Identity{ID: id}}}
-	srv := NewApp(&store)
+	srv := newTestApp(t, &store)
 
 	t.Run("should delete existing identity", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodDelete, "/identities/"+id, nil)
-		resp, err := srv.server.Test(req)
+		resp, err := srv.admin.Test(authorize(req))
 		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
 		assertStatus(t, http.StatusNoContent, resp.StatusCode, "")
 		assert.Equal(t, len(store.identities), 0, "identity was not deleted from store")
 	})
 	t.Run("should return bad request for invalid id format", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodDelete, "/identities/1", nil)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
 	})
 	t.Run("should return not found for not existing id", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodDelete, "/identities/"+uuid.NewV4().String(), nil)
-		resp, _ := srv.server.Test(req)
+		resp, _ := srv.admin.Test(authorize(req))
 		assertErrorJSONResponse(t, http.StatusNotFound, resp)
 	})
 }
 
+func TestETag(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	i, _ := store.Create(model.Identity{ID: uuid.NewV4().String(), SchemaID: "default"})
+	path := "/identities/" + i.ID
+	send := func(method, body string, headers map[string]string) *http.Response {
+		return sendRequest(t, srv.admin, method, path, body, adminHeaders(headers))
+	}
+	serialized, _ := json.Marshal(i)
+	putHeaders := func(ifMatch string) map[string]string {
+		return map[string]string{HeaderKeyContentType: HeaderValueJSONContactType, HeaderKeyIfMatch: ifMatch}
+	}
+
+	t.Run("should return etag on get", func(t *testing.T) {
+		resp := send(http.MethodGet, "", nil)
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+		assert.Equal(t, `"1"`, resp.Header.Get(HeaderKeyETag), "expected etag to contain identity version")
+	})
+	t.Run("should return not modified for matching If-None-Match", func(t *testing.T) {
+		resp := send(http.MethodGet, "", map[string]string{HeaderKeyIfNoneMatch: `"1"`})
+		assertStatus(t, http.StatusNotModified, resp.StatusCode, "")
+		resp = send(http.MethodGet, "", map[string]string{HeaderKeyIfNoneMatch: `"2"`})
+		assertStatus(t, http.StatusOK, resp.StatusCode, "")
+	})
+	t.Run("should update matching If-Match", func(t *testing.T) {
+		resp := send(http.MethodPut, string(serialized), putHeaders(`"1"`))
+		body := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		assert.Equal(t, `"2"`, resp.Header.Get(HeaderKeyETag), "expected etag to contain new identity version")
+		assert.Equal(t, int64(2), body.Version, "expected version to be incremented")
+	})
+	t.Run("should return 412 for outdated If-Match", func(t *testing.T) {
+		resp := send(http.MethodPut, string(serialized), putHeaders(`"1"`))
+		assertErrorJSONResponse(t, http.StatusPreconditionFailed, resp)
+		resp = send(http.MethodPatch, `{"schema_id":"other"}`, map[string]string{
+			HeaderKeyContentType: HeaderValueMergePatchJSONContentType,
+			HeaderKeyIfMatch:     `"1"`,
+		})
+		assertErrorJSONResponse(t, http.StatusPreconditionFailed, resp)
+		resp = send(http.MethodDelete, "", map[string]string{HeaderKeyIfMatch: `"1"`})
+		assertErrorJSONResponse(t, http.StatusPreconditionFailed, resp)
+	})
+	t.Run("should return 412 for weak If-Match", func(t *testing.T) {
+		resp := send(http.MethodPut, string(serialized), putHeaders(`W/"2"`))
+		assertErrorJSONResponse(t, http.StatusPreconditionFailed, resp)
+		resp = send(http.MethodDelete, "", map[string]string{HeaderKeyIfMatch: `W/"2"`})
+		assertErrorJSONResponse(t, http.StatusPreconditionFailed, resp)
+	})
+	t.Run("should return not modified for weak If-None-Match", func(t *testing.T) {
+		resp := send(http.MethodGet, "", map[string]string{HeaderKeyIfNoneMatch: `W/"2"`})
+		assertStatus(t, http.StatusNotModified, resp.StatusCode, "")
+	})
+	t.Run("should return bad request for invalid If-Match", func(t *testing.T) {
+		resp := send(http.MethodPut, string(serialized), putHeaders("1"))
+		assertErrorJSONResponse(t, http.StatusBadRequest, resp)
+	})
+	t.Run("should patch matching If-Match", func(t *testing.T) {
+		resp := send(http.MethodPatch, `{"schema_id":"other"}`, map[string]string{
+			HeaderKeyContentType: HeaderValueMergePatchJSONContentType,
+			HeaderKeyIfMatch:     `"2"`,
+		})
+		body := model.Identity{}
+		assertSussessJSONResponse(t, http.StatusOK, resp, &body)
+		assert.Equal(t, `"3"`, resp.Header.Get(HeaderKeyETag), "expected etag to contain new identity version")
+	})
+	t.Run("should delete matching If-Match", func(t *testing.T) {
+		resp := send(http.MethodDelete, "", map[string]string{HeaderKeyIfMatch: `"3"`})
+		assertStatus(t, http.StatusNoContent, resp.StatusCode, "")
+	})
+}
+
+func TestRouters(t *testing.T) {
+	srv := newTestApp(t, &memstore.Store{})
+	send := func(app *fiber.App, method, path string) int {
+		return sendRequest(t, app, method, path, `{"address":"alice@example.com","via":"email"}`, adminHeaders(nil)).StatusCode
+	}
+	for _, path := range []string{"/identities", "/admin/identities"} {
+		assertStatus(t, http.StatusOK, send(srv.admin, http.MethodGet, path), "admin route on admin router")
+		assertStatus(t, http.StatusNotFound, send(srv.public, http.MethodGet, path), "admin route on public router")
+	}
+	for _, path := range []string{"/schemas", "/schemas/default"} {
+		assertStatus(t, http.StatusOK, sendRequest(t, srv.public, http.MethodGet, path, "", nil).StatusCode, "schema route on public router without credentials")
+		assertStatus(t, http.StatusNotFound, send(srv.admin, http.MethodGet, path), "schema route on admin router")
+	}
+	assertStatus(t, http.StatusNotFound, send(srv.public, http.MethodPut, "/admin/schemas/customer"), "admin schema route on public router")
+	assertStatus(t, http.StatusAccepted, send(srv.public, http.MethodPost, "/recovery"), "self-service route on public router")
+	assertStatus(t, http.StatusNotFound, send(srv.admin, http.MethodPost, "/recovery"), "self-service route on admin router")
+	assertStatus(t, http.StatusUnauthorized, send(srv.public, http.MethodGet, "/sessions/whoami"), "self-service route on public router")
+	assertStatus(t, http.StatusNotFound, send(srv.admin, http.MethodGet, "/sessions/whoami"), "self-service route on admin router")
+}
+
+func TestShutdown(t *testing.T) {
+	srv := newTestApp(t, &memstore.Store{})
+	started := make(chan struct{})
+	srv.public.Get("/slow", func(c *fiber.Ctx) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(public, admin) }()
+	// idle keep-alive connections are closed by idle timeout which is too long for the test
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + admin.Addr().String() + "/identities")
+	require.NoError(t, err, "expected admin listener to serve")
+	resp.Body.Close()
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := client.Get("http://" + public.Addr().String() + "/slow")
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	assert.Equal(t, http.StatusOK, <-responses, "expected in-flight request to be drained")
+	assert.NoError(t, <-served)
+	_, err = client.Get("http://" + admin.Addr().String() + "/identities")
+	assert.Error(t, err, "expected admin listener to be closed")
+}
+
+func TestShutdownDelay(t *testing.T) {
+	srv := newTestApp(t, &memstore.Store{})
+	srv.cfg.ShutdownDelay = appconfig.Duration{Duration: 500 * time.Millisecond}
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(public, admin) }()
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	ready := func(l net.Listener) (int, error) {
+		resp, err := client.Get("http://" + l.Addr().String() + "/health/ready")
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	code, err := ready(public)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	for _, l := range []net.Listener{public, admin} {
+		code, err = ready(l)
+		require.NoError(t, err, "expected listeners to accept connections during shutdown delay")
+		assert.Equal(t, http.StatusServiceUnavailable, code, "expected readiness to fail during shutdown delay")
+	}
+	require.NoError(t, <-stopped)
+	assert.NoError(t, <-served)
+	_, err = ready(public)
+	assert.Error(t, err, "expected public listener to be closed after shutdown delay")
+}
+
+func newTestApp(t *testing.T, s Store) *IdentApp {
+	cfg := appconfig.Default()
+	cfg.IdentitySchemas = map[string]string{"other": "../model/schema.json"}
+	cfg.Password.Argon2.Memory = 1024
+	cfg.ShutdownDelay = appconfig.Duration{}
+	cfg.Auth.APIKeys = []appconfig.APIKeyConfig{{Name: "test", Hash: auth.HashAPIKey(testAPIKey), Scopes: []string{auth.ScopeAdmin}}}
+	app, err := NewApp(s, cfg)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("could not init app %v", err))
+	return app
+}
+
+// testAPIKey authenticates requests of tests which are not about authentication
+const testAPIKey = "test-api-key"
+
+// authorize sets the test API key to the request unless it has other credentials
+func authorize(req *http.Request) *http.Request {
+	if req.Header.Get(HeaderKeyAuthorization) == "" {
+		req.Header.Set(HeaderKeyAuthorization, "Bearer "+testAPIKey)
+	}
+	return req
+}
+
+// sendRequest serves a request with JSON body by the router and fails the test when it can't be served.
+// Headers are set over the JSON content type, so they may replace it
+func sendRequest(t *testing.T, app *fiber.App, method, path, body string, headers map[string]string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+	req.Header.Set(HeaderKeyContentType, HeaderValueJSONContactType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := app.Test(req)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("got an error while serving http request %v", err))
+	return resp
+}
+
+// adminHeaders returns headers authorized by the test API key unless they have other credentials
+func adminHeaders(headers map[string]string) map[string]string {
+	res := map[string]string{HeaderKeyAuthorization: "Bearer " + testAPIKey}
+	for k, v := range headers {
+		res[k] = v
+	}
+	return res
+}
+
+// sessionHeaders returns headers authenticated by the session token
+func sessionHeaders(token string) map[string]string {
+	return map[string]string{HeaderKeySessionToken: token}
+}
+
 func assertStatus(t *testing.T, want, got int, message string) {
 	t.Helper()
 	testutil.FailOnNotEqual(t, want, got, fmt.Sprintf("didn't get correct status. got %d instead of %d. %s", got, want, message))
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// sessionTokenSize is a number of random bytes in session tokens
+const sessionTokenSize = 32
+
+// sessionSubject binds hashes of session tokens, so they differ from hashes of other secrets
+const sessionSubject = "session"
+
+var errUnauthenticated = errors.New("missing, invalid or expired session token")
+
+// HandleLogin authenticates identity by password credentials and issues a session.
+// Identities with enabled totp also pass a totp or recovery code and get an aal2 session.
+// The session token is returned once in the response body and in the session cookie
+func (a *IdentApp) HandleLogin(c *fiber.Ctx) {
+	var r model.LoginRequest
+	if err := json.Unmarshal([]byte(c.Body()), &r); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(r.Identifier) == "" || r.Password == "" {
+		writeError(c, http.StatusBadRequest, errors.New("identifier and password must not be empty"))
+		return
+	}
+	i, err := a.authenticatePassword(r.Identifier, r.Password)
+	if err == errInvalidCredentials {
+		writeError(c, http.StatusUnauthorized, err)
+		return
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	aal := model.AAL1
+	if cred, ok := i.Credentials[model.CredentialsTOTP]; ok && cred.TOTPSecret() != "" {
+		if err = a.verifySecondFactor(i.ID, r.TOTPCode, r.RecoveryCode); err != nil {
+			writeError(c, a.secondFactorStatus(err, http.StatusUnauthorized), err)
+			return
+		}
+		aal = model.AAL2
+	}
+	s, err := a.issueSession(c, i.ID, aal, false, a.cfg.Session.TTL.Duration)
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	writeSuccess(c, http.StatusCreated, s)
+}
+
+// HandleWhoami resolves the session token of the request to its session and identity
+func (a *IdentApp) HandleWhoami(c *fiber.Ctx) {
+	s, i, ok := a.currentSession(c)
+	if !ok {
+		return
+	}
+	writeSuccess(c, http.StatusOK, model.SessionInfo{Session: s, Identity: publicView(i)})
+}
+
+// HandleLogout revokes the session of the request
+func (a *IdentApp) HandleLogout(c *fiber.Ctx) {
+	s, _, ok := a.currentSession(c)
+	if !ok {
+		return
+	}
+	if err := a.store.DeleteSession(s.TokenHash); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	c.ClearCookie(a.cfg.Session.CookieName)
+	c.Status(http.StatusNoContent)
+}
+
+// issueSession creates a session of the identity for the client of the request and sets the session cookie
+func (a *IdentApp) issueSession(c *fiber.Ctx, identityID, aal string, privileged bool, ttl time.Duration) (model.SessionToken, error) {
+	token, err := newToken(sessionTokenSize)
+	if err != nil {
+		return model.SessionToken{}, err
+	}
+	now := a.now().UTC().Truncate(time.Millisecond)
+	s := model.Session{
+		ID:         uuid.NewV4().String(),
+		TokenHash:  hashSecret(sessionSubject, token),
+		IdentityID: identityID,
+		Privileged: privileged,
+		AAL:        aal,
+		IP:         c.IP(),
+		UserAgent:  c.Get(HeaderKeyUserAgent),
+		ExpiresAt:  now.Add(ttl),
+		CreatedAt:  now,
+	}
+	if err = a.store.CreateSession(s); err != nil {
+		return model.SessionToken{}, err
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     a.cfg.Session.CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  s.ExpiresAt,
+		Secure:   a.cfg.Session.CookieSecure,
+		HTTPOnly: true,
+		SameSite: "lax",
+	})
+	return model.SessionToken{Token: token, Session: s}, nil
+}
+
+// currentSession returns not expired session of the request token and its identity.
+// It writes unauthorized response when there is no such session
+func (a *IdentApp) currentSession(c *fiber.Ctx) (model.Session, model.Identity, bool) {
+	token := c.Get(HeaderKeySessionToken)
+	if token == "" {
+		token = c.Cookies(a.cfg.Session.CookieName)
+	}
+	if token == "" {
+		writeError(c, http.StatusUnauthorized, errUnauthenticated)
+		return model.Session{}, model.Identity{}, false
+	}
+	s, err := a.store.GetSession(hashSecret(sessionSubject, token))
+	if err != nil && a.store.NoRows(err) {
+		writeError(c, http.StatusUnauthorized, errUnauthenticated)
+		return s, model.Identity{}, false
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return s, model.Identity{}, false
+	}
+	if s.Expired(a.now()) {
+		if err = a.store.DeleteSession(s.TokenHash); err != nil {
+			writeError(c, a.statusFromDBErr(err), err)
+			return s, model.Identity{}, false
+		}
+		writeError(c, http.StatusUnauthorized, errUnauthenticated)
+		return s, model.Identity{}, false
+	}
+	i, err := a.store.Get(s.IdentityID)
+	if err != nil && a.store.NoRows(err) {
+		writeError(c, http.StatusUnauthorized, errUnauthenticated)
+		return s, i, false
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return s, i, false
+	}
+	return s, i, true
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+)
+
+func TestSessions(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	now := time.Now()
+	srv.now = func() time.Time { return now }
+	i, _ := store.Create(model.Identity{ID: uuid.NewV4().String(), MetadataAdmin: model.JSONObject{"secret": true}})
+	hash, err := srv.hasher.Hash("correct horse")
+	require.NoError(t, err)
+	require.NoError(t, store.PutCredentials(model.Credentials{
+		IdentityID:  i.ID,
+		Type:        model.CredentialsPassword,
+		Identifiers: []string{"alice@example.com"},
+		Config:      model.JSONObject{model.PasswordConfigKey: hash},
+	}))
+	login := func(identifier, password string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/sessions", fmt.Sprintf(`{"identifier":%q,"password":%q}`, identifier, password), map[string]string{HeaderKeyUserAgent: "session-test"})
+	}
+	whoami := func(header map[string]string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodGet, "/sessions/whoami", "", header)
+	}
+	token := ""
+
+	t.Run("should issue session on login", func(t *testing.T) {
+		resp := login("Alice@example.com", "correct horse")
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusCreated, resp, &body)
+		token = body.Token
+		assert.NotEmpty(t, token)
+		assert.Equal(t, i.ID, body.Session.IdentityID)
+		assert.False(t, body.Session.Privileged)
+		assert.Equal(t, model.AAL1, body.Session.AAL)
+		assert.Equal(t, "session-test", body.Session.UserAgent)
+		assert.True(t, body.Session.ExpiresAt.Equal(now.Add(srv.cfg.Session.TTL.Duration).Truncate(time.Millisecond)))
+		s, err := store.GetSession(hashSecret(sessionSubject, token))
+		require.NoError(t, err, "expected session to be stored by token hash")
+		assert.Equal(t, body.Session.ID, s.ID)
+		cookie := resp.Header.Get("Set-Cookie")
+		assert.Contains(t, cookie, srv.cfg.Session.CookieName+"="+token)
+		assert.Contains(t, cookie, "HttpOnly")
+	})
+	t.Run("should reject invalid credentials", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login("alice@example.com", "wrong horse"))
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login("bob@example.com", "correct horse"))
+		assertErrorJSONResponse(t, http.StatusBadRequest, login("", "correct horse"))
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/sessions", "{", nil))
+	})
+	t.Run("should hash passwords of unknown identifiers like known ones", func(t *testing.T) {
+		assert.NotEmpty(t, srv.dummyHash)
+		assert.False(t, srv.hasher.NeedsRehash(srv.dummyHash), "expected dummy hash to have configured parameters")
+		_, err := srv.authenticatePassword("bob@example.com", "dummy password")
+		assert.Equal(t, errInvalidCredentials, err, "expected dummy hash not to authenticate")
+	})
+	t.Run("should resolve session by header or cookie", func(t *testing.T) {
+		for _, header := range []map[string]string{
+			{HeaderKeySessionToken: token},
+			{"Cookie": srv.cfg.Session.CookieName + "=" + token},
+		} {
+			body := model.SessionInfo{}
+			assertSussessJSONResponse(t, http.StatusOK, whoami(header), &body)
+			assert.Equal(t, i.ID, body.Identity.ID)
+			assert.Equal(t, i.ID, body.Session.IdentityID)
+			assert.Nil(t, body.Identity.MetadataAdmin, "expected admin metadata to be hidden")
+		}
+	})
+	t.Run("should reject missing or unknown token", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnauthorized, whoami(nil))
+		assertErrorJSONResponse(t, http.StatusUnauthorized, whoami(map[string]string{HeaderKeySessionToken: "unknown"}))
+	})
+	t.Run("should reject and remove expired session", func(t *testing.T) {
+		now = now.Add(srv.cfg.Session.TTL.Duration)
+		defer func() { now = now.Add(-srv.cfg.Session.TTL.Duration) }()
+		assertErrorJSONResponse(t, http.StatusUnauthorized, whoami(map[string]string{HeaderKeySessionToken: token}))
+		_, err := store.GetSession(hashSecret(sessionSubject, token))
+		assert.True(t, store.NoRows(err), "expected expired session to be deleted")
+	})
+	t.Run("should revoke session on logout", func(t *testing.T) {
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusCreated, login("alice@example.com", "correct horse"), &body)
+		header := map[string]string{HeaderKeySessionToken: body.Token}
+		assertStatus(t, http.StatusNoContent, sendRequest(t, srv.public, http.MethodDelete, "/sessions", "", header).StatusCode, "")
+		assertErrorJSONResponse(t, http.StatusUnauthorized, whoami(header))
+		assertErrorJSONResponse(t, http.StatusUnauthorized, sendRequest(t, srv.public, http.MethodDelete, "/sessions", "", header))
+	})
+	t.Run("should end session of deleted identity", func(t *testing.T) {
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusCreated, login("alice@example.com", "correct horse"), &body)
+		require.NoError(t, store.Delete(i.ID, 0))
+		assertErrorJSONResponse(t, http.StatusUnauthorized, whoami(map[string]string{HeaderKeySessionToken: body.Token}))
+	})
+}
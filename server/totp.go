@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/totp"
+)
+
+// recoveryCodeSize is a number of random bytes in totp recovery codes
+const recoveryCodeSize = 8
+
+// totpRecoverySubject binds hashes of totp recovery codes, so they differ from hashes of other secrets
+const totpRecoverySubject = "totp_recovery"
+
+var (
+	errSecondFactorRequired = errors.New("totp code or recovery code is required")
+	errInvalidSecondFactor  = errors.New("invalid totp code or recovery code")
+	errInvalidTOTPCode      = errors.New("invalid totp code")
+	errNoPendingTOTP        = errors.New("no pending totp enrollment")
+	errStepUpRequired       = errors.New("replacing totp requires an aal2 session or a recovery code")
+	errSecondFactorLocked   = errors.New("too many totp or recovery code attempts, try again later")
+)
+
+// HandleStartTOTP generates a totp secret for the identity of the session. The secret is pending
+// until confirmed by its first code, so enabled totp keeps working meanwhile. Sessions without
+// a second factor replace enabled totp by spending a recovery code
+func (a *IdentApp) HandleStartTOTP(c *fiber.Ctx) {
+	var r model.TOTPStartRequest
+	if body := c.Body(); strings.TrimSpace(body) != "" {
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			writeError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	s, i, ok := a.currentSession(c)
+	if !ok {
+		return
+	}
+	cred, enrolled := i.Credentials[model.CredentialsTOTP]
+	pendingSession := ""
+	if !canReplaceTOTP(s, cred) {
+		if strings.TrimSpace(r.RecoveryCode) == "" {
+			writeError(c, http.StatusForbidden, errStepUpRequired)
+			return
+		}
+		if err := a.verifySecondFactor(i.ID, "", r.RecoveryCode); err != nil {
+			writeError(c, a.secondFactorStatus(err, http.StatusForbidden), err)
+			return
+		}
+		pendingSession = s.ID
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	now := a.now().UTC().Truncate(time.Millisecond)
+	if enrolled {
+		// pending keys are merged into stored config, so codes consumed meanwhile are not restored
+		set, unset := model.JSONObject{model.TOTPPendingSecretKey: secret}, []string{}
+		if pendingSession != "" {
+			set[model.TOTPPendingSessionKey] = pendingSession
+		} else {
+			unset = append(unset, model.TOTPPendingSessionKey)
+		}
+		err = a.store.MergeCredentialsConfig(i.ID, model.CredentialsTOTP, set, unset, now)
+	} else {
+		err = a.store.PutCredentials(model.Credentials{
+			IdentityID: i.ID,
+			Type:       model.CredentialsTOTP,
+			Config:     model.JSONObject{model.TOTPPendingSecretKey: secret},
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		})
+	}
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	writeSuccess(c, http.StatusOK, model.TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.URI(a.cfg.TOTP.Issuer, totpAccount(i), secret),
+	})
+}
+
+// HandleConfirmTOTP enables the pending totp secret of the identity of the session by its current code
+// and issues new recovery codes which replace the previous ones
+func (a *IdentApp) HandleConfirmTOTP(c *fiber.Ctx) {
+	var r model.TOTPConfirmRequest
+	if err := json.Unmarshal([]byte(c.Body()), &r); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	if r.Code = strings.TrimSpace(r.Code); r.Code == "" {
+		writeError(c, http.StatusBadRequest, errors.New("code must not be empty"))
+		return
+	}
+	s, i, ok := a.currentSession(c)
+	if !ok {
+		return
+	}
+	cred, enrolled := i.Credentials[model.CredentialsTOTP]
+	if !enrolled || cred.TOTPPendingSecret() == "" {
+		writeError(c, http.StatusConflict, errNoPendingTOTP)
+		return
+	}
+	if !canReplaceTOTP(s, cred) && cred.TOTPPendingSession() != s.ID {
+		writeError(c, http.StatusForbidden, errStepUpRequired)
+		return
+	}
+	secret := cred.TOTPPendingSecret()
+	step, valid := totp.Validate(secret, r.Code, a.now(), 0)
+	if !valid {
+		writeError(c, http.StatusUnprocessableEntity, errInvalidTOTPCode)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes(a.cfg.TOTP.RecoveryCodes)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	cred.Config = model.JSONObject{
+		model.TOTPSecretKey:        secret,
+		model.TOTPLastStepKey:      step,
+		model.TOTPRecoveryCodesKey: hashes,
+	}
+	cred.UpdatedAt = a.now().UTC().Truncate(time.Millisecond)
+	if err = a.store.PutCredentials(cred); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	writeSuccess(c, http.StatusOK, model.TOTPRecoveryCodes{RecoveryCodes: codes})
+}
+
+// verifySecondFactor checks the totp code or, when it's empty, the recovery code against enabled totp credentials
+// of the identity. Every attempt is counted first, so concurrent guesses can't exceed max attempts per window.
+// Accepted codes are consumed atomically, so a code can't be accepted twice even by concurrent requests
+func (a *IdentApp) verifySecondFactor(identityID, code, recoveryCode string) error {
+	code, recoveryCode = strings.TrimSpace(code), strings.TrimSpace(recoveryCode)
+	if code == "" && recoveryCode == "" {
+		return errSecondFactorRequired
+	}
+	now := a.now().UTC().Truncate(time.Millisecond)
+	cred, err := a.store.IncrementTOTPAttempts(identityID, now, now.Add(-a.cfg.TOTP.AttemptsWindow.Duration))
+	if err != nil {
+		if a.store.NoRows(err) {
+			return errInvalidSecondFactor
+		}
+		return err
+	}
+	if cred.TOTPAttempts() > int64(a.cfg.TOTP.MaxAttempts) {
+		return errSecondFactorLocked
+	}
+	if code != "" {
+		step, valid := totp.Validate(cred.TOTPSecret(), code, a.now(), cred.TOTPLastStep())
+		if !valid {
+			return errInvalidSecondFactor
+		}
+		err = a.store.ConsumeTOTPStep(identityID, step, now)
+	} else {
+		hash := ""
+		for _, h := range cred.TOTPRecoveryCodes() {
+			if secretMatches(totpRecoverySubject, strings.ToLower(recoveryCode), h) {
+				hash = h
+			}
+		}
+		if hash == "" {
+			return errInvalidSecondFactor
+		}
+		err = a.store.UseTOTPRecoveryCode(identityID, hash, now)
+	}
+	if err != nil && a.store.NoRows(err) {
+		return errInvalidSecondFactor
+	}
+	return err
+}
+
+// secondFactorStatus returns response status of verifySecondFactor error
+func (a *IdentApp) secondFactorStatus(err error, rejected int) int {
+	switch err {
+	case errSecondFactorRequired, errInvalidSecondFactor:
+		return rejected
+	case errSecondFactorLocked:
+		return http.StatusTooManyRequests
+	}
+	return a.statusFromDBErr(err)
+}
+
+// canReplaceTOTP returns whether the session may change totp credentials without a recovery code.
+// Enabled totp can be replaced only by sessions which passed it
+func canReplaceTOTP(s model.Session, cred model.Credentials) bool {
+	return cred.TOTPSecret() == "" || s.AAL == model.AAL2
+}
+
+// totpAccount returns the account name shown by authenticator apps
+func totpAccount(i model.Identity) string {
+	if p, ok := i.Credentials[model.CredentialsPassword]; ok && len(p.Identifiers) > 0 {
+		return p.Identifiers[0]
+	}
+	return i.ID
+}
+
+// newRecoveryCodes returns n random recovery codes and their hashes
+func newRecoveryCodes(n int) ([]string, []string, error) {
+	codes, hashes := make([]string, n), make([]string, n)
+	b := make([]byte, recoveryCodeSize)
+	for k := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		codes[k] = hex.EncodeToString(b)
+		hashes[k] = hashSecret(totpRecoverySubject, codes[k])
+	}
+	return codes, hashes, nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/totp"
+)
+
+func TestTOTP(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv.now = func() time.Time { return now }
+	i, _ := store.Create(model.Identity{ID: uuid.NewV4().String()})
+	hash, err := srv.hasher.Hash("correct horse")
+	require.NoError(t, err)
+	require.NoError(t, store.PutCredentials(model.Credentials{
+		IdentityID:  i.ID,
+		Type:        model.CredentialsPassword,
+		Identifiers: []string{"alice@example.com"},
+		Config:      model.JSONObject{model.PasswordConfigKey: hash},
+	}))
+	login := func(secondFactor string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/sessions", `{"identifier":"alice@example.com","password":"correct horse"`+secondFactor+`}`, nil)
+	}
+	code := func(secret string) string {
+		c, err := totp.Code(secret, totp.Step(now))
+		require.NoError(t, err)
+		return c
+	}
+	body := model.SessionToken{}
+	assertSussessJSONResponse(t, http.StatusCreated, login(""), &body)
+	aal1Token := body.Token
+	enrollment := model.TOTPEnrollment{}
+	recovery := model.TOTPRecoveryCodes{}
+	replacement := model.TOTPEnrollment{}
+
+	t.Run("should require session to enroll", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnauthorized, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", "", nil))
+	})
+	t.Run("should generate pending secret", func(t *testing.T) {
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", "", sessionHeaders(aal1Token)), &enrollment)
+		assert.NotEmpty(t, enrollment.Secret)
+		u, err := url.Parse(enrollment.URI)
+		require.NoError(t, err)
+		assert.Equal(t, "/kr.api:alice@example.com", u.Path)
+		assert.Equal(t, enrollment.Secret, u.Query().Get("secret"))
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusCreated, login(""), &body)
+		assert.Equal(t, model.AAL1, body.Session.AAL, "expected pending totp not to be required on login")
+	})
+	t.Run("should reject wrong confirmation code", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, sendRequest(t, srv.public, http.MethodPost, "/settings/totp/confirm", `{"code":"000000"}`, sessionHeaders(aal1Token)))
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/settings/totp/confirm", `{}`, sessionHeaders(aal1Token)))
+	})
+	t.Run("should confirm secret by its code and issue recovery codes", func(t *testing.T) {
+		resp := sendRequest(t, srv.public, http.MethodPost, "/settings/totp/confirm", fmt.Sprintf(`{"code":%q}`, code(enrollment.Secret)), sessionHeaders(aal1Token))
+		assertSussessJSONResponse(t, http.StatusOK, resp, &recovery)
+		assert.Len(t, recovery.RecoveryCodes, srv.cfg.TOTP.RecoveryCodes)
+		assertErrorJSONResponse(t, http.StatusConflict, sendRequest(t, srv.public, http.MethodPost, "/settings/totp/confirm", `{"code":"000000"}`, sessionHeaders(aal1Token)))
+	})
+	t.Run("should require second factor on login", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login(""))
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login(`,"totp_code":"000000"`))
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login(fmt.Sprintf(`,"totp_code":%q`, code(enrollment.Secret))))
+	})
+	t.Run("should issue aal2 session by totp code", func(t *testing.T) {
+		now = now.Add(totp.Period)
+		c := code(enrollment.Secret)
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusCreated, login(fmt.Sprintf(`,"totp_code":%q`, c)), &body)
+		assert.Equal(t, model.AAL2, body.Session.AAL)
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login(fmt.Sprintf(`,"totp_code":%q`, c)))
+	})
+	t.Run("should issue aal2 session by single-use recovery code", func(t *testing.T) {
+		rc := fmt.Sprintf(`,"recovery_code":%q`, recovery.RecoveryCodes[0])
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusCreated, login(rc), &body)
+		assert.Equal(t, model.AAL2, body.Session.AAL)
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login(rc))
+		assertErrorJSONResponse(t, http.StatusUnauthorized, login(`,"recovery_code":"nope"`))
+	})
+	t.Run("should replace enabled totp by aal2 session only", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusForbidden, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", "", sessionHeaders(aal1Token)))
+		body := model.SessionToken{}
+		assertSussessJSONResponse(t, http.StatusCreated, login(fmt.Sprintf(`,"recovery_code":%q`, recovery.RecoveryCodes[1])), &body)
+		pending := model.TOTPEnrollment{}
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", "", sessionHeaders(body.Token)), &pending)
+		assert.NotEqual(t, enrollment.Secret, pending.Secret)
+		now = now.Add(totp.Period)
+		assertSussessJSONResponse(t, http.StatusCreated, login(fmt.Sprintf(`,"totp_code":%q`, code(enrollment.Secret))), &model.SessionToken{})
+	})
+	t.Run("should replace enabled totp by privileged aal1 session with recovery code only", func(t *testing.T) {
+		token := uuid.NewV4().String()
+		require.NoError(t, store.CreateSession(model.Session{
+			ID:         uuid.NewV4().String(),
+			TokenHash:  hashSecret(sessionSubject, token),
+			IdentityID: i.ID,
+			Privileged: true,
+			AAL:        model.AAL1,
+			ExpiresAt:  now.Add(time.Hour),
+			CreatedAt:  now,
+		}))
+		assertErrorJSONResponse(t, http.StatusForbidden, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", "", sessionHeaders(token)))
+		assertErrorJSONResponse(t, http.StatusForbidden, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", `{"recovery_code":"nope"}`, sessionHeaders(token)))
+		rc := fmt.Sprintf(`{"recovery_code":%q}`, recovery.RecoveryCodes[2])
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", rc, sessionHeaders(token)), &replacement)
+		assertErrorJSONResponse(t, http.StatusForbidden, sendRequest(t, srv.public, http.MethodPost, "/settings/totp", rc, sessionHeaders(token)))
+		confirm := fmt.Sprintf(`{"code":%q}`, code(replacement.Secret))
+		assertErrorJSONResponse(t, http.StatusForbidden, sendRequest(t, srv.public, http.MethodPost, "/settings/totp/confirm", confirm, sessionHeaders(aal1Token)))
+		assertSussessJSONResponse(t, http.StatusOK, sendRequest(t, srv.public, http.MethodPost, "/settings/totp/confirm", confirm, sessionHeaders(token)), &model.TOTPRecoveryCodes{})
+		now = now.Add(totp.Period)
+		assertSussessJSONResponse(t, http.StatusCreated, login(fmt.Sprintf(`,"totp_code":%q`, code(replacement.Secret))), &model.SessionToken{})
+	})
+	t.Run("should accept the same totp code once by concurrent requests", func(t *testing.T) {
+		now = now.Add(totp.Period)
+		c := code(replacement.Secret)
+		var wg sync.WaitGroup
+		errs := make(chan error, srv.cfg.TOTP.MaxAttempts)
+		for n := 0; n < srv.cfg.TOTP.MaxAttempts; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- srv.verifySecondFactor(i.ID, c, "")
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		accepted := 0
+		for err := range errs {
+			if err == nil {
+				accepted++
+			} else {
+				assert.Equal(t, errInvalidSecondFactor, err)
+			}
+		}
+		assert.Equal(t, 1, accepted, "expected totp code to be accepted once")
+	})
+	t.Run("should lock second factor after max attempts per window", func(t *testing.T) {
+		now = now.Add(srv.cfg.TOTP.AttemptsWindow.Duration)
+		for n := 0; n < srv.cfg.TOTP.MaxAttempts; n++ {
+			assertErrorJSONResponse(t, http.StatusUnauthorized, login(`,"totp_code":"000000"`))
+		}
+		c := fmt.Sprintf(`,"totp_code":%q`, code(replacement.Secret))
+		assertErrorJSONResponse(t, http.StatusTooManyRequests, login(c))
+		assertErrorJSONResponse(t, http.StatusTooManyRequests, login(`,"recovery_code":"nope"`))
+		now = now.Add(srv.cfg.TOTP.AttemptsWindow.Duration)
+		c = fmt.Sprintf(`,"totp_code":%q`, code(replacement.Secret))
+		assertSussessJSONResponse(t, http.StatusCreated, login(c), &model.SessionToken{})
+	})
+}
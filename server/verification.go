@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber"
+	"github.com/trapck/kr.api/model"
+)
+
+// verificationCodeDigits is a length of address verification codes
+const verificationCodeDigits = 6
+
+var (
+	errInvalidCode     = errors.New("invalid or expired verification code")
+	errAddressNotFound = errors.New("verifiable address not found")
+)
+
+// HandleStartVerification issues a verification code for not verified address and sends it to the address.
+// A code issued less than resend interval ago is kept and not sent again. Failed attempts of a not expired code
+// are carried over to the new one, and no code is issued until a code guessed wrong too many times expires,
+// so reissues don't reset the attempts limit. The response doesn't tell whether the address exists or a code was sent
+func (a *IdentApp) HandleStartVerification(c *fiber.Ctx) {
+	var r model.VerificationRequest
+	if !parseVerificationRequest(c, &r, &r) {
+		return
+	}
+	i, address, err := a.findUnverifiedAddress(r)
+	if err == errAddressNotFound {
+		c.Status(http.StatusAccepted)
+		return
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	now := a.now()
+	previous, err := a.store.GetVerificationCode(address.ID)
+	if err != nil && !a.store.NoRows(err) {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	} else if err == nil && !previous.Expired(now) && (previous.Attempts >= a.cfg.Verification.MaxAttempts ||
+		now.Before(previous.CreatedAt.Add(a.cfg.Verification.ResendInterval.Duration))) {
+		c.Status(http.StatusAccepted)
+		return
+	}
+	code, err := newCode(verificationCodeDigits)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	v := model.VerificationCode{
+		AddressID:  address.ID,
+		IdentityID: i.ID,
+		CodeHash:   hashSecret(address.ID, code),
+		ExpiresAt:  now.Add(a.cfg.Verification.TTL.Duration),
+		CreatedAt:  now,
+	}
+	if err == nil && !previous.Expired(now) {
+		v.Attempts = previous.Attempts
+	}
+	if err = a.store.SaveVerificationCode(v); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	i, err = a.changeVerifiableAddress(i.ID, address.ID, func(va *model.VerifiableAddress) {
+		va.ExpiresAt = &v.ExpiresAt
+	})
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	// failed delivery is answered as a sent code, so it doesn't tell the address exists
+	if err = a.notifier.SendVerificationCode(i, address, code); err != nil {
+		log.Printf("could not send verification code to address %s: %v", address.ID, err)
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// HandleCompleteVerification marks address verified when the code matches the one sent to it.
+// Every attempt is counted before the code is checked, so concurrent guesses can't exceed max attempts.
+// The code is revoked when it is used or expired. A code guessed wrong too many times is kept until it expires,
+// so it blocks reissue for the address
+func (a *IdentApp) HandleCompleteVerification(c *fiber.Ctx) {
+	var r model.VerificationCompleteRequest
+	if !parseVerificationRequest(c, &r, &r.VerificationRequest) {
+		return
+	}
+	if r.Code == "" {
+		writeError(c, http.StatusBadRequest, errors.New("code must not be empty"))
+		return
+	}
+	i, address, err := a.findUnverifiedAddress(r.VerificationRequest)
+	if err == errAddressNotFound {
+		writeError(c, http.StatusUnprocessableEntity, errInvalidCode)
+		return
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	v, err := a.store.IncrementVerificationAttempts(address.ID)
+	if err != nil && a.store.NoRows(err) {
+		writeError(c, http.StatusUnprocessableEntity, errInvalidCode)
+		return
+	} else if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	now := a.now()
+	if v.IdentityID != i.ID || v.Expired(now) || v.Attempts > a.cfg.Verification.MaxAttempts || !secretMatches(address.ID, r.Code, v.CodeHash) {
+		if v.IdentityID != i.ID || v.Expired(now) {
+			if err = a.store.DeleteVerificationCode(address.ID); err != nil {
+				writeError(c, a.statusFromDBErr(err), err)
+				return
+			}
+		}
+		writeError(c, http.StatusUnprocessableEntity, errInvalidCode)
+		return
+	}
+	if err = a.store.DeleteVerificationCode(address.ID); err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	i, err = a.changeVerifiableAddress(i.ID, address.ID, func(va *model.VerifiableAddress) {
+		va.Verified = true
+		va.VerifiedAt = &now
+		va.ExpiresAt = nil
+	})
+	if err != nil {
+		writeError(c, a.statusFromDBErr(err), err)
+		return
+	}
+	for _, va := range i.VerifiableAddresses {
+		if va.ID == address.ID {
+			writeSuccess(c, http.StatusOK, va)
+			return
+		}
+	}
+	writeError(c, http.StatusConflict, errAddressNotFound)
+}
+
+func parseVerificationRequest(c *fiber.Ctx, dst interface{}, r *model.VerificationRequest) bool {
+	if err := json.Unmarshal([]byte(c.Body()), dst); err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return false
+	}
+	r.Address, r.Via = strings.TrimSpace(r.Address), strings.TrimSpace(r.Via)
+	if r.Address == "" || r.Via == "" {
+		writeError(c, http.StatusBadRequest, errors.New("address and via must not be empty"))
+		return false
+	}
+	return true
+}
+
+// findUnverifiedAddress returns identity owning not verified address with the requested value and channel
+func (a *IdentApp) findUnverifiedAddress(r model.VerificationRequest) (model.Identity, model.VerifiableAddress, error) {
+	verified := false
+	l, err := a.store.ListPage(model.IdentityQuery{Address: r.Address, Via: r.Via, Verified: &verified, Limit: 1})
+	if err != nil {
+		return model.Identity{}, model.VerifiableAddress{}, err
+	}
+	for _, i := range l {
+		for _, va := range i.VerifiableAddresses {
+			if va.Value == r.Address && va.Via == r.Via && !va.Verified {
+				return i, va, nil
+			}
+		}
+	}
+	return model.Identity{}, model.VerifiableAddress{}, errAddressNotFound
+}
+
+// changeVerifiableAddress applies change to the identity address and saves the identity
+func (a *IdentApp) changeVerifiableAddress(identityID, addressID string, change func(*model.VerifiableAddress)) (model.Identity, error) {
+	return a.modifyIdentity(identityID, 0, func(i model.Identity) (model.Identity, error) {
+		va := make([]model.VerifiableAddress, len(i.VerifiableAddresses))
+		copy(va, i.VerifiableAddresses)
+		for n := range va {
+			if va[n].ID == addressID {
+				change(&va[n])
+				i.VerifiableAddresses = va
+				return i, nil
+			}
+		}
+		return i, errAddressNotFound
+	})
+}
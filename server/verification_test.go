@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/trapck/kr.api/memstore"
+	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/testutil"
+)
+
+type stubNotifier struct {
+	codes  map[string]string
+	tokens map[string]string
+	err    error
+}
+
+func (n *stubNotifier) SendVerificationCode(i model.Identity, a model.VerifiableAddress, code string) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.codes[a.Value] = code
+	return nil
+}
+
+func (n *stubNotifier) SendRecoveryToken(i model.Identity, a model.RecoveryAddress, token string) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.tokens[a.Value] = token
+	return nil
+}
+
+func TestVerification(t *testing.T) {
+	store := memstore.Store{}
+	srv := newTestApp(t, &store)
+	notifier := &stubNotifier{codes: map[string]string{}, tokens: map[string]string{}}
+	srv.SetNotifier(notifier)
+	now := time.Now()
+	srv.now = func() time.Time { return now }
+	address := func() model.VerifiableAddress {
+		return model.VerifiableAddress{Address: model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String() + "@example.com", Via: "email"}}
+	}
+	i, _ := store.Create(model.Identity{ID: uuid.NewV4().String(), VerifiableAddresses: []model.VerifiableAddress{address(), address()}})
+	value := i.VerifiableAddresses[0].Value
+	start := func(value string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/verification", fmt.Sprintf(`{"address":%q,"via":"email"}`, value), nil)
+	}
+	complete := func(value, code string) *http.Response {
+		return sendRequest(t, srv.public, http.MethodPost, "/verification/complete", fmt.Sprintf(`{"address":%q,"via":"email","code":%q}`, value, code), nil)
+	}
+
+	t.Run("should issue hashed code", func(t *testing.T) {
+		assertStatus(t, http.StatusAccepted, start(value).StatusCode, "")
+		code := notifier.codes[value]
+		assert.Len(t, code, verificationCodeDigits, "expected code to be sent")
+		v, err := store.GetVerificationCode(i.VerifiableAddresses[0].ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected code to be stored")
+		assert.NotContains(t, v.CodeHash, code, "expected code to be stored hashed")
+		found, _ := store.Get(i.ID)
+		assert.True(t, found.VerifiableAddresses[0].ExpiresAt.Equal(v.ExpiresAt), "expected address expiration to be set")
+		assert.False(t, found.VerifiableAddresses[0].Verified)
+	})
+	t.Run("should not reveal unknown address", func(t *testing.T) {
+		assertStatus(t, http.StatusAccepted, start("unknown@example.com").StatusCode, "")
+		assert.NotContains(t, notifier.codes, "unknown@example.com")
+	})
+	t.Run("should not reveal failed delivery", func(t *testing.T) {
+		other, _ := store.Create(model.Identity{ID: uuid.NewV4().String(), VerifiableAddresses: []model.VerifiableAddress{address()}})
+		notifier.err = fmt.Errorf("smtp is down")
+		defer func() { notifier.err = nil }()
+		assertStatus(t, http.StatusAccepted, start(other.VerifiableAddresses[0].Value).StatusCode, "")
+	})
+	t.Run("should not reissue code within resend interval", func(t *testing.T) {
+		issued := notifier.codes[value]
+		delete(notifier.codes, value)
+		assertStatus(t, http.StatusAccepted, start(value).StatusCode, "")
+		assert.NotContains(t, notifier.codes, value, "expected code not to be sent again")
+		notifier.codes[value] = issued
+	})
+	t.Run("should reject wrong code", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(value, "wrong"))
+		v, _ := store.GetVerificationCode(i.VerifiableAddresses[0].ID)
+		assert.Equal(t, 1, v.Attempts, "expected failed attempt to be counted")
+	})
+	t.Run("should verify address with issued code", func(t *testing.T) {
+		body := model.VerifiableAddress{}
+		assertSussessJSONResponse(t, http.StatusOK, complete(value, notifier.codes[value]), &body)
+		assert.True(t, body.Verified)
+		found, _ := store.Get(i.ID)
+		va := found.VerifiableAddresses[0]
+		assert.True(t, va.Verified, "expected address to be verified")
+		assert.True(t, va.VerifiedAt.Equal(now), "expected verification time to be set")
+		assert.Nil(t, va.ExpiresAt, "expected address expiration to be cleared")
+		assert.False(t, found.VerifiableAddresses[1].Verified, "expected other address to stay not verified")
+	})
+	t.Run("should not reuse code", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(value, notifier.codes[value]))
+	})
+	t.Run("should reject expired code", func(t *testing.T) {
+		other := i.VerifiableAddresses[1].Value
+		assertStatus(t, http.StatusAccepted, start(other).StatusCode, "")
+		now = now.Add(srv.cfg.Verification.TTL.Duration)
+		defer func() { now = now.Add(-srv.cfg.Verification.TTL.Duration) }()
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(other, notifier.codes[other]))
+		_, err := store.GetVerificationCode(i.VerifiableAddresses[1].ID)
+		assert.True(t, store.NoRows(err), "expected expired code to be revoked")
+	})
+	t.Run("should lock code after max attempts", func(t *testing.T) {
+		other := i.VerifiableAddresses[1].Value
+		assertStatus(t, http.StatusAccepted, start(other).StatusCode, "")
+		for n := 0; n < srv.cfg.Verification.MaxAttempts; n++ {
+			assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(other, "wrong"))
+		}
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(other, notifier.codes[other]))
+	})
+	t.Run("should not reissue locked code until it expires", func(t *testing.T) {
+		other := i.VerifiableAddresses[1].Value
+		issued := notifier.codes[other]
+		now = now.Add(srv.cfg.Verification.ResendInterval.Duration)
+		assertStatus(t, http.StatusAccepted, start(other).StatusCode, "")
+		assert.Equal(t, issued, notifier.codes[other], "expected new code not to be sent")
+		now = now.Add(srv.cfg.Verification.TTL.Duration)
+		assertStatus(t, http.StatusAccepted, start(other).StatusCode, "")
+		assert.NotEqual(t, issued, notifier.codes[other], "expected new code to be sent")
+		v, _ := store.GetVerificationCode(i.VerifiableAddresses[1].ID)
+		assert.Equal(t, 0, v.Attempts, "expected attempts of expired code not to be carried over")
+	})
+	t.Run("should carry failed attempts over to reissued code", func(t *testing.T) {
+		other := i.VerifiableAddresses[1].Value
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(other, "wrong"))
+		issued := notifier.codes[other]
+		now = now.Add(srv.cfg.Verification.ResendInterval.Duration)
+		assertStatus(t, http.StatusAccepted, start(other).StatusCode, "")
+		assert.NotEqual(t, issued, notifier.codes[other], "expected new code to be sent")
+		v, _ := store.GetVerificationCode(i.VerifiableAddresses[1].ID)
+		assert.Equal(t, 1, v.Attempts, "expected failed attempt to be carried over")
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(other, issued))
+		body := model.VerifiableAddress{}
+		assertSussessJSONResponse(t, http.StatusOK, complete(other, notifier.codes[other]), &body)
+	})
+	t.Run("should reject code guessed after max attempts", func(t *testing.T) {
+		i, _ := store.Create(model.Identity{ID: uuid.NewV4().String(), VerifiableAddresses: []model.VerifiableAddress{address()}})
+		value := i.VerifiableAddresses[0].Value
+		assertStatus(t, http.StatusAccepted, start(value).StatusCode, "")
+		for n := 0; n < srv.cfg.Verification.MaxAttempts; n++ {
+			_, err := store.IncrementVerificationAttempts(i.VerifiableAddresses[0].ID)
+			testutil.FailOnNotEqual(t, err, nil, "expected to count attempt")
+		}
+		assertErrorJSONResponse(t, http.StatusUnprocessableEntity, complete(value, notifier.codes[value]))
+		v, err := store.GetVerificationCode(i.VerifiableAddresses[0].ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected exhausted code to be kept until it expires")
+		assert.Greater(t, v.Attempts, srv.cfg.Verification.MaxAttempts)
+	})
+	t.Run("should return bad request for invalid body", func(t *testing.T) {
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/verification", "{", nil))
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/verification", `{"address":"a@example.com"}`, nil))
+		assertErrorJSONResponse(t, http.StatusBadRequest, sendRequest(t, srv.public, http.MethodPost, "/verification/complete", `{"address":"a@example.com","via":"email"}`, nil))
+	})
+}
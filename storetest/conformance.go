@@ -0,0 +1,1225 @@
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/trapck/kr.api/model"
+	"github.com/trapck/kr.api/server"
+	"github.com/trapck/kr.api/testutil"
+)
+
+// Factory returns a ready to use store for a single conformance test.
+// Releasing the store is up to the factory, e.g. with t.Cleanup
+type Factory func(t *testing.T) server.Store
+
+// RunConformance checks that store implementation follows server.Store contract.
+// Every identity created by the suite has a unique id and is deleted at the end of its test,
+// so the suite can be run against a shared database
+func RunConformance(t *testing.T, factory Factory) {
+	t.Run("Create", func(t *testing.T) { testCreate(t, factory(t)) })
+	t.Run("Get", func(t *testing.T) { testGet(t, factory(t)) })
+	t.Run("List", func(t *testing.T) { testList(t, factory(t)) })
+	t.Run("ListPage", func(t *testing.T) { testListPage(t, factory(t)) })
+	t.Run("ListPageFilters", func(t *testing.T) { testListPageFilters(t, factory(t)) })
+	t.Run("Update", func(t *testing.T) { testUpdate(t, factory(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory(t)) })
+	t.Run("Version", func(t *testing.T) { testVersion(t, factory(t)) })
+	t.Run("Schemas", func(t *testing.T) { testSchemas(t, factory(t)) })
+	t.Run("Timestamps", func(t *testing.T) { testTimestamps(t, factory(t)) })
+	t.Run("VerificationCodes", func(t *testing.T) { testVerificationCodes(t, factory(t)) })
+	t.Run("RecoveryTokens", func(t *testing.T) { testRecoveryTokens(t, factory(t)) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, factory(t)) })
+	t.Run("Messages", func(t *testing.T) { testMessages(t, factory(t)) })
+	t.Run("Credentials", func(t *testing.T) { testCredentials(t, factory(t)) })
+	t.Run("TOTPCredentials", func(t *testing.T) { testTOTPCredentials(t, factory(t)) })
+	t.Run("Ping", func(t *testing.T) { testPing(t, factory(t)) })
+}
+
+func testCreate(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+
+	t.Run("should return created identity", func(t *testing.T) {
+		created, err := s.Create(i)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+		AssertIdentity(t, i, created, "created identity must be equal to input")
+	})
+	t.Run("should reject duplicate id", func(t *testing.T) {
+		_, err := s.Create(model.Identity{ID: i.ID, SchemaID: "duplicate"})
+		assert.Error(t, err, "expected to get an error for duplicate id")
+		assert.False(t, s.NoRows(err), "duplicate error must not be reported as no rows")
+		assert.True(t, s.Duplicate(err), "expected error to be reported as duplicate")
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		AssertIdentity(t, i, found, "original identity must not be changed by duplicate insert")
+	})
+	t.Run("should reject address used by another identity", func(t *testing.T) {
+		other := NewIdentity()
+		defer cleanup(s, other.ID)
+		other.VerifiableAddresses[0].Value = i.VerifiableAddresses[0].Value
+		_, err := s.Create(other)
+		assert.Error(t, err, "expected to get an error for duplicate verifiable address")
+		assert.True(t, s.Duplicate(err), "expected error to be reported as duplicate")
+		another := NewIdentity()
+		defer cleanup(s, another.ID)
+		another.RecoveryAddresses[0].Value = i.RecoveryAddresses[0].Value
+		_, err = s.Create(another)
+		assert.True(t, s.Duplicate(err), "expected error to be reported as duplicate")
+	})
+	t.Run("should reject address repeated in one identity", func(t *testing.T) {
+		other := NewIdentity()
+		defer cleanup(s, other.ID)
+		other.VerifiableAddresses = append(other.VerifiableAddresses, model.VerifiableAddress{
+			Address: model.Address{ID: uuid.NewV4().String(), Value: other.VerifiableAddresses[0].Value, Via: other.VerifiableAddresses[0].Via},
+		})
+		_, err := s.Create(other)
+		assert.True(t, s.Duplicate(err), fmt.Sprintf("expected duplicate error for repeated verifiable address, got %v", err))
+		another := NewIdentity()
+		defer cleanup(s, another.ID)
+		another.RecoveryAddresses[1] = model.RecoveryAddress{
+			Address: model.Address{ID: uuid.NewV4().String(), Value: another.RecoveryAddresses[0].Value, Via: another.RecoveryAddresses[0].Via},
+		}
+		_, err = s.Create(another)
+		assert.True(t, s.Duplicate(err), fmt.Sprintf("expected duplicate error for repeated recovery address, got %v", err))
+	})
+	t.Run("should allow same address value via different channel", func(t *testing.T) {
+		other := NewIdentity()
+		defer cleanup(s, other.ID)
+		other.VerifiableAddresses[0].Value = i.VerifiableAddresses[0].Value
+		other.VerifiableAddresses[0].Via = "sms"
+		_, err := s.Create(other)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	})
+	t.Run("should create identity without addresses", func(t *testing.T) {
+		empty := model.Identity{ID: uuid.NewV4().String()}
+		defer cleanup(s, empty.ID)
+		_, err := s.Create(empty)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+		found, err := s.Get(empty.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		AssertIdentity(t, empty, found, "stored identity must be equal to input")
+	})
+}
+
+func testGet(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	i.VerifiableAddresses = append(i.VerifiableAddresses, model.VerifiableAddress{
+		Address: model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String() + "@example.com", Via: "email"},
+	})
+	defer cleanup(s, i.ID)
+	_, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+
+	t.Run("should round trip addresses", func(t *testing.T) {
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		AssertIdentity(t, i, found, "expected to find identity with all addresses")
+	})
+	t.Run("should keep nil address times", func(t *testing.T) {
+		found, _ := s.Get(i.ID)
+		for _, a := range found.VerifiableAddresses {
+			if a.ID == i.VerifiableAddresses[1].ID {
+				assert.Nil(t, a.VerifiedAt, "verified_at must stay nil")
+				assert.Nil(t, a.ExpiresAt, "expires_at must stay nil")
+			}
+		}
+	})
+	t.Run("should report not existing identity as no rows", func(t *testing.T) {
+		_, err := s.Get(uuid.NewV4().String())
+		assert.Error(t, err, "expected to get an error for not existing identity")
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+}
+
+func testList(t *testing.T, s server.Store) {
+	input := []model.Identity{NewIdentity(), NewIdentity()}
+	for _, i := range input {
+		defer cleanup(s, i.ID)
+		_, err := s.Create(i)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	}
+	l, err := s.List()
+	testutil.FailOnNotEqual(t, err, nil, "expected to list identities without errors")
+	for _, i := range input {
+		found := false
+		for _, v := range l {
+			if v.ID == i.ID {
+				found = true
+				AssertIdentity(t, i, v, "listed identity must contain all addresses")
+			}
+		}
+		assert.True(t, found, fmt.Sprintf("expected to find identity %s in list", i.ID))
+	}
+}
+
+func testListPage(t *testing.T, s server.Store) {
+	input := []model.Identity{NewIdentity(), NewIdentity(), NewIdentity()}
+	for _, i := range input {
+		defer cleanup(s, i.ID)
+		_, err := s.Create(i)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	}
+	t.Run("should walk through all identities in id order", func(t *testing.T) {
+		seen := map[string]model.Identity{}
+		q := model.IdentityQuery{Limit: 2}
+		for {
+			page, err := s.ListPage(q)
+			testutil.FailOnNotEqual(t, err, nil, "expected to list identities page without errors")
+			if len(page) == 0 {
+				break
+			}
+			assert.LessOrEqual(t, len(page), q.Limit, "page must not exceed limit")
+			for _, i := range page {
+				assert.Greater(t, i.ID, q.After, "page must be ordered by id and start after cursor")
+				_, dup := seen[i.ID]
+				assert.False(t, dup, "identity must be listed once")
+				seen[i.ID] = i
+				q.After = i.ID
+			}
+		}
+		for _, i := range input {
+			found, ok := seen[i.ID]
+			assert.True(t, ok, fmt.Sprintf("expected to find identity %s in pages", i.ID))
+			AssertIdentity(t, i, found, "paged identity must contain all addresses")
+		}
+	})
+}
+
+func testListPageFilters(t *testing.T, s server.Store) {
+	schemaID := uuid.NewV4().String()
+	verified, unverified, other := NewIdentity(), NewIdentity(), NewIdentity()
+	verified.SchemaID, unverified.SchemaID = schemaID, schemaID
+	unverified.VerifiableAddresses[0].Verified = false
+	unverified.VerifiableAddresses[0].VerifiedAt = nil
+	for _, i := range []model.Identity{verified, unverified, other} {
+		defer cleanup(s, i.ID)
+		_, err := s.Create(i)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	}
+	yes, no := true, false
+	cases := []struct {
+		name  string
+		query model.IdentityQuery
+		want  []model.Identity
+	}{
+		{"schema id", model.IdentityQuery{SchemaID: schemaID}, []model.Identity{verified, unverified}},
+		{"verifiable address", model.IdentityQuery{Address: verified.VerifiableAddresses[0].Value}, []model.Identity{verified}},
+		{"recovery address", model.IdentityQuery{Address: other.RecoveryAddresses[1].Value}, []model.Identity{other}},
+		{"address and via", model.IdentityQuery{Address: other.RecoveryAddresses[1].Value, Via: "sms"}, []model.Identity{other}},
+		{"address and other via", model.IdentityQuery{Address: other.RecoveryAddresses[1].Value, Via: "email"}, []model.Identity{}},
+		{"verified", model.IdentityQuery{SchemaID: schemaID, Verified: &yes}, []model.Identity{verified}},
+		{"not verified", model.IdentityQuery{SchemaID: schemaID, Verified: &no}, []model.Identity{unverified}},
+		{"recovery address is not verifiable", model.IdentityQuery{Address: other.RecoveryAddresses[0].Value, Verified: &no}, []model.Identity{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.query.Limit = 100
+			l, err := s.ListPage(c.query)
+			testutil.FailOnNotEqual(t, err, nil, "expected to list identities page without errors")
+			got := make([]string, len(l))
+			for n, i := range l {
+				got[n] = i.ID
+			}
+			want := make([]string, len(c.want))
+			for n, i := range c.want {
+				want[n] = i.ID
+			}
+			sort.Strings(want)
+			assert.Equal(t, want, got, "found identities don't match filter")
+		})
+	}
+}
+
+func testUpdate(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	_, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+
+	t.Run("should replace address sets", func(t *testing.T) {
+		n := NewIdentity()
+		n.ID = i.ID
+		n.SchemaID = "updated"
+		_, err := s.Update(i.ID, n)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		AssertIdentity(t, n, found, "expected addresses to be replaced")
+	})
+	t.Run("should reject address repeated in one identity", func(t *testing.T) {
+		current, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		n := current
+		n.VerifiableAddresses = append(append([]model.VerifiableAddress{}, current.VerifiableAddresses...), model.VerifiableAddress{
+			Address: model.Address{ID: uuid.NewV4().String(), Value: current.VerifiableAddresses[0].Value, Via: current.VerifiableAddresses[0].Via},
+		})
+		_, err = s.Update(i.ID, n)
+		assert.True(t, s.Duplicate(err), fmt.Sprintf("expected duplicate error for repeated address, got %v", err))
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		AssertIdentity(t, current, found, "identity must not be changed by rejected update")
+	})
+	t.Run("should replace traits", func(t *testing.T) {
+		n := NewIdentity()
+		n.ID = i.ID
+		n.Traits = model.JSONObject{"email": "updated@example.com", "tags": []interface{}{"a", "b"}}
+		_, err := s.Update(i.ID, n)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		AssertIdentity(t, n, found, "expected traits to be replaced")
+	})
+	t.Run("should remove all addresses", func(t *testing.T) {
+		n := model.Identity{ID: i.ID}
+		_, err := s.Update(i.ID, n)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		AssertIdentity(t, n, found, "expected addresses to be removed")
+	})
+	t.Run("should move identity to new id", func(t *testing.T) {
+		n := NewIdentity()
+		defer cleanup(s, n.ID)
+		_, err := s.Update(i.ID, n)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		found, err := s.Get(n.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity by new id")
+		AssertIdentity(t, n, found, "expected to find identity by new id")
+		_, err = s.Get(i.ID)
+		assert.True(t, s.NoRows(err), "expected old id to be released")
+	})
+	t.Run("should move identity records to new id", func(t *testing.T) {
+		o := NewIdentity()
+		_, err := s.Create(o)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+		code, token, session, message := saveIdentityRecords(t, s, o)
+		n := NewIdentity()
+		defer cleanup(s, n.ID)
+		_, err = s.Update(o.ID, n)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		foundCode, err := s.GetVerificationCode(code.AddressID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get verification code without errors")
+		assert.Equal(t, n.ID, foundCode.IdentityID, "expected verification code to be moved to new id")
+		foundSession, err := s.GetSession(session.TokenHash)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get session without errors")
+		assert.Equal(t, n.ID, foundSession.IdentityID, "expected session to be moved to new id")
+		foundToken, err := s.UseRecoveryToken(token.TokenHash)
+		testutil.FailOnNotEqual(t, err, nil, "expected to use recovery token without errors")
+		assert.Equal(t, n.ID, foundToken.IdentityID, "expected recovery token to be moved to new id")
+		foundMessage, err := s.GetMessage(message.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get message without errors")
+		assert.Equal(t, n.ID, foundMessage.IdentityID, "expected message to be moved to new id")
+	})
+	t.Run("should report not existing identity as no rows", func(t *testing.T) {
+		_, err := s.Update(uuid.NewV4().String(), NewIdentity())
+		assert.Error(t, err, "expected to get an error for not existing identity")
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+}
+
+func testDelete(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	_, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+
+	t.Run("should delete existing identity", func(t *testing.T) {
+		err := s.Delete(i.ID, 0)
+		testutil.FailOnNotEqual(t, err, nil, "expected to delete identity without error")
+		_, err = s.Get(i.ID)
+		assert.True(t, s.NoRows(err), "expected identity to be not found")
+	})
+	t.Run("should allow to reuse deleted id", func(t *testing.T) {
+		_, err := s.Create(i)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	})
+	t.Run("should delete identity records", func(t *testing.T) {
+		o := NewIdentity()
+		defer cleanup(s, o.ID)
+		_, err := s.Create(o)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+		code, token, session, message := saveIdentityRecords(t, s, o)
+		err = s.Delete(o.ID, 0)
+		testutil.FailOnNotEqual(t, err, nil, "expected to delete identity without error")
+		_, err = s.GetVerificationCode(code.AddressID)
+		assert.True(t, s.NoRows(err), "expected verification code to be deleted with identity")
+		_, err = s.UseRecoveryToken(token.TokenHash)
+		assert.True(t, s.NoRows(err), "expected recovery token to be deleted with identity")
+		_, err = s.GetSession(session.TokenHash)
+		assert.True(t, s.NoRows(err), "expected session to be deleted with identity")
+		_, err = s.GetMessage(message.ID)
+		assert.True(t, s.NoRows(err), "expected message to be deleted with identity")
+		_, err = s.Create(o)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be recreated without error, instead got : %s", err))
+		_, err = s.GetSession(session.TokenHash)
+		assert.True(t, s.NoRows(err), "expected session not to be passed to reused id")
+	})
+	t.Run("should report not existing identity as no rows", func(t *testing.T) {
+		err := s.Delete(uuid.NewV4().String(), 0)
+		assert.Error(t, err, "expected to get an error for not existing identity")
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+}
+
+func testVersion(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	created, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	assert.Equal(t, int64(1), created.Version, "created identity must have first version")
+	found, _ := s.Get(i.ID)
+	assert.Equal(t, int64(1), found.Version, "stored identity must have first version")
+
+	t.Run("should increment version on unconditional update", func(t *testing.T) {
+		i.Version = 0
+		updated, err := s.Update(i.ID, i)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		assert.Equal(t, int64(2), updated.Version, "expected version to be incremented")
+		found, _ := s.Get(i.ID)
+		assert.Equal(t, int64(2), found.Version, "expected stored version to be incremented")
+	})
+	t.Run("should update matching version", func(t *testing.T) {
+		i.Version = 2
+		updated, err := s.Update(i.ID, i)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		assert.Equal(t, int64(3), updated.Version, "expected version to be incremented")
+	})
+	t.Run("should reject outdated version on update", func(t *testing.T) {
+		i.Version = 2
+		i.SchemaID = "outdated"
+		_, err := s.Update(i.ID, i)
+		assert.True(t, s.VersionMismatch(err), "expected error to be reported as version mismatch")
+		found, _ := s.Get(i.ID)
+		assert.NotEqual(t, "outdated", found.SchemaID, "expected identity not to be changed")
+		assert.Equal(t, int64(3), found.Version, "expected version not to be changed")
+	})
+	t.Run("should reject outdated version on delete", func(t *testing.T) {
+		err := s.Delete(i.ID, 2)
+		assert.True(t, s.VersionMismatch(err), "expected error to be reported as version mismatch")
+		_, err = s.Get(i.ID)
+		assert.NoError(t, err, "expected identity not to be deleted")
+	})
+	t.Run("should delete matching version", func(t *testing.T) {
+		err := s.Delete(i.ID, 3)
+		testutil.FailOnNotEqual(t, err, nil, "expected to delete identity without error")
+	})
+	t.Run("should report not existing identity as no rows", func(t *testing.T) {
+		_, err := s.Update(uuid.NewV4().String(), model.Identity{ID: uuid.NewV4().String(), Version: 1})
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+		err = s.Delete(uuid.NewV4().String(), 1)
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+}
+
+func testTimestamps(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	before := time.Now().Add(-time.Second)
+	created, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+
+	t.Run("should set creation times", func(t *testing.T) {
+		assert.True(t, created.CreatedAt.After(before), "expected identity creation time to be set")
+		assert.Equal(t, created.CreatedAt, created.UpdatedAt, "expected update time to be equal to creation time")
+		for _, a := range created.VerifiableAddresses {
+			assert.Equal(t, created.CreatedAt, a.CreatedAt, "expected address creation time to be set")
+			assert.Equal(t, created.CreatedAt, a.UpdatedAt, "expected address update time to be set")
+		}
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		assert.True(t, created.CreatedAt.Equal(found.CreatedAt), "expected creation time to be stored")
+		assert.True(t, created.RecoveryAddresses[0].CreatedAt.Equal(found.RecoveryAddresses[0].CreatedAt) ||
+			created.RecoveryAddresses[0].CreatedAt.Equal(found.RecoveryAddresses[1].CreatedAt), "expected address creation time to be stored")
+	})
+	t.Run("should keep creation times on update", func(t *testing.T) {
+		time.Sleep(5 * time.Millisecond)
+		n := created
+		n.SchemaID = "updated"
+		n.VerifiableAddresses = append([]model.VerifiableAddress{}, created.VerifiableAddresses...)
+		n.VerifiableAddresses[0].Verified = !n.VerifiableAddresses[0].Verified
+		added := model.RecoveryAddress{Address: model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String(), Via: "email"}}
+		n.RecoveryAddresses = append([]model.RecoveryAddress{added}, created.RecoveryAddresses...)
+		_, err := s.Update(i.ID, n)
+		testutil.FailOnNotEqual(t, err, nil, "expected to update identity without errors")
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		assert.True(t, created.CreatedAt.Equal(found.CreatedAt), "expected creation time to be kept")
+		assert.True(t, found.UpdatedAt.After(created.UpdatedAt), "expected update time to be advanced")
+		va := found.VerifiableAddresses[0]
+		assert.True(t, created.CreatedAt.Equal(va.CreatedAt), "expected changed address creation time to be kept")
+		assert.True(t, found.UpdatedAt.Equal(va.UpdatedAt), "expected changed address update time to be advanced")
+		for _, a := range found.RecoveryAddresses {
+			if a.ID == added.ID {
+				assert.True(t, found.UpdatedAt.Equal(a.CreatedAt), "expected new address creation time to be set")
+			} else {
+				assert.True(t, created.CreatedAt.Equal(a.UpdatedAt), "expected not changed address update time to be kept")
+			}
+		}
+	})
+}
+
+func testVerificationCodes(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	_, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	v := model.VerificationCode{
+		AddressID:  i.VerifiableAddresses[0].ID,
+		IdentityID: i.ID,
+		CodeHash:   "hash",
+		ExpiresAt:  now.Add(time.Hour),
+		CreatedAt:  now,
+	}
+
+	t.Run("should report not existing code as no rows", func(t *testing.T) {
+		_, err := s.GetVerificationCode(v.AddressID)
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+	t.Run("should save and get code", func(t *testing.T) {
+		err := s.SaveVerificationCode(v)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be saved without error, instead got : %s", err))
+		found, err := s.GetVerificationCode(v.AddressID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get code without errors")
+		assertVerificationCode(t, v, found, "stored code must be equal to input")
+	})
+	t.Run("should replace code of the same address", func(t *testing.T) {
+		v.CodeHash = "other"
+		v.Attempts = 2
+		err := s.SaveVerificationCode(v)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be saved without error, instead got : %s", err))
+		found, err := s.GetVerificationCode(v.AddressID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get code without errors")
+		assertVerificationCode(t, v, found, "stored code must be replaced")
+	})
+	t.Run("should count concurrent attempts atomically", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for n := 0; n < 10; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.IncrementVerificationAttempts(v.AddressID)
+				assert.NoError(t, err, "expected to count attempt without errors")
+			}()
+		}
+		wg.Wait()
+		found, err := s.IncrementVerificationAttempts(v.AddressID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to count attempt without errors")
+		v.Attempts += 11
+		assertVerificationCode(t, v, found, "expected every attempt to be counted")
+		_, err = s.IncrementVerificationAttempts(uuid.NewV4().String())
+		assert.True(t, s.NoRows(err), "expected missing code to be reported as no rows")
+	})
+	t.Run("should delete code", func(t *testing.T) {
+		err := s.DeleteVerificationCode(v.AddressID)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be deleted without error, instead got : %s", err))
+		_, err = s.GetVerificationCode(v.AddressID)
+		assert.True(t, s.NoRows(err), "expected deleted code to be reported as no rows")
+		err = s.DeleteVerificationCode(v.AddressID)
+		testutil.FailOnNotEqual(t, err, nil, "expected delete of missing code to succeed")
+	})
+}
+
+func assertVerificationCode(t *testing.T, expected, actual model.VerificationCode, msg string) {
+	t.Helper()
+	expected.ExpiresAt, expected.CreatedAt = expected.ExpiresAt.UTC(), expected.CreatedAt.UTC()
+	actual.ExpiresAt, actual.CreatedAt = actual.ExpiresAt.UTC(), actual.CreatedAt.UTC()
+	assert.Equal(t, expected, actual, msg)
+}
+
+func testRecoveryTokens(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	_, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	newToken := func() model.RecoveryToken {
+		return model.RecoveryToken{
+			TokenHash:  uuid.NewV4().String(),
+			IdentityID: i.ID,
+			AddressID:  i.RecoveryAddresses[0].ID,
+			ExpiresAt:  now.Add(time.Hour),
+			CreatedAt:  now,
+		}
+	}
+	v := newToken()
+
+	t.Run("should report not existing token as no rows", func(t *testing.T) {
+		_, err := s.UseRecoveryToken(v.TokenHash)
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+	t.Run("should use token once", func(t *testing.T) {
+		err := s.SaveRecoveryToken(v)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be saved without error, instead got : %s", err))
+		found, err := s.UseRecoveryToken(v.TokenHash)
+		testutil.FailOnNotEqual(t, err, nil, "expected to use token without errors")
+		assertRecoveryToken(t, v, found, "used token must be equal to input")
+		_, err = s.UseRecoveryToken(v.TokenHash)
+		assert.True(t, s.NoRows(err), "expected used token to be reported as no rows")
+	})
+	t.Run("should reject duplicate token", func(t *testing.T) {
+		d := newToken()
+		err := s.SaveRecoveryToken(d)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be saved without error, instead got : %s", err))
+		err = s.SaveRecoveryToken(d)
+		assert.True(t, s.Duplicate(err), fmt.Sprintf("expected duplicate error, got %v", err))
+	})
+	t.Run("should return latest token of identity", func(t *testing.T) {
+		_, err := s.GetLatestRecoveryToken(uuid.NewV4().String())
+		assert.True(t, s.NoRows(err), "expected missing token to be reported as no rows")
+		older, latest := newToken(), newToken()
+		older.CreatedAt = now.Add(-time.Minute)
+		for _, v := range []model.RecoveryToken{latest, older} {
+			err := s.SaveRecoveryToken(v)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be saved without error, instead got : %s", err))
+		}
+		found, err := s.GetLatestRecoveryToken(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be found without error, instead got : %s", err))
+		assertRecoveryToken(t, latest, found, "found token must be the latest one")
+	})
+	t.Run("should delete all tokens of identity", func(t *testing.T) {
+		a, b := newToken(), newToken()
+		for _, v := range []model.RecoveryToken{a, b} {
+			err := s.SaveRecoveryToken(v)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be saved without error, instead got : %s", err))
+		}
+		err := s.DeleteRecoveryTokens(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be deleted without error, instead got : %s", err))
+		for _, v := range []model.RecoveryToken{a, b} {
+			_, err = s.UseRecoveryToken(v.TokenHash)
+			assert.True(t, s.NoRows(err), "expected deleted token to be reported as no rows")
+		}
+	})
+}
+
+func assertRecoveryToken(t *testing.T, expected, actual model.RecoveryToken, msg string) {
+	t.Helper()
+	expected.ExpiresAt, expected.CreatedAt = expected.ExpiresAt.UTC(), expected.CreatedAt.UTC()
+	actual.ExpiresAt, actual.CreatedAt = actual.ExpiresAt.UTC(), actual.CreatedAt.UTC()
+	assert.Equal(t, expected, actual, msg)
+}
+
+func testSessions(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	_, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	v := model.Session{
+		ID:         uuid.NewV4().String(),
+		TokenHash:  uuid.NewV4().String(),
+		IdentityID: i.ID,
+		Privileged: true,
+		AAL:        model.AAL2,
+		IP:         "192.0.2.1",
+		UserAgent:  "conformance",
+		ExpiresAt:  now.Add(time.Hour),
+		CreatedAt:  now,
+	}
+
+	t.Run("should report not existing session as no rows", func(t *testing.T) {
+		_, err := s.GetSession(v.TokenHash)
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+	t.Run("should create and get session", func(t *testing.T) {
+		err := s.CreateSession(v)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+		found, err := s.GetSession(v.TokenHash)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get session without errors")
+		assertSession(t, v, found, "stored session must be equal to input")
+	})
+	t.Run("should reject duplicate token", func(t *testing.T) {
+		d := v
+		d.ID = uuid.NewV4().String()
+		err := s.CreateSession(d)
+		assert.True(t, s.Duplicate(err), fmt.Sprintf("expected duplicate error, got %v", err))
+	})
+	t.Run("should delete session", func(t *testing.T) {
+		err := s.DeleteSession(v.TokenHash)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be deleted without error, instead got : %s", err))
+		_, err = s.GetSession(v.TokenHash)
+		assert.True(t, s.NoRows(err), "expected deleted session to be reported as no rows")
+		err = s.DeleteSession(v.TokenHash)
+		testutil.FailOnNotEqual(t, err, nil, "expected delete of missing session to succeed")
+	})
+	t.Run("should delete other sessions of identity", func(t *testing.T) {
+		o := NewIdentity()
+		defer cleanup(s, o.ID)
+		_, err := s.Create(o)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+		newSession := func(identityID string) model.Session {
+			n := v
+			n.ID, n.TokenHash, n.IdentityID = uuid.NewV4().String(), uuid.NewV4().String(), identityID
+			err := s.CreateSession(n)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+			return n
+		}
+		kept, revoked, foreign := newSession(i.ID), newSession(i.ID), newSession(o.ID)
+		err = s.DeleteOtherSessions(i.ID, kept.TokenHash)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be deleted without error, instead got : %s", err))
+		_, err = s.GetSession(revoked.TokenHash)
+		assert.True(t, s.NoRows(err), "expected other session of identity to be deleted")
+		_, err = s.GetSession(kept.TokenHash)
+		assert.NoError(t, err, "expected excepted session to be kept")
+		_, err = s.GetSession(foreign.TokenHash)
+		assert.NoError(t, err, "expected sessions of other identities to be kept")
+	})
+}
+
+func assertSession(t *testing.T, expected, actual model.Session, msg string) {
+	t.Helper()
+	expected.ExpiresAt, expected.CreatedAt = expected.ExpiresAt.UTC(), expected.CreatedAt.UTC()
+	actual.ExpiresAt, actual.CreatedAt = actual.ExpiresAt.UTC(), actual.CreatedAt.UTC()
+	assert.Equal(t, expected, actual, msg)
+}
+
+func testMessages(t *testing.T, s server.Store) {
+	// messages of other runs may be due in shared databases, so due messages are checked by ids
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	newMessage := func(sendAfter time.Time) model.Message {
+		return model.Message{
+			ID:        uuid.NewV4().String(),
+			Via:       "email",
+			Recipient: uuid.NewV4().String() + "@example.com",
+			Template:  "verification_code",
+			Subject:   "subject",
+			Body:      "body",
+			Status:    model.MessageQueued,
+			SendAfter: sendAfter,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+	}
+	early, late, future := newMessage(now.Add(-2*time.Hour)), newMessage(now.Add(-time.Hour)), newMessage(now.Add(time.Hour))
+	claimedIDs := func(now, reclaimBefore time.Time) []string {
+		l, err := s.ClaimMessages(now, reclaimBefore, 1000)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("expected to claim due messages without errors, got %v", err))
+		ids := []string{}
+		for _, m := range l {
+			if m.ID == early.ID || m.ID == late.ID || m.ID == future.ID {
+				assert.Equal(t, model.MessageSending, m.Status, "expected claimed message to be sending")
+				assert.True(t, m.UpdatedAt.Equal(now), "expected claimed message to be updated at claim time")
+				ids = append(ids, m.ID)
+			}
+		}
+		return ids
+	}
+
+	t.Run("should report not existing message as no rows", func(t *testing.T) {
+		_, err := s.GetMessage(early.ID)
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+		err = s.UpdateMessage(early)
+		assert.True(t, s.NoRows(err), "expected update of missing message to be reported as no rows")
+	})
+	t.Run("should enqueue and get message", func(t *testing.T) {
+		for _, m := range []model.Message{late, future, early} {
+			err := s.EnqueueMessage(m)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be queued without error, instead got : %s", err))
+		}
+		found, err := s.GetMessage(early.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get message without errors")
+		assertMessage(t, early, found, "stored message must be equal to input")
+	})
+	t.Run("should reject duplicate id", func(t *testing.T) {
+		err := s.EnqueueMessage(early)
+		assert.True(t, s.Duplicate(err), fmt.Sprintf("expected duplicate error, got %v", err))
+	})
+	t.Run("should claim due messages ordered by send time once", func(t *testing.T) {
+		assert.Equal(t, []string{early.ID, late.ID}, claimedIDs(now, now.Add(-time.Hour)))
+		assert.Empty(t, claimedIDs(now, now.Add(-time.Hour)), "expected claimed messages not to be claimed again")
+		found, err := s.GetMessage(late.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get message without errors")
+		assert.Equal(t, model.MessageSending, found.Status, "expected claim to be stored")
+	})
+	t.Run("should reclaim messages sending for too long", func(t *testing.T) {
+		assert.Equal(t, []string{early.ID, late.ID}, claimedIDs(now.Add(time.Minute), now.Add(time.Millisecond)))
+	})
+	t.Run("should update message", func(t *testing.T) {
+		early.Status, early.Body, early.Attempts, early.UpdatedAt = model.MessageSent, "", 1, now.Add(time.Minute)
+		err := s.UpdateMessage(early)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be updated without error, instead got : %s", err))
+		found, err := s.GetMessage(early.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get message without errors")
+		assertMessage(t, early, found, "stored message must be replaced")
+		assert.Equal(t, []string{late.ID}, claimedIDs(now.Add(2*time.Minute), now.Add(2*time.Minute)), "expected sent message not to be claimed")
+	})
+	t.Run("should list newest messages matching filters", func(t *testing.T) {
+		identityID := uuid.NewV4().String()
+		older, newer, other := newMessage(now), newMessage(now), newMessage(now)
+		older.Recipient, newer.Recipient = other.Recipient, other.Recipient
+		older.IdentityID, newer.IdentityID = identityID, identityID
+		newer.CreatedAt, newer.Status = now.Add(time.Minute), model.MessageSent
+		other.Via = "sms"
+		for _, m := range []model.Message{older, newer, other} {
+			err := s.EnqueueMessage(m)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be queued without error, instead got : %s", err))
+		}
+		ids := func(q model.MessageQuery) []string {
+			l, err := s.ListMessages(q)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("expected to list messages without errors, got %v", err))
+			res := []string{}
+			for _, m := range l {
+				res = append(res, m.ID)
+			}
+			return res
+		}
+		assert.Equal(t, []string{newer.ID, older.ID}, ids(model.MessageQuery{Limit: 10, Recipient: older.Recipient, Via: "email"}))
+		assert.Equal(t, []string{newer.ID}, ids(model.MessageQuery{Limit: 1, IdentityID: identityID}), "expected limit to keep newest")
+		assert.Equal(t, []string{older.ID}, ids(model.MessageQuery{Limit: 10, IdentityID: identityID, Status: model.MessageQueued}))
+		l, err := s.ListMessages(model.MessageQuery{Limit: 10, Recipient: other.Recipient, Via: "sms"})
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("expected to list messages without errors, got %v", err))
+		testutil.FailOnNotEqual(t, len(l), 1, "expected to find message by recipient and channel")
+		assertMessage(t, other, l[0], "listed message must be equal to input")
+	})
+	t.Run("should claim every message by a single of concurrent claims", func(t *testing.T) {
+		queued := []model.Message{}
+		for n := 0; n < 20; n++ {
+			m := newMessage(now.Add(-time.Hour))
+			err := s.EnqueueMessage(m)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be queued without error, instead got : %s", err))
+			queued = append(queued, m)
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		claims := map[string]int{}
+		for n := 0; n < 4; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					l, err := s.ClaimMessages(now, now.Add(-time.Hour), 3)
+					if err != nil || len(l) == 0 {
+						return
+					}
+					mu.Lock()
+					for _, m := range l {
+						claims[m.ID]++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		for _, m := range queued {
+			assert.Equal(t, 1, claims[m.ID], "expected message to be claimed exactly once")
+		}
+	})
+}
+
+func assertMessage(t *testing.T, expected, actual model.Message, msg string) {
+	t.Helper()
+	for _, m := range []*model.Message{&expected, &actual} {
+		m.SendAfter, m.CreatedAt, m.UpdatedAt = m.SendAfter.UTC(), m.CreatedAt.UTC(), m.UpdatedAt.UTC()
+	}
+	assert.Equal(t, expected, actual, msg)
+}
+
+func testCredentials(t *testing.T, s server.Store) {
+	i, other := NewIdentity(), NewIdentity()
+	defer cleanup(s, i.ID)
+	defer cleanup(s, other.ID)
+	for _, v := range []model.Identity{i, other} {
+		_, err := s.Create(v)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	identifier := uuid.NewV4().String() + "@example.com"
+	c := model.Credentials{
+		IdentityID:  i.ID,
+		Type:        model.CredentialsPassword,
+		Identifiers: []string{identifier},
+		Config:      model.JSONObject{model.PasswordConfigKey: "hash"},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	t.Run("should report not existing identifier as no rows", func(t *testing.T) {
+		_, err := s.FindCredentials(model.CredentialsPassword, identifier)
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+	t.Run("should report not existing identity as no rows", func(t *testing.T) {
+		n := c
+		n.IdentityID = uuid.NewV4().String()
+		err := s.PutCredentials(n)
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected no rows error, got %v", err))
+	})
+	t.Run("should put and find credentials", func(t *testing.T) {
+		err := s.PutCredentials(c)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be stored without error, instead got : %s", err))
+		found, err := s.FindCredentials(model.CredentialsPassword, identifier)
+		testutil.FailOnNotEqual(t, err, nil, "expected to find credentials without errors")
+		assertCredentials(t, c, found, "stored credentials must be equal to input")
+		_, err = s.FindCredentials("other", identifier)
+		assert.True(t, s.NoRows(err), "expected identifier to be matched within its type only")
+	})
+	t.Run("should return credentials with identity", func(t *testing.T) {
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		assert.Len(t, found.Credentials, 1)
+		assertCredentials(t, c, found.Credentials[model.CredentialsPassword], "identity credentials must be equal to input")
+	})
+	t.Run("should keep credentials on identity update", func(t *testing.T) {
+		_, err := s.Update(i.ID, i)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be updated without error, instead got : %s", err))
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		assertCredentials(t, c, found.Credentials[model.CredentialsPassword], "identity update must not change credentials")
+	})
+	t.Run("should reject identifier of other identity", func(t *testing.T) {
+		n := c
+		n.IdentityID = other.ID
+		err := s.PutCredentials(n)
+		assert.True(t, s.Duplicate(err), fmt.Sprintf("expected duplicate error, got %v", err))
+	})
+	t.Run("should replace credentials and free old identifiers", func(t *testing.T) {
+		replaced := identifier + ".new"
+		c.Identifiers = []string{replaced}
+		c.Config = model.JSONObject{model.PasswordConfigKey: "other"}
+		c.UpdatedAt = now.Add(time.Minute)
+		err := s.PutCredentials(c)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be replaced without error, instead got : %s", err))
+		found, err := s.FindCredentials(model.CredentialsPassword, replaced)
+		testutil.FailOnNotEqual(t, err, nil, "expected to find credentials without errors")
+		assertCredentials(t, c, found, "stored credentials must be replaced")
+		n := c
+		n.IdentityID, n.Identifiers = other.ID, []string{identifier}
+		err = s.PutCredentials(n)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("expected old identifier to be free, got %v", err))
+	})
+	t.Run("should store credentials without identifiers for many identities", func(t *testing.T) {
+		for _, id := range []string{i.ID, other.ID} {
+			totp := model.Credentials{
+				IdentityID:  id,
+				Type:        model.CredentialsTOTP,
+				Identifiers: []string{},
+				Config:      model.JSONObject{model.TOTPSecretKey: "secret-" + id},
+				CreatedAt:   now,
+				UpdatedAt:   now,
+			}
+			err := s.PutCredentials(totp)
+			testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be stored without error, instead got : %s", err))
+			found, err := s.Get(id)
+			testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+			assertCredentials(t, totp, found.Credentials[model.CredentialsTOTP], "stored credentials must be equal to input")
+		}
+	})
+	t.Run("should delete credentials with identity", func(t *testing.T) {
+		err := s.Delete(other.ID, 0)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be deleted without error, instead got : %s", err))
+		_, err = s.FindCredentials(model.CredentialsPassword, identifier)
+		assert.True(t, s.NoRows(err), "expected credentials of deleted identity to be reported as no rows")
+	})
+}
+
+func testTOTPCredentials(t *testing.T, s server.Store) {
+	i := NewIdentity()
+	defer cleanup(s, i.ID)
+	_, err := s.Create(i)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be created without error, instead got : %s", err))
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	c := model.Credentials{
+		IdentityID:  i.ID,
+		Type:        model.CredentialsTOTP,
+		Identifiers: []string{},
+		Config: model.JSONObject{
+			model.TOTPSecretKey:        "secret",
+			model.TOTPLastStepKey:      int64(10),
+			model.TOTPRecoveryCodesKey: []string{"a", "b", "c"},
+		},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = s.PutCredentials(c)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be stored without error, instead got : %s", err))
+	stored := func() model.Credentials {
+		found, err := s.Get(i.ID)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get identity without errors")
+		return found.Credentials[model.CredentialsTOTP]
+	}
+	// concurrently runs n calls of f and returns how many of them succeeded
+	race := func(n int, f func() error) int {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		succeeded := 0
+		for k := 0; k < n; k++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := f()
+				if err != nil {
+					assert.True(t, s.NoRows(err), fmt.Sprintf("expected rejected call to be reported as no rows, got %v", err))
+					return
+				}
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return succeeded
+	}
+
+	t.Run("should report not existing credentials as no rows", func(t *testing.T) {
+		id := uuid.NewV4().String()
+		err := s.MergeCredentialsConfig(id, model.CredentialsTOTP, model.JSONObject{"k": "v"}, nil, now)
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected no rows error on merge, got %v", err))
+		_, err = s.IncrementTOTPAttempts(id, now, now.Add(-time.Minute))
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected no rows error on attempt, got %v", err))
+		err = s.ConsumeTOTPStep(id, 20, now)
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected no rows error on step, got %v", err))
+		err = s.UseTOTPRecoveryCode(id, "a", now)
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected no rows error on recovery code, got %v", err))
+	})
+	t.Run("should merge config keeping other keys", func(t *testing.T) {
+		err := s.MergeCredentialsConfig(i.ID, model.CredentialsTOTP, model.JSONObject{model.TOTPPendingSecretKey: "pending"}, nil, now)
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be merged without error, instead got : %s", err))
+		found := stored()
+		assert.Equal(t, "pending", found.TOTPPendingSecret())
+		assert.Equal(t, "secret", found.TOTPSecret())
+		assert.Equal(t, []string{"a", "b", "c"}, found.TOTPRecoveryCodes())
+		err = s.MergeCredentialsConfig(i.ID, model.CredentialsTOTP, nil, []string{model.TOTPPendingSecretKey}, now.Add(time.Second))
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be merged without error, instead got : %s", err))
+		found = stored()
+		assert.Empty(t, found.TOTPPendingSecret(), "expected unset key to be deleted")
+		assert.Equal(t, "secret", found.TOTPSecret())
+		assert.Equal(t, now.Add(time.Second), found.UpdatedAt.UTC())
+	})
+	t.Run("should count concurrent attempts atomically", func(t *testing.T) {
+		assert.Equal(t, 10, race(10, func() error {
+			_, err := s.IncrementTOTPAttempts(i.ID, now, now.Add(-time.Minute))
+			return err
+		}))
+		found, err := s.IncrementTOTPAttempts(i.ID, now, now.Add(-time.Minute))
+		testutil.FailOnNotEqual(t, err, nil, "expected to count attempt without errors")
+		assert.EqualValues(t, 11, found.TOTPAttempts(), "expected every attempt to be counted")
+		assert.Equal(t, "secret", found.TOTPSecret(), "expected attempt to return credentials")
+	})
+	t.Run("should restart count when its window passed", func(t *testing.T) {
+		later := now.Add(time.Hour)
+		found, err := s.IncrementTOTPAttempts(i.ID, later, now)
+		testutil.FailOnNotEqual(t, err, nil, "expected to count attempt without errors")
+		assert.EqualValues(t, 1, found.TOTPAttempts(), "expected count to restart")
+		assert.Equal(t, model.UnixMillis(later), found.TOTPAttemptsSince())
+		found, err = s.IncrementTOTPAttempts(i.ID, later, now)
+		testutil.FailOnNotEqual(t, err, nil, "expected to count attempt without errors")
+		assert.EqualValues(t, 2, found.TOTPAttempts(), "expected count to continue within its window")
+	})
+	t.Run("should accept every totp step once by concurrent calls", func(t *testing.T) {
+		err := s.ConsumeTOTPStep(i.ID, 10, now)
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected stored step to be rejected as no rows, got %v", err))
+		assert.Equal(t, 1, race(10, func() error { return s.ConsumeTOTPStep(i.ID, 11, now) }), "expected step to be accepted once")
+		found := stored()
+		assert.EqualValues(t, 11, found.TOTPLastStep())
+		assert.EqualValues(t, 0, found.TOTPAttempts(), "expected accepted step to reset attempts")
+		err = s.ConsumeTOTPStep(i.ID, 9, now)
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected older step to be rejected as no rows, got %v", err))
+	})
+	t.Run("should accept every recovery code once by concurrent calls", func(t *testing.T) {
+		_, err := s.IncrementTOTPAttempts(i.ID, now, now.Add(-time.Minute))
+		testutil.FailOnNotEqual(t, err, nil, "expected to count attempt without errors")
+		assert.Equal(t, 1, race(10, func() error { return s.UseTOTPRecoveryCode(i.ID, "b", now) }), "expected code to be used once")
+		found := stored()
+		assert.Equal(t, []string{"a", "c"}, found.TOTPRecoveryCodes(), "expected other codes to be kept")
+		assert.EqualValues(t, 0, found.TOTPAttempts(), "expected used code to reset attempts")
+		err = s.UseTOTPRecoveryCode(i.ID, "unknown", now)
+		assert.True(t, s.NoRows(err), fmt.Sprintf("expected unknown code to be rejected as no rows, got %v", err))
+	})
+	t.Run("should use different recovery codes concurrently", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for _, h := range []string{"a", "c"} {
+			wg.Add(1)
+			go func(h string) {
+				defer wg.Done()
+				assert.NoError(t, s.UseTOTPRecoveryCode(i.ID, h, now), "expected code to be used")
+			}(h)
+		}
+		wg.Wait()
+		assert.Empty(t, stored().TOTPRecoveryCodes(), "expected both codes to be removed")
+	})
+}
+
+func assertCredentials(t *testing.T, expected, actual model.Credentials, msg string) {
+	t.Helper()
+	expected.CreatedAt, expected.UpdatedAt = expected.CreatedAt.UTC(), expected.UpdatedAt.UTC()
+	actual.CreatedAt, actual.UpdatedAt = actual.CreatedAt.UTC(), actual.UpdatedAt.UTC()
+	assert.Equal(t, expected, actual, msg)
+}
+
+func testSchemas(t *testing.T, s server.Store) {
+	id := "conformance-" + uuid.NewV4().String()
+
+	t.Run("should report not existing schema as no rows", func(t *testing.T) {
+		_, err := s.GetSchema(id)
+		assert.True(t, s.NoRows(err), "expected error to be reported as no rows")
+	})
+	t.Run("should put and get schema", func(t *testing.T) {
+		err := s.PutSchema(model.IdentitySchema{ID: id, Schema: json.RawMessage(`{"type":"object"}`)})
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be stored without error, instead got : %s", err))
+		found, err := s.GetSchema(id)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get schema without errors")
+		assert.Equal(t, id, found.ID)
+		assert.JSONEq(t, `{"type":"object"}`, string(found.Schema))
+	})
+	t.Run("should replace schema", func(t *testing.T) {
+		err := s.PutSchema(model.IdentitySchema{ID: id, Schema: json.RawMessage(`{"type":"object","required":["$id"]}`)})
+		testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("must be replaced without error, instead got : %s", err))
+		found, err := s.GetSchema(id)
+		testutil.FailOnNotEqual(t, err, nil, "expected to get schema without errors")
+		assert.JSONEq(t, `{"type":"object","required":["$id"]}`, string(found.Schema))
+	})
+	t.Run("should list schema once", func(t *testing.T) {
+		l, err := s.ListSchemas()
+		testutil.FailOnNotEqual(t, err, nil, "expected to list schemas without errors")
+		n := 0
+		for _, v := range l {
+			if v.ID == id {
+				n++
+			}
+		}
+		assert.Equal(t, 1, n, "expected schema to be listed once")
+		assert.True(t, sort.SliceIsSorted(l, func(i, j int) bool { return l[i].ID < l[j].ID }), "expected schemas to be ordered by id")
+	})
+}
+
+// NewIdentity returns identity with unique ids and address values, filled with every supported field
+func NewIdentity() model.Identity {
+	verifiedAt := time.Now().Add(-time.Hour)
+	expiresAt := time.Now().Add(time.Hour)
+	return model.Identity{
+		ID: uuid.NewV4().String(),
+		RecoveryAddresses: []model.RecoveryAddress{
+			{Address: model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String() + "@example.com", Via: "email"}},
+			{Address: model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String(), Via: "sms"}},
+		},
+		SchemaID:  "default",
+		SchemaURL: "https://example.com/schemas/default",
+		Traits: model.JSONObject{
+			"email": uuid.NewV4().String() + "@example.com",
+			"name":  map[string]interface{}{"first": "Alice", "last": "Smith"},
+			"age":   float64(42),
+			"admin": false,
+		},
+		MetadataPublic: model.JSONObject{"plan": "free"},
+		MetadataAdmin:  model.JSONObject{"fraud_score": float64(0.1), "flags": []interface{}{"beta"}},
+		VerifiableAddresses: []model.VerifiableAddress{
+			{
+				Address:    model.Address{ID: uuid.NewV4().String(), Value: uuid.NewV4().String() + "@example.com", Via: "email"},
+				Verified:   true,
+				VerifiedAt: &verifiedAt,
+				ExpiresAt:  &expiresAt,
+			},
+		},
+	}
+}
+
+// AssertIdentity compares identities ignoring versions, timestamps, address order, storage precision of times
+// and the difference between nil and empty address lists and json objects
+func AssertIdentity(t *testing.T, expected, actual model.Identity, msg string) {
+	t.Helper()
+	assert.Equal(t, normalize(expected), normalize(actual), msg)
+}
+
+func normalize(i model.Identity) model.Identity {
+	i.Version = 0
+	i.CreatedAt, i.UpdatedAt = time.Time{}, time.Time{}
+	i.Credentials = nil
+	for _, o := range []*model.JSONObject{&i.Traits, &i.MetadataPublic, &i.MetadataAdmin} {
+		if len(*o) == 0 {
+			*o = nil
+		}
+	}
+	ra := make([]model.RecoveryAddress, len(i.RecoveryAddresses))
+	for n, a := range i.RecoveryAddresses {
+		a.Identity = ""
+		a.CreatedAt, a.UpdatedAt = time.Time{}, time.Time{}
+		ra[n] = a
+	}
+	sort.Slice(ra, func(x, y int) bool { return ra[x].ID < ra[y].ID })
+	i.RecoveryAddresses = ra
+	va := make([]model.VerifiableAddress, len(i.VerifiableAddresses))
+	for n, a := range i.VerifiableAddresses {
+		a.Identity = ""
+		a.CreatedAt, a.UpdatedAt = time.Time{}, time.Time{}
+		a.ExpiresAt = normalizeTime(a.ExpiresAt)
+		a.VerifiedAt = normalizeTime(a.VerifiedAt)
+		va[n] = a
+	}
+	sort.Slice(va, func(x, y int) bool { return va[x].ID < va[y].ID })
+	i.VerifiableAddresses = va
+	return i
+}
+
+func normalizeTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	n := t.UTC().Truncate(time.Millisecond)
+	return &n
+}
+
+// saveIdentityRecords stores a verification code, a recovery token, a session and a queued message of the identity
+func saveIdentityRecords(t *testing.T, s server.Store, i model.Identity) (model.VerificationCode, model.RecoveryToken, model.Session, model.Message) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	code := model.VerificationCode{
+		AddressID:  i.RecoveryAddresses[0].ID,
+		IdentityID: i.ID,
+		CodeHash:   uuid.NewV4().String(),
+		ExpiresAt:  now.Add(time.Hour),
+		CreatedAt:  now,
+	}
+	err := s.SaveVerificationCode(code)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("verification code must be saved without error, instead got : %s", err))
+	token := model.RecoveryToken{
+		TokenHash:  uuid.NewV4().String(),
+		IdentityID: i.ID,
+		AddressID:  i.RecoveryAddresses[0].ID,
+		ExpiresAt:  now.Add(time.Hour),
+		CreatedAt:  now,
+	}
+	err = s.SaveRecoveryToken(token)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("recovery token must be saved without error, instead got : %s", err))
+	session := model.Session{
+		ID:         uuid.NewV4().String(),
+		TokenHash:  uuid.NewV4().String(),
+		IdentityID: i.ID,
+		AAL:        model.AAL1,
+		ExpiresAt:  now.Add(time.Hour),
+		CreatedAt:  now,
+	}
+	err = s.CreateSession(session)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("session must be created without error, instead got : %s", err))
+	message := model.Message{
+		ID:         uuid.NewV4().String(),
+		Via:        "email",
+		Recipient:  i.RecoveryAddresses[0].Value,
+		IdentityID: i.ID,
+		Template:   "recovery_token",
+		Body:       "body",
+		Status:     model.MessageQueued,
+		SendAfter:  now,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	err = s.EnqueueMessage(message)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("message must be enqueued without error, instead got : %s", err))
+	return code, token, session, message
+}
+
+func cleanup(s server.Store, id string) {
+	s.Delete(id, 0)
+}
+
+func testPing(t *testing.T, s server.Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.Ping(ctx)
+	testutil.FailOnNotEqual(t, err, nil, fmt.Sprintf("expected reachable store to be pinged without error, got %v", err))
+}
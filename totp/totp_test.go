@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA-1 key of RFC 6238 test vectors
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B vectors truncated to 6 digits
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, expected := range cases {
+		code, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, "code at %d", unix)
+	}
+	_, err := Code("not base32!", 1)
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		require.NoError(t, err)
+		return c
+	}
+
+	step, ok := Validate(rfcSecret, code(current), now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, current, step)
+	_, ok = Validate(rfcSecret, code(current-1), now, 0)
+	assert.True(t, ok, "expected previous period code to be accepted")
+	_, ok = Validate(rfcSecret, code(current+1), now, 0)
+	assert.True(t, ok, "expected next period code to be accepted")
+	_, ok = Validate(rfcSecret, code(current-2), now, 0)
+	assert.False(t, ok, "expected old code to be rejected")
+	_, ok = Validate(rfcSecret, code(current), now, current)
+	assert.False(t, ok, "expected used code to be rejected")
+	_, ok = Validate(rfcSecret, "000000", now, 0)
+	assert.False(t, ok)
+}
+
+func TestSecretAndURI(t *testing.T) {
+	secret, err := NewSecret()
+	require.NoError(t, err)
+	_, err = Code(secret, 1)
+	require.NoError(t, err)
+	u, err := url.Parse(URI("kr.api", "alice@example.com", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/kr.api:alice@example.com", u.Path)
+	assert.Equal(t, secret, u.Query().Get("secret"))
+	assert.Equal(t, "kr.api", u.Query().Get("issuer"))
+	assert.Equal(t, "6", u.Query().Get("digits"))
+}